@@ -4,122 +4,34 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
-	"time"
 
-	"github.com/stolostron/provider-credential-controller/controllers/providercredential"
-	"go.uber.org/zap/zapcore"
-	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/labels"
-	"k8s.io/apimachinery/pkg/runtime"
-	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"github.com/stolostron/provider-credential-controller/pkg/config"
+	"github.com/stolostron/provider-credential-controller/pkg/manager"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
-	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
-	"sigs.k8s.io/controller-runtime/pkg/cache"
-	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	// +kubebuilder:scaffold:imports
 )
 
-var (
-	scheme   = runtime.NewScheme()
-	setupLog = ctrl.Log.WithName("setup")
-)
-
-func init() {
-	_ = clientgoscheme.AddToScheme(scheme)
-
-	_ = corev1.AddToScheme(scheme)
-}
+var setupLog = ctrl.Log.WithName("setup")
 
 func main() {
-	var metricsAddr string
-
-	var enableLeaderElection bool
-
-	var leaderElectionLeaseDuration time.Duration
-
-	var leaderElectionRenewDeadline time.Duration
-
-	var leaderElectionRetryPeriod time.Duration
-
-	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
-	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
-		"Enable leader election for controller manager. "+
-			"Enabling this will ensure there is only one active controller manager.")
-	flag.DurationVar(
-		&leaderElectionLeaseDuration,
-		"leader-election-lease-duration",
-		137*time.Second,
-		"The duration that non-leader candidates will wait after observing a leadership "+
-			"renewal until attempting to acquire leadership of a led but unrenewed leader "+
-			"slot. This is effectively the maximum duration that a leader can be stopped "+
-			"before it is replaced by another candidate. This is only applicable if leader "+
-			"election is enabled.",
-	)
-	flag.DurationVar(
-		&leaderElectionRenewDeadline,
-		"leader-election-renew-deadline",
-		107*time.Second,
-		"The interval between attempts by the acting master to renew a leadership slot "+
-			"before it stops leading. This must be less than or equal to the lease duration. "+
-			"This is only applicable if leader election is enabled.",
-	)
-	flag.DurationVar(
-		&leaderElectionRetryPeriod,
-		"leader-election-retry-period",
-		26*time.Second,
-		"The duration the clients should wait between attempting acquisition and renewal "+
-			"of a leadership. This is only applicable if leader election is enabled.",
-	)
+	opts := manager.NewOptions()
+	opts.AddFlags(flag.CommandLine)
 	flag.Parse()
 
-	// To run in debug change zapcore.InfoLevel to zapcore.DebugLevel
-	ctrl.SetLogger(zap.New(zap.UseDevMode(true), zap.Level(zapcore.InfoLevel)))
-
-	setupLog.Info("Leader election settings", "enableLeaderElection", enableLeaderElection,
-		"leaseDuration", leaderElectionLeaseDuration,
-		"renewDeadline", leaderElectionRenewDeadline,
-		"retryPeriod", leaderElectionRetryPeriod)
-
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:             scheme,
-		MetricsBindAddress: metricsAddr,
-		Port:               9443,
-		NewCache: func(config *rest.Config, opts cache.Options) (cache.Cache, error) {
-			opts.ByObject = map[client.Object]cache.ByObject{
-				&corev1.Secret{}: {
-					Label: labels.SelectorFromSet(labels.Set{providercredential.CredentialLabel: ""}),
-				}}
-			return cache.New(config, opts)
-		},
-		LeaderElection:   enableLeaderElection,
-		LeaderElectionID: "provider-credential-controller.open-cluster-management.io",
-		LeaseDuration:    &leaderElectionLeaseDuration,
-		RenewDeadline:    &leaderElectionRenewDeadline,
-		RetryPeriod:      &leaderElectionRetryPeriod,
-	})
+	store, err := config.NewStore(opts.ConfigFile)
 	if err != nil {
-		setupLog.Error(err, "unable to start manager")
-		os.Exit(1)
-	}
-
-	if err = (&providercredential.ProviderCredentialSecretReconciler{
-		Client:    mgr.GetClient(),
-		APIReader: mgr.GetAPIReader(),
-		Log:       ctrl.Log.WithName("controllers").WithName("ProviderCredentialSecretReconciler"),
-		Scheme:    mgr.GetScheme(),
-		Recorder:  mgr.GetEventRecorderFor("provider-credential-controller"),
-	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "ProviderCredentialSecretReconciler")
+		fmt.Fprintf(os.Stderr, "invalid configuration %s: %v\n", opts.ConfigFile, err)
 		os.Exit(1)
 	}
-	// +kubebuilder:scaffold:builder
 
-	setupLog.Info("starting manager")
+	// To run in debug set logging.level to debug in the configuration file
+	ctrl.SetLogger(zap.New(zap.UseDevMode(true), zap.Level(store.LogLevel())))
 
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	if err := manager.Run(ctrl.SetupSignalHandler(), opts, store); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
@@ -0,0 +1,95 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package oldproviderconnection
+
+import (
+	"context"
+
+	"github.com/stolostron/provider-credential-controller/controllers/providercredential"
+	"github.com/stolostron/provider-credential-controller/pkg/apply"
+	"github.com/stolostron/provider-credential-controller/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// legacyCopySuffixes lists, by provider type, the suffixes appended to the
+// cluster name when copies were made from legacy provider connections:
+// <cluster>-<suffix>-creds, in the ManagedCluster namespace.
+var legacyCopySuffixes = map[string][]string{
+	"aws": {"aws"},
+	"azr": {"azure", "azr"},
+	"gcp": {"gcp"},
+	"vmw": {"vsphere", "vmw"},
+	"ost": {"openstack", "ost"},
+}
+
+// legacyCopyNames returns the names a legacy copy of a "credType" provider
+// connection may have in the namespace of "cluster".
+func legacyCopyNames(cluster, credType string) []string {
+	names := []string{}
+	for _, suffix := range legacyCopySuffixes[credType] {
+		names = append(names, cluster+"-"+suffix+"-creds")
+	}
+	return names
+}
+
+// adoptLegacyCopies finds the copies made from the legacy form of the
+// migrated secret "secret" in Joined ManagedCluster namespaces, and labels
+// them as copied from it so the next rotation reaches them. A copy is only
+// adopted when its data hashes to "hash", the secret's CredentialHash, and it
+// is not already labelled as a copy of another secret. Copies owned by a
+// GitOps tool according to "cfg" are left alone. It returns the adopted
+// copies as namespace/name.
+func adoptLegacyCopies(ctx context.Context, c client.Client, reader client.Reader, cfg *config.Configuration, secret *corev1.Secret, hash string) ([]string, error) {
+	credType := secret.Labels[providercredential.ProviderTypeLabel]
+	if len(legacyCopySuffixes[credType]) == 0 {
+		return nil, nil
+	}
+
+	namespaces, err := providercredential.JoinedManagedClusterNamespaces(ctx, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	adopted := []string{}
+	for _, namespace := range namespaces {
+		for _, name := range legacyCopyNames(namespace, credType) {
+			var copied corev1.Secret
+			if err := reader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, &copied); err != nil {
+				if k8serrors.IsNotFound(err) {
+					continue
+				}
+				return nil, err
+			}
+
+			if _, labelled := copied.Labels[providercredential.CopiedFromNameLabel]; labelled {
+				continue
+			}
+			if managedBy := providercredential.GitOpsOwner(&copied, cfg); managedBy != "" {
+				klog.V(0).Info("Not adopting " + namespace + "/" + name + ", it is managed by GitOps (" + managedBy + ")")
+				continue
+			}
+			copiedHash, err := providercredential.DataHash(copied.Data)
+			if err != nil || copiedHash != hash {
+				klog.V(0).Info("Not adopting " + namespace + "/" + name + ", its data does not match " +
+					secret.Namespace + "/" + secret.Name)
+				continue
+			}
+
+			labelled := apply.NewSecret(namespace, name, copied.ResourceVersion)
+			labelled.Labels = map[string]string{
+				providercredential.CopiedFromNamespaceLabel: secret.Namespace,
+				providercredential.CopiedFromNameLabel:      secret.Name,
+			}
+			if err := apply.Secret(ctx, c, FieldManager, labelled); err != nil {
+				return nil, err
+			}
+			klog.V(0).Info("Adopted legacy copy " + namespace + "/" + name + " of " + secret.Namespace + "/" + secret.Name)
+			adopted = append(adopted, namespace+"/"+name)
+		}
+	}
+	return adopted, nil
+}
@@ -0,0 +1,142 @@
+package oldproviderconnection
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/stolostron/provider-credential-controller/controllers/providercredential"
+	"github.com/stolostron/provider-credential-controller/pkg/config"
+)
+
+func TestMigrationAdoptsLegacyCopies(t *testing.T) {
+	secret := newSecret("providers", "my-aws", map[string]string{
+		ProviderLabel:        "aws",
+		CloudConnectionLabel: "",
+	}, "awsAccessKeyID: a\nawsSecretAccessKeyID: b\nbaseDomain: example.com")
+
+	copyData := map[string][]byte{
+		"aws_access_key_id":     []byte("a"),
+		"aws_secret_access_key": []byte("b"),
+	}
+	staleData := map[string][]byte{
+		"aws_access_key_id":     []byte("a"),
+		"aws_secret_access_key": []byte("old"),
+	}
+
+	gitOpsCopy := newLegacyCopy("cluster4", "cluster4-aws-creds", copyData)
+	gitOpsCopy.Annotations = map[string]string{providercredential.SkipCredentialSyncAnnotation: "true"}
+
+	fakeClient := fake.NewFakeClient(
+		secret,
+		newManagedCluster("cluster4", true),
+		gitOpsCopy,
+		newManagedCluster("cluster1", true),
+		newManagedCluster("cluster2", true),
+		newManagedCluster("cluster3", false),
+		newLegacyCopy("cluster1", "cluster1-aws-creds", copyData),
+		newLegacyCopy("cluster2", "cluster2-aws-creds", staleData),
+		newLegacyCopy("cluster3", "cluster3-aws-creds", copyData),
+	)
+
+	reconciler := &OldProviderConnectionReconciler{
+		Client:    fakeClient,
+		APIReader: fakeClient,
+		Log:       ctrl.Log.WithName("controllers").WithName("OldProviderConnectionReconciler"),
+		Scheme:    scheme.Scheme,
+		Recorder:  record.NewFakeRecorder(10),
+	}
+	if _, err := reconciler.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name},
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	var migrated corev1.Secret
+	if err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name}, &migrated); err != nil {
+		t.Fatalf("failed to fetch secret: %v", err)
+	}
+	expectedHash, err := providercredential.CredentialDataHash(migrated, config.Default())
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if migrated.Annotations[providercredential.CredentialHash] != expectedHash {
+		t.Fatalf("expected %v %v, but got %v", providercredential.CredentialHash, expectedHash,
+			migrated.Annotations[providercredential.CredentialHash])
+	}
+
+	var migration MigrationRecord
+	if err := json.Unmarshal([]byte(migrated.Annotations[MigrationRecordAnnotation]), &migration); err != nil {
+		t.Fatalf("expected a migration record: %v", err)
+	}
+	if !reflect.DeepEqual(migration.AdoptedCopies, []string{"cluster1/cluster1-aws-creds"}) {
+		t.Fatalf("expected only cluster1/cluster1-aws-creds to be adopted, but got %v", migration.AdoptedCopies)
+	}
+
+	for namespace, adopted := range map[string]bool{"cluster1": true, "cluster2": false, "cluster3": false} {
+		var copied corev1.Secret
+		if err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: namespace + "-aws-creds"}, &copied); err != nil {
+			t.Fatalf("failed to fetch copy: %v", err)
+		}
+		labelled := copied.Labels[providercredential.CopiedFromNamespaceLabel] == secret.Namespace &&
+			copied.Labels[providercredential.CopiedFromNameLabel] == secret.Name
+		if labelled != adopted {
+			t.Fatalf("expected %v/%v adopted=%v, but got labels %v", namespace, copied.Name, adopted, copied.Labels)
+		}
+	}
+}
+
+func TestLegacyCopyNames(t *testing.T) {
+	tests := []struct {
+		credType string
+		expected []string
+	}{
+		{"aws", []string{"c1-aws-creds"}},
+		{"azr", []string{"c1-azure-creds", "c1-azr-creds"}},
+		{"vmw", []string{"c1-vsphere-creds", "c1-vmw-creds"}},
+		{"ans", []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.credType, func(t *testing.T) {
+			if names := legacyCopyNames("c1", tt.credType); !reflect.DeepEqual(names, tt.expected) {
+				t.Fatalf("expected %v, but got %v", tt.expected, names)
+			}
+		})
+	}
+}
+
+func newLegacyCopy(namespace, name string, data map[string][]byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Data:       data,
+	}
+}
+
+func newManagedCluster(name string, joined bool) *unstructured.Unstructured {
+	mc := &unstructured.Unstructured{}
+	mc.SetGroupVersionKind(providercredential.ManagedClusterGVK)
+	mc.SetName(name)
+
+	if joined {
+		_ = unstructured.SetNestedSlice(mc.Object, []interface{}{
+			map[string]interface{}{
+				"type":   "ManagedClusterJoined",
+				"status": "True",
+			},
+		}, "status", "conditions")
+	}
+
+	return mc
+}
@@ -0,0 +1,210 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package oldproviderconnection
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// legacyFieldType is the YAML type a legacy metadata key must hold.
+type legacyFieldType int
+
+const (
+	// scalarField holds a string, number or boolean, written as its text.
+	scalarField legacyFieldType = iota
+	// stringListField holds a list of strings, written one per line. A single
+	// string is accepted as is.
+	stringListField
+)
+
+// legacyField describes one key of the legacy metadata document.
+type legacyField struct {
+	Type     legacyFieldType
+	Required bool
+}
+
+// legacySchema lists the metadata keys known for a legacy provider type.
+// Other keys are migrated as scalars, and reported when the provider type has
+// a schema.
+type legacySchema map[string]legacyField
+
+// commonLegacyFields are the keys every legacy provider connection may carry.
+var commonLegacyFields = legacySchema{
+	"baseDomain":            {},
+	"pullSecret":            {},
+	"sshPrivatekey":         {},
+	"sshPublickey":          {},
+	"sshKnownHosts":         {Type: stringListField},
+	"isOcp":                 {},
+	"httpProxy":             {},
+	"httpsProxy":            {},
+	"noProxy":               {},
+	"additionalTrustBundle": {},
+}
+
+// legacySchemas holds the provider specific keys, by legacy provider label.
+var legacySchemas = map[string]legacySchema{
+	"aws": {
+		"awsAccessKeyID":       {},
+		"awsSecretAccessKeyID": {},
+	},
+	"azr": {
+		"baseDomainResourceGroupName": {},
+		"clientId":                    {Required: true},
+		"clientSecret":                {Required: true},
+		"tenantId":                    {Required: true},
+		"subscriptionId":              {Required: true},
+	},
+	"gcp": {
+		"gcProjectID":         {},
+		"gcServiceAccountKey": {},
+	},
+	"vmw": {
+		"username":      {},
+		"password":      {},
+		"vcenter":       {},
+		"cacertificate": {},
+		"vmClusterName": {},
+		"datacenter":    {},
+		"datastore":     {},
+	},
+	"ost": {
+		"openstackCloudsYaml": {},
+		"openstackCloud":      {},
+	},
+	"redhatvirtualization": {
+		"ovirtUrl":      {Required: true},
+		"ovirtFqdn":     {},
+		"ovirtUsername": {Required: true},
+		"ovirtPassword": {Required: true},
+		"ovirtCABundle": {},
+	},
+	"bm": {
+		"libvirtURI":       {Required: true},
+		"imageMirror":      {},
+		"bootstrapOSImage": {},
+		"clusterOSImage":   {},
+	},
+}
+
+// fieldFor returns the schema of "key" for "credType", falling back to the
+// common keys and then to a scalar. The second result is false when
+// "credType" has a schema that does not know "key".
+func fieldFor(credType, key string) (legacyField, bool) {
+	if field, ok := legacySchemas[credType][key]; ok {
+		return field, true
+	}
+	if field, ok := commonLegacyFields[key]; ok {
+		return field, true
+	}
+	_, typed := legacySchemas[credType]
+	return legacyField{}, !typed
+}
+
+// parseLegacyMetadata strictly decodes the legacy metadata document and
+// checks it against the schema of "credType", reporting every offending key.
+// It returns the text written for each key: scalars are kept as written in
+// the document, so a value such as 1e+06 is not reformatted. Keys unknown to
+// the schema of "credType" are kept when they hold a scalar and returned,
+// sorted, as the second result. A document that can never be migrated
+// returns an invalidMetadataError.
+func parseLegacyMetadata(credType string, raw []byte) (map[string]string, []string, error) {
+	if len(raw) == 0 {
+		return nil, nil, &invalidMetadataError{"did not find any credential information with key: metadata"}
+	}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(raw, &document); err != nil {
+		return nil, nil, &invalidMetadataError{"metadata is not a valid YAML mapping: " + err.Error()}
+	}
+	if len(document.Content) != 1 || document.Content[0].Kind != yaml.MappingNode {
+		return nil, nil, &invalidMetadataError{"metadata is not a valid YAML mapping"}
+	}
+	mapping := document.Content[0]
+
+	providerMetadata := map[string]string{}
+	var problems, unknown []string
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		keyNode, valueNode := mapping.Content[i], resolveAlias(mapping.Content[i+1])
+		if keyNode.Kind != yaml.ScalarNode {
+			return nil, nil, &invalidMetadataError{fmt.Sprintf("metadata is not a valid YAML mapping: line %d: keys must be strings", keyNode.Line)}
+		}
+		key := keyNode.Value
+		if _, duplicate := providerMetadata[key]; duplicate {
+			return nil, nil, &invalidMetadataError{fmt.Sprintf("metadata is not a valid YAML mapping: line %d: key %q already set", keyNode.Line, key)}
+		}
+
+		field, known := fieldFor(credType, key)
+		if !known {
+			unknown = append(unknown, key)
+		}
+		value, err := encodeLegacyValue(key, field, valueNode)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		providerMetadata[key] = value
+	}
+
+	for key, field := range legacySchemas[credType] {
+		if field.Required && providerMetadata[key] == "" {
+			problems = append(problems, "metadata."+key+" is required")
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, nil, &invalidMetadataError{strings.Join(problems, "; ")}
+	}
+	sort.Strings(unknown)
+	return providerMetadata, unknown, nil
+}
+
+// encodeLegacyValue returns the text written for a legacy metadata value. A
+// null value is written as empty.
+func encodeLegacyValue(key string, field legacyField, value *yaml.Node) (string, error) {
+	if field.Type == stringListField && value.Kind == yaml.SequenceNode {
+		lines := make([]string, 0, len(value.Content))
+		for i, item := range value.Content {
+			item = resolveAlias(item)
+			if item.Kind != yaml.ScalarNode || item.Tag == "!!null" {
+				return "", fmt.Errorf("metadata.%s[%d] must be a string, got %s", key, i, yamlType(item))
+			}
+			lines = append(lines, item.Value)
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+
+	if value.Kind == yaml.ScalarNode {
+		if value.Tag == "!!null" {
+			return "", nil
+		}
+		return value.Value, nil
+	}
+	if field.Type == stringListField {
+		return "", fmt.Errorf("metadata.%s must be a list of strings, got %s", key, yamlType(value))
+	}
+	return "", fmt.Errorf("metadata.%s must be a string, got %s", key, yamlType(value))
+}
+
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	return node
+}
+
+func yamlType(node *yaml.Node) string {
+	switch {
+	case node.Kind == yaml.SequenceNode:
+		return "a list"
+	case node.Kind == yaml.MappingNode:
+		return "a mapping"
+	case node.Tag == "!!null":
+		return "null"
+	default:
+		return strings.TrimPrefix(node.Tag, "!!")
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package oldproviderconnection
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Outcomes counted by migrationsTotal.
+const (
+	outcomeMigrated = "migrated"
+	outcomeFailed   = "failed"
+	outcomeReverted = "reverted"
+)
+
+var migrationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "provider_credential_legacy_migrations_total",
+	Help: "Number of legacy provider connections migrated, newly refused or reverted, by outcome (migrated, failed, reverted).",
+}, []string{"outcome"})
+
+var legacyRemainingDesc = prometheus.NewDesc(
+	"provider_credential_legacy_secrets_remaining",
+	"Number of secrets still in the legacy provider connection form, by migration status.",
+	[]string{"status"}, nil,
+)
+
+func init() {
+	metrics.Registry.MustRegister(migrationsTotal)
+	for _, outcome := range []string{outcomeMigrated, outcomeFailed, outcomeReverted} {
+		migrationsTotal.WithLabelValues(outcome)
+	}
+}
+
+// remainingCollector counts the legacy secrets held in the controller's cache
+// when scraped, so the gauge is exact even when nothing reconciles.
+type remainingCollector struct {
+	reader client.Reader
+}
+
+func (c *remainingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- legacyRemainingDesc
+}
+
+// Collect reports nothing until the cache can be listed.
+func (c *remainingCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	secrets := &corev1.SecretList{}
+	if err := c.reader.List(ctx, secrets, client.HasLabels{CloudConnectionLabel}); err != nil {
+		return
+	}
+
+	counts := map[string]float64{"pending": 0, MigrationFailed: 0, "reverted": 0}
+	for i := range secrets.Items {
+		switch {
+		case secrets.Items[i].Labels[MigrationStatusLabel] == MigrationFailed:
+			counts[MigrationFailed]++
+		case SkipReason(secrets.Items[i]) != "":
+			counts["reverted"]++
+		default:
+			counts["pending"]++
+		}
+	}
+	for status, count := range counts {
+		ch <- prometheus.MustNewConstMetric(legacyRemainingDesc, prometheus.GaugeValue, count, status)
+	}
+}
+
+// registerRemaining exposes the legacy secrets in "reader" on the manager's
+// metrics endpoint.
+func registerRemaining(reader client.Reader) error {
+	err := metrics.Registry.Register(&remainingCollector{reader: reader})
+	if errors.As(err, &prometheus.AlreadyRegisteredError{}) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,151 @@
+package oldproviderconnection
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestMigrationOutcomeMetrics(t *testing.T) {
+	good := newSecret("providers", "good", map[string]string{ProviderLabel: "aws", CloudConnectionLabel: ""},
+		"awsAccessKeyID: a\nawsSecretAccessKeyID: b")
+	bad := newSecret("providers", "bad", map[string]string{ProviderLabel: "azr", CloudConnectionLabel: ""},
+		"clientId: a")
+
+	migrated := testutil.ToFloat64(migrationsTotal.WithLabelValues(outcomeMigrated))
+	failed := testutil.ToFloat64(migrationsTotal.WithLabelValues(outcomeFailed))
+
+	fakeClient := fake.NewFakeClient(good, bad)
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &OldProviderConnectionReconciler{
+		Client:    fakeClient,
+		APIReader: fakeClient,
+		Log:       ctrl.Log.WithName("controllers").WithName("OldProviderConnectionReconciler"),
+		Scheme:    scheme.Scheme,
+		Recorder:  recorder,
+	}
+
+	for _, name := range []string{"good", "bad"} {
+		if _, err := reconciler.Reconcile(context.Background(), reconcile.Request{
+			NamespacedName: types.NamespacedName{Namespace: "providers", Name: name},
+		}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	if v := testutil.ToFloat64(migrationsTotal.WithLabelValues(outcomeMigrated)); v != migrated+1 {
+		t.Fatalf("expected %v migrated, but got %v", migrated+1, v)
+	}
+	if v := testutil.ToFloat64(migrationsTotal.WithLabelValues(outcomeFailed)); v != failed+1 {
+		t.Fatalf("expected %v failed, but got %v", failed+1, v)
+	}
+
+	// Resyncs of the refused secret, and of a reverted one, are not counted
+	reverted := newSecret("providers", "reverted", map[string]string{ProviderLabel: "aws"}, "awsAccessKeyID: a\nawsSecretAccessKeyID: b")
+	reverted.Annotations = map[string]string{RevertMigrationAnnotation: "true"}
+	if err := fakeClient.Create(context.Background(), reverted); err != nil {
+		t.Fatalf("failed to create secret: %v", err)
+	}
+	for _, name := range []string{"bad", "reverted", "reverted"} {
+		if _, err := reconciler.Reconcile(context.Background(), reconcile.Request{
+			NamespacedName: types.NamespacedName{Namespace: "providers", Name: name},
+		}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+	if v := testutil.ToFloat64(migrationsTotal.WithLabelValues(outcomeFailed)); v != failed+1 {
+		t.Fatalf("expected %v failed, but got %v", failed+1, v)
+	}
+	if v := testutil.ToFloat64(migrationsTotal.WithLabelValues(outcomeMigrated)); v != migrated+1 {
+		t.Fatalf("expected %v migrated, but got %v", migrated+1, v)
+	}
+
+	close(recorder.Events)
+	var events []string
+	for e := range recorder.Events {
+		events = append(events, e)
+	}
+	if len(events) != 3 || !strings.HasPrefix(events[0], corev1.EventTypeNormal+" "+MigratedEventReason) {
+		t.Fatalf("expected a %v event followed by two failures, but got %v", MigratedEventReason, events)
+	}
+}
+
+func TestMigrationOutcomeConcurrentlyMigrated(t *testing.T) {
+	secret := newSecret("providers", "raced", map[string]string{ProviderLabel: "aws"}, "awsAccessKeyID: a\nawsSecretAccessKeyID: b")
+
+	// Another writer migrates the secret while the first apply is in flight
+	raced := false
+	fakeClient := fake.NewClientBuilder().WithObjects(secret).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+				if !raced && patch.Type() == types.ApplyPatchType {
+					raced = true
+					var current corev1.Secret
+					if err := c.Get(ctx, client.ObjectKeyFromObject(obj), &current); err != nil {
+						return err
+					}
+					delete(current.Labels, CloudConnectionLabel)
+					if err := c.Update(ctx, &current); err != nil {
+						return err
+					}
+					return k8serrors.NewConflict(corev1.Resource("secrets"), obj.GetName(), errors.New("modified"))
+				}
+				return c.Patch(ctx, obj, patch, opts...)
+			},
+		}).Build()
+
+	migrated := testutil.ToFloat64(migrationsTotal.WithLabelValues(outcomeMigrated))
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &OldProviderConnectionReconciler{
+		Client:    fakeClient,
+		APIReader: fakeClient,
+		Log:       ctrl.Log.WithName("controllers").WithName("OldProviderConnectionReconciler"),
+		Scheme:    scheme.Scheme,
+		Recorder:  recorder,
+	}
+	if _, err := reconciler.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: client.ObjectKeyFromObject(secret),
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	if v := testutil.ToFloat64(migrationsTotal.WithLabelValues(outcomeMigrated)); v != migrated {
+		t.Fatalf("expected %v migrated, but got %v", migrated, v)
+	}
+	if len(recorder.Events) != 0 {
+		t.Fatalf("expected no %v event, but got %v", MigratedEventReason, <-recorder.Events)
+	}
+}
+
+func TestRemainingCollector(t *testing.T) {
+	pending := newSecret("providers", "pending", map[string]string{CloudConnectionLabel: ""}, "a: b")
+	failed := newSecret("providers", "failed", map[string]string{CloudConnectionLabel: "", MigrationStatusLabel: MigrationFailed}, "a")
+	reverted := newSecret("providers", "reverted", map[string]string{CloudConnectionLabel: ""}, "a: b")
+	reverted.Annotations = map[string]string{RevertMigrationAnnotation: "true"}
+
+	collector := &remainingCollector{reader: fake.NewFakeClient(pending, failed, reverted)}
+
+	expected := `
+# HELP provider_credential_legacy_secrets_remaining Number of secrets still in the legacy provider connection form, by migration status.
+# TYPE provider_credential_legacy_secrets_remaining gauge
+provider_credential_legacy_secrets_remaining{status="migration-failed"} 1
+provider_credential_legacy_secrets_remaining{status="pending"} 1
+provider_credential_legacy_secrets_remaining{status="reverted"} 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package oldproviderconnection
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stolostron/provider-credential-controller/controllers/providercredential"
+	"github.com/stolostron/provider-credential-controller/pkg/version"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// MigrationRecordAnnotation holds a JSON MigrationRecord on every secret the
+// controller has migrated from the legacy form.
+const MigrationRecordAnnotation = "cluster.open-cluster-management.io/migration-record"
+
+// RevertMigrationAnnotation, set to "true" on a migrated secret, restores the
+// legacy form from its backup. The annotation is kept on the restored secret
+// and stops it from being migrated again until it is removed.
+const RevertMigrationAnnotation = "cluster.open-cluster-management.io/revert-migration"
+
+// LegacyBackupLabel marks the backup secret holding the legacy form of a
+// migrated secret.
+const LegacyBackupLabel = "cluster.open-cluster-management.io/legacy-backup"
+
+const legacyLabelsAnnotation = "cluster.open-cluster-management.io/legacy-labels"
+const legacyAnnotationsAnnotation = "cluster.open-cluster-management.io/legacy-annotations"
+
+// MigrationRevertedEventReason is the Event reason recorded on a secret that
+// was restored to its legacy form.
+const MigrationRevertedEventReason = "LegacyMigrationReverted"
+
+// MigrationRecord describes a migration applied to a legacy secret.
+type MigrationRecord struct {
+	Time              string `json:"time"`
+	ControllerVersion string `json:"controllerVersion"`
+	// KeyMapping maps each legacy metadata key to the data key it was written to.
+	KeyMapping map[string]string `json:"keyMapping"`
+	// Backup is the name of the secret, in the same namespace, holding the legacy form.
+	Backup string `json:"backup"`
+	// AdoptedCopies lists, as namespace/name, the copies of the legacy form
+	// that were labelled as copies of the migrated secret.
+	AdoptedCopies []string `json:"adoptedCopies,omitempty"`
+	// UnknownKeys lists the legacy metadata keys that are not known for the
+	// provider type; they were migrated as written.
+	UnknownKeys []string `json:"unknownKeys,omitempty"`
+}
+
+func backupName(secretName string) string {
+	return secretName + "-legacy-backup"
+}
+
+// newMigrationRecord returns the record for a migration applied now.
+func newMigrationRecord(secretName string, keyMapping map[string]string) MigrationRecord {
+	return MigrationRecord{
+		Time:              time.Now().UTC().Format(time.RFC3339),
+		ControllerVersion: version.Version,
+		KeyMapping:        keyMapping,
+		Backup:            backupName(secretName),
+	}
+}
+
+// MigrationRecordOf returns the record stored on a migrated "secret".
+func MigrationRecordOf(secret corev1.Secret) (*MigrationRecord, error) {
+	var migration MigrationRecord
+	if err := json.Unmarshal([]byte(secret.Annotations[MigrationRecordAnnotation]), &migration); err != nil {
+		return nil, err
+	}
+	return &migration, nil
+}
+
+// annotate stores the record on the migrated "secret".
+func (m *MigrationRecord) annotate(secret *corev1.Secret) error {
+	record, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	secret.Annotations[MigrationRecordAnnotation] = string(record)
+	return nil
+}
+
+// createBackup stores the data, labels and annotations of the legacy
+// "secret" in a backup secret owned by it. A backup already owned by
+// "secret" is kept, so an attempt retried after the migration was partly
+// written never overwrites the legacy form. A backup left behind by an
+// earlier secret of the same name is replaced.
+func createBackup(ctx context.Context, c client.Client, reader client.Reader, secret *corev1.Secret) error {
+	legacyLabels, err := json.Marshal(secret.Labels)
+	if err != nil {
+		return err
+	}
+	legacyAnnotations, err := json.Marshal(secret.Annotations)
+	if err != nil {
+		return err
+	}
+
+	backup := &corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      backupName(secret.Name),
+			Namespace: secret.Namespace,
+			Labels: map[string]string{
+				LegacyBackupLabel:              "",
+				"app.kubernetes.io/managed-by": "provider-credential-controller",
+			},
+			Annotations: map[string]string{
+				legacyLabelsAnnotation:      string(legacyLabels),
+				legacyAnnotationsAnnotation: string(legacyAnnotations),
+			},
+			OwnerReferences: []v1.OwnerReference{{
+				APIVersion: "v1",
+				Kind:       "Secret",
+				Name:       secret.Name,
+				UID:        secret.UID,
+			}},
+		},
+		Type: secret.Type,
+		Data: secret.Data,
+	}
+
+	err = c.Create(ctx, backup)
+	if k8serrors.IsAlreadyExists(err) {
+		var existing corev1.Secret
+		if err := reader.Get(ctx, client.ObjectKeyFromObject(backup), &existing); err != nil {
+			return err
+		}
+		for _, owner := range existing.OwnerReferences {
+			if owner.UID == secret.UID {
+				return nil
+			}
+		}
+		if err = c.Delete(ctx, &existing); err != nil && !k8serrors.IsNotFound(err) {
+			return err
+		}
+		backup.ResourceVersion = ""
+		err = c.Create(ctx, backup)
+	}
+	return err
+}
+
+// RevertMigrationReconciler restores migrated secrets annotated with
+// RevertMigrationAnnotation to the legacy form saved in their backup.
+type RevertMigrationReconciler struct {
+	client.Client
+	// APIReader reads the backup secrets, which are not in any cache.
+	APIReader client.Reader
+	Log       logr.Logger
+	Recorder  record.EventRecorder
+}
+
+func (r *RevertMigrationReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+
+	log := r.Log.WithValues("RevertMigrationReconciler", req.NamespacedName)
+
+	var secret corev1.Secret
+	if err := r.Get(ctx, req.NamespacedName, &secret); err != nil {
+		log.V(1).Info("Resource deleted")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if !revertRequested(&secret) {
+		return ctrl.Result{}, nil
+	}
+
+	migration, err := MigrationRecordOf(secret)
+	if err != nil {
+		r.warn(&secret, "can not revert, the migration record is not valid: "+err.Error())
+		return ctrl.Result{}, nil
+	}
+
+	var backup corev1.Secret
+	if err := r.APIReader.Get(ctx, types.NamespacedName{Namespace: secret.Namespace, Name: migration.Backup}, &backup); err != nil {
+		if k8serrors.IsNotFound(err) {
+			r.warn(&secret, "can not revert, the backup secret "+migration.Backup+" does not exist")
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	legacyLabels := map[string]string{}
+	legacyAnnotations := map[string]string{}
+	if err := json.Unmarshal([]byte(backup.Annotations[legacyLabelsAnnotation]), &legacyLabels); err != nil {
+		r.warn(&secret, "can not revert, the backup labels are not valid: "+err.Error())
+		return ctrl.Result{}, nil
+	}
+	if err := json.Unmarshal([]byte(backup.Annotations[legacyAnnotationsAnnotation]), &legacyAnnotations); err != nil {
+		r.warn(&secret, "can not revert, the backup annotations are not valid: "+err.Error())
+		return ctrl.Result{}, nil
+	}
+	if legacyAnnotations == nil {
+		legacyAnnotations = map[string]string{}
+	}
+	legacyAnnotations[RevertMigrationAnnotation] = "true"
+
+	secret.Labels = legacyLabels
+	secret.Annotations = legacyAnnotations
+	secret.Data = backup.Data
+	if err := r.Update(ctx, &secret); err != nil {
+		log.Error(err, "Failed to restore the legacy secret")
+		return ctrl.Result{}, err
+	}
+
+	if err := r.Delete(ctx, &backup); err != nil && !k8serrors.IsNotFound(err) {
+		log.Error(err, "Failed to delete the backup secret "+backup.Name)
+	}
+
+	log.V(0).Info("Reverted migration of " + secret.Namespace + "/" + secret.Name)
+	migrationsTotal.WithLabelValues(outcomeReverted).Inc()
+	if r.Recorder != nil {
+		r.Recorder.Event(&secret, corev1.EventTypeNormal, MigrationRevertedEventReason,
+			"restored the legacy provider connection from "+backup.Name+"; remove the "+
+				RevertMigrationAnnotation+" annotation to migrate it again")
+	}
+	return ctrl.Result{}, nil
+}
+
+func (r *RevertMigrationReconciler) warn(secret *corev1.Secret, msg string) {
+	r.Log.V(0).Info(secret.Namespace + "/" + secret.Name + ": " + msg)
+	if r.Recorder != nil {
+		r.Recorder.Event(secret, corev1.EventTypeWarning, MigrationFailedEventReason, msg)
+	}
+}
+
+func revertRequested(secret client.Object) bool {
+	annotations := secret.GetAnnotations()
+	_, migrated := annotations[MigrationRecordAnnotation]
+	return migrated && annotations[RevertMigrationAnnotation] == "true" && providercredential.IsProviderSecret(secret)
+}
+
+// SetupWithManager watches the secrets labelled with
+// providercredential.CredentialLabel, i.e. migrated ones.
+func (r *RevertMigrationReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("revertmigration").
+		For(&corev1.Secret{}).WithEventFilter(predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return revertRequested(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return revertRequested(e.ObjectNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return false
+		},
+	}).Complete(r)
+}
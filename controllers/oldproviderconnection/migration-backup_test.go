@@ -0,0 +1,229 @@
+package oldproviderconnection
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/stolostron/provider-credential-controller/controllers/providercredential"
+)
+
+func TestMigrationBackupAndRevert(t *testing.T) {
+	metadata := "awsAccessKeyID: a\nawsSecretAccessKeyID: b\nbaseDomain: example.com"
+	legacyLabels := map[string]string{
+		ProviderLabel:        "aws",
+		CloudConnectionLabel: "",
+		"other-label":        "other-value",
+	}
+	secret := newSecret("secret1", "test-ns", legacyLabels, metadata)
+	secret.Annotations = map[string]string{"note": "kept"}
+
+	fakeClient := fake.NewFakeClient(secret)
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name}}
+
+	migrate := &OldProviderConnectionReconciler{
+		Client:    fakeClient,
+		APIReader: fakeClient,
+		Log:       ctrl.Log.WithName("controllers").WithName("OldProviderConnectionReconciler"),
+		Scheme:    scheme.Scheme,
+		Recorder:  record.NewFakeRecorder(10),
+	}
+	if _, err := migrate.Reconcile(context.Background(), req); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	var migrated corev1.Secret
+	if err := fakeClient.Get(context.Background(), req.NamespacedName, &migrated); err != nil {
+		t.Fatalf("failed to fetch secret: %v", err)
+	}
+	var migration MigrationRecord
+	if err := json.Unmarshal([]byte(migrated.Annotations[MigrationRecordAnnotation]), &migration); err != nil {
+		t.Fatalf("expected a migration record, but got %q: %v", migrated.Annotations[MigrationRecordAnnotation], err)
+	}
+	expectedMapping := map[string]string{
+		"awsAccessKeyID":       "aws_access_key_id",
+		"awsSecretAccessKeyID": "aws_secret_access_key",
+		"baseDomain":           "baseDomain",
+	}
+	if !reflect.DeepEqual(migration.KeyMapping, expectedMapping) {
+		t.Fatalf("expected key mapping %v, but got %v", expectedMapping, migration.KeyMapping)
+	}
+	if migration.Time == "" || migration.ControllerVersion == "" || migration.Backup != "test-ns-legacy-backup" {
+		t.Fatalf("incomplete migration record %+v", migration)
+	}
+
+	var backup corev1.Secret
+	if err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: secret.Namespace, Name: migration.Backup}, &backup); err != nil {
+		t.Fatalf("failed to fetch backup: %v", err)
+	}
+	if string(backup.Data["metadata"]) != metadata {
+		t.Fatalf("expected backup metadata %q, but got %q", metadata, string(backup.Data["metadata"]))
+	}
+	if _, ok := backup.Labels[LegacyBackupLabel]; !ok || len(backup.OwnerReferences) != 1 {
+		t.Fatalf("expected a labelled backup owned by the secret, but got %+v", backup.ObjectMeta)
+	}
+
+	// Request the revert
+	migrated.Annotations[RevertMigrationAnnotation] = "true"
+	if err := fakeClient.Update(context.Background(), &migrated); err != nil {
+		t.Fatalf("failed to annotate secret: %v", err)
+	}
+
+	recorder := record.NewFakeRecorder(10)
+	revert := &RevertMigrationReconciler{
+		Client:    fakeClient,
+		APIReader: fakeClient,
+		Log:       ctrl.Log.WithName("controllers").WithName("RevertMigrationReconciler"),
+		Recorder:  recorder,
+	}
+	if _, err := revert.Reconcile(context.Background(), req); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	var reverted corev1.Secret
+	if err := fakeClient.Get(context.Background(), req.NamespacedName, &reverted); err != nil {
+		t.Fatalf("failed to fetch secret: %v", err)
+	}
+	if !reflect.DeepEqual(reverted.Labels, legacyLabels) {
+		t.Fatalf("expected labels %v, but got %v", legacyLabels, reverted.Labels)
+	}
+	expectedAnnotations := map[string]string{"note": "kept", RevertMigrationAnnotation: "true"}
+	if !reflect.DeepEqual(reverted.Annotations, expectedAnnotations) {
+		t.Fatalf("expected annotations %v, but got %v", expectedAnnotations, reverted.Annotations)
+	}
+	expectedData := map[string][]byte{"metadata": []byte(metadata)}
+	if !reflect.DeepEqual(reverted.Data, expectedData) {
+		t.Fatalf("expected data %v, but got %v", expectedData, reverted.Data)
+	}
+	if _, ok := reverted.Labels[providercredential.CredentialLabel]; ok {
+		t.Fatalf("reverted secret must not carry %v", providercredential.CredentialLabel)
+	}
+	if err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: secret.Namespace, Name: migration.Backup}, &backup); !errors.IsNotFound(err) {
+		t.Fatalf("expected the backup to be deleted, but got %v", err)
+	}
+	if len(recorder.Events) != 1 {
+		t.Fatalf("expected one event, but got %v", len(recorder.Events))
+	}
+
+	// The reverted secret is not migrated again while the annotation is set
+	if _, err := migrate.Reconcile(context.Background(), req); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := fakeClient.Get(context.Background(), req.NamespacedName, &reverted); err != nil {
+		t.Fatalf("failed to fetch secret: %v", err)
+	}
+	if !reflect.DeepEqual(reverted.Data, expectedData) {
+		t.Fatalf("expected data %v to be left alone, but got %v", expectedData, reverted.Data)
+	}
+}
+
+func TestRevertMigrationMissingBackup(t *testing.T) {
+	secret := newSecret("secret1", "test-ns", map[string]string{providercredential.CredentialLabel: ""}, "")
+	secret.Annotations = map[string]string{
+		MigrationRecordAnnotation: `{"backup":"test-ns-legacy-backup"}`,
+		RevertMigrationAnnotation: "true",
+	}
+
+	fakeClient := fake.NewFakeClient(secret)
+	recorder := record.NewFakeRecorder(10)
+	revert := &RevertMigrationReconciler{
+		Client:    fakeClient,
+		APIReader: fakeClient,
+		Log:       ctrl.Log.WithName("controllers").WithName("RevertMigrationReconciler"),
+		Recorder:  recorder,
+	}
+	if _, err := revert.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: client.ObjectKeyFromObject(secret),
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if len(recorder.Events) != 1 {
+		t.Fatalf("expected a warning event, but got %v", len(recorder.Events))
+	}
+}
+
+func TestMigrationBackupKeptOnRetry(t *testing.T) {
+	metadata := "awsAccessKeyID: a\nawsSecretAccessKeyID: b"
+	secret := newSecret("secret1", "test-ns", map[string]string{ProviderLabel: "aws"}, metadata)
+	secret.UID = "legacy-uid"
+
+	// A backup left behind by an earlier secret of the same name
+	stale := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            backupName(secret.Name),
+			Namespace:       secret.Namespace,
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "v1", Kind: "Secret", Name: secret.Name, UID: "deleted-uid"}},
+		},
+		Data: map[string][]byte{"metadata": []byte("stale")},
+	}
+
+	// The first attempt fails after the migrated form was applied
+	failPatch := true
+	fakeClient := fake.NewClientBuilder().WithObjects(secret, stale).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+				if failPatch && patch.Type() == types.MergePatchType {
+					failPatch = false
+					return errors.NewServiceUnavailable("injected")
+				}
+				return c.Patch(ctx, obj, patch, opts...)
+			},
+		}).Build()
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(secret)}
+
+	migrate := &OldProviderConnectionReconciler{
+		Client:    fakeClient,
+		APIReader: fakeClient,
+		Log:       ctrl.Log.WithName("controllers").WithName("OldProviderConnectionReconciler"),
+		Scheme:    scheme.Scheme,
+		Recorder:  record.NewFakeRecorder(10),
+	}
+	if _, err := migrate.Reconcile(context.Background(), req); err == nil {
+		t.Fatalf("expected the injected error")
+	}
+
+	var partlyMigrated corev1.Secret
+	if err := fakeClient.Get(context.Background(), req.NamespacedName, &partlyMigrated); err != nil {
+		t.Fatalf("failed to fetch secret: %v", err)
+	}
+	if _, ok := partlyMigrated.Annotations[MigrationRecordAnnotation]; !ok {
+		t.Fatalf("expected the migrated form to be applied, but got %v", partlyMigrated.Annotations)
+	}
+
+	// The retry completes the migration without touching the backup
+	if _, err := migrate.Reconcile(context.Background(), req); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	var backup corev1.Secret
+	if err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: secret.Namespace, Name: backupName(secret.Name)}, &backup); err != nil {
+		t.Fatalf("failed to fetch backup: %v", err)
+	}
+	expectedData := map[string][]byte{"metadata": []byte(metadata)}
+	if !reflect.DeepEqual(backup.Data, expectedData) {
+		t.Fatalf("expected the backup to hold the legacy form %v, but got %v", expectedData, backup.Data)
+	}
+	if len(backup.OwnerReferences) != 1 || backup.OwnerReferences[0].UID != secret.UID {
+		t.Fatalf("expected the stale backup to be replaced, but got %+v", backup.OwnerReferences)
+	}
+	var legacyLabels map[string]string
+	if err := json.Unmarshal([]byte(backup.Annotations[legacyLabelsAnnotation]), &legacyLabels); err != nil {
+		t.Fatalf("invalid backup labels: %v", err)
+	}
+	if _, ok := legacyLabels[providercredential.CredentialLabel]; ok {
+		t.Fatalf("expected the backup to hold the legacy labels, but got %v", legacyLabels)
+	}
+}
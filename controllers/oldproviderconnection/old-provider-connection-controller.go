@@ -3,29 +3,57 @@
 package oldproviderconnection
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
 
 	"github.com/go-logr/logr"
 	"github.com/stolostron/provider-credential-controller/controllers/providercredential"
-	"gopkg.in/yaml.v2"
+	"github.com/stolostron/provider-credential-controller/pkg/apply"
+	"github.com/stolostron/provider-credential-controller/pkg/config"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 const CloudConnectionLabel = "cluster.open-cluster-management.io/cloudconnection"
 const ProviderLabel = "cluster.open-cluster-management.io/provider"
 
+// MigrationStatusLabel is set to MigrationFailed on a legacy secret that the
+// controller refused to migrate. The secret is otherwise left untouched, so
+// the original metadata is still available to fix and retry; editing the
+// secret triggers another attempt.
+const MigrationStatusLabel = "cluster.open-cluster-management.io/migration-status"
+const MigrationFailed = "migration-failed"
+
+// MigrationFailedEventReason is the Warning Event reason recorded on a legacy
+// secret that can not be migrated.
+const MigrationFailedEventReason = "LegacyMigrationFailed"
+
+// FieldManager owns the keys, labels and annotations the migration writes,
+// which the controller server-side applies.
+const FieldManager = "old-provider-connection-controller"
+
+// MigratedEventReason is the Event reason recorded on a migrated secret.
+const MigratedEventReason = "LegacyMigrated"
+
+// UnknownMetadataKeysEventReason is the Warning Event reason recorded on a
+// secret migrated with metadata keys not known for its provider type.
+const UnknownMetadataKeysEventReason = "LegacyUnknownMetadataKeys"
+
 var mapYamlKeys = map[string]string{
 	"awsAccessKeyID":       "aws_access_key_id",
 	"awsSecretAccessKeyID": "aws_secret_access_key",
@@ -40,13 +68,136 @@ var mapYamlKeys = map[string]string{
 	"datastore":            "defaultDatastore",
 }
 
-var hash = sha256.New()
+// providerYamlKeys maps the legacy metadata keys of a single provider type to
+// data keys, taking precedence over mapYamlKeys.
+var providerYamlKeys = map[string]map[string]string{
+	"redhatvirtualization": {
+		"ovirtUrl":      "ovirt_url",
+		"ovirtFqdn":     "ovirt_fqdn",
+		"ovirtUsername": "ovirt_username",
+		"ovirtPassword": "ovirt_password",
+		"ovirtCABundle": "ovirt_ca_bundle",
+	},
+	"bm": {
+		"libvirtURI":       "libvirtURI",
+		"sshKnownHosts":    "sshKnownHosts",
+		"imageMirror":      "imageMirror",
+		"bootstrapOSImage": "bootstrapOSImage",
+		"clusterOSImage":   "clusterOSImage",
+		"pullSecret":       "pullSecret",
+		"sshPrivatekey":    "ssh-privatekey",
+		"sshPublickey":     "ssh-publickey",
+	},
+}
+
+// providerTypeAliases maps the values legacy secrets carry in ProviderLabel
+// to the current ProviderTypeLabel values.
+var providerTypeAliases = map[string]string{
+	"ans":                  "ans",
+	"ansible":              "ans",
+	"aws":                  "aws",
+	"amazon":               "aws",
+	"azr":                  "azr",
+	"azure":                "azr",
+	"gcp":                  "gcp",
+	"google":               "gcp",
+	"vmw":                  "vmw",
+	"vmware":               "vmw",
+	"vsphere":              "vmw",
+	"ost":                  "ost",
+	"openstack":            "ost",
+	"redhatvirtualization": "redhatvirtualization",
+	"rhv":                  "redhatvirtualization",
+	"ovirt":                "redhatvirtualization",
+	"bm":                   "bm",
+	"bmc":                  "bm",
+	"baremetal":            "bm",
+}
+
+// providerType returns the current type name for the ProviderLabel in
+// "labels", refusing values that are not a known alias. A secret without the
+// label keeps migrating without a type.
+func providerType(labels map[string]string) (string, error) {
+	value, ok := labels[ProviderLabel]
+	if !ok {
+		return "", nil
+	}
+	credType, ok := providerTypeAliases[strings.ToLower(strings.TrimSpace(value))]
+	if !ok {
+		return "", &invalidMetadataError{fmt.Sprintf("label %s=%q is not a known provider type", ProviderLabel, value)}
+	}
+	return credType, nil
+}
+
+// dataKey returns the data key a legacy metadata key is written to.
+func dataKey(credType, key string) string {
+	if dataKey, ok := providerYamlKeys[credType][key]; ok {
+		return dataKey
+	}
+	if dataKey, ok := mapYamlKeys[key]; ok {
+		return dataKey
+	}
+	return key
+}
 
 // OldProviderConnectionReconciler reconciles a Old Provider secret
 type OldProviderConnectionReconciler struct {
 	client.Client
-	Log    logr.Logger
-	Scheme *runtime.Scheme
+	// Cache holds the legacy secrets watched by this controller, see NewSecretCache.
+	Cache cache.Cache
+	// APIReader looks up ManagedClusters and the copies made from legacy secrets.
+	APIReader client.Reader
+	Log       logr.Logger
+	Scheme    *runtime.Scheme
+	Config    *config.Store
+	Recorder  record.EventRecorder
+}
+
+// invalidMetadataError reports a legacy secret whose metadata or provider
+// label can never be migrated as-is. Retrying does not help, so the secret is
+// marked as failed instead.
+type invalidMetadataError struct {
+	msg string
+}
+
+func (e *invalidMetadataError) Error() string {
+	return e.msg
+}
+
+// azureServicePrincipal is the osServicePrincipal.json document built from
+// the legacy Azure metadata keys.
+type azureServicePrincipal struct {
+	ClientID       string
+	ClientSecret   string
+	TenantID       string
+	SubscriptionID string
+}
+
+// NewSecretCache returns a cache holding only the secrets labelled with
+// CloudConnectionLabel in "namespaces" (all namespaces when empty), passed
+// through "transform", and adds it to "mgr" so it is started and stopped
+// with the manager.
+func NewSecretCache(mgr ctrl.Manager, namespaces []string, transform toolscache.TransformFunc) (cache.Cache, error) {
+	c, err := cache.New(mgr.GetConfig(), cache.Options{
+		Scheme:     mgr.GetScheme(),
+		Mapper:     mgr.GetRESTMapper(),
+		Namespaces: namespaces,
+		ByObject: map[client.Object]cache.ByObject{
+			&corev1.Secret{}: {
+				Label:     labels.SelectorFromSet(labels.Set{CloudConnectionLabel: ""}),
+				Transform: transform,
+			}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, mgr.Add(c)
+}
+
+// IsLegacySecret reports whether "secret" is labelled with CloudConnectionLabel.
+func IsLegacySecret(secret client.Object) bool {
+	_, ok := secret.GetLabels()[CloudConnectionLabel]
+	return ok
 }
 
 func (r *OldProviderConnectionReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -59,23 +210,156 @@ func (r *OldProviderConnectionReconciler) Reconcile(ctx context.Context, req ctr
 		return ctrl.Result{}, err
 	}
 
+	// The cloudconnection label may have been removed since the event was queued
+	if !IsLegacySecret(&secret) {
+		log.V(1).Info("Not a legacy provider connection")
+		return ctrl.Result{}, nil
+	}
+
 	log.V(1).Info("Reconcile secret")
 
-	if err := updateSecret(r.Client, secret); err != nil {
+	// Reverted secrets are reported by the remaining gauge rather than
+	// counted on every resync
+	if reason := SkipReason(secret); reason != "" {
+		log.V(1).Info("Skipping secret, " + reason)
+		return ctrl.Result{}, nil
+	}
+
+	migrated, err := r.Migrate(ctx, secret)
+	if err != nil {
+		if IsInvalidMetadata(err) {
+			if secret.Labels[MigrationStatusLabel] != MigrationFailed {
+				migrationsTotal.WithLabelValues(outcomeFailed).Inc()
+			}
+			return ctrl.Result{}, nil
+		}
 		return ctrl.Result{}, err
 	}
+	if !migrated {
+		log.V(1).Info("Secret is no longer a legacy provider connection")
+		return ctrl.Result{}, nil
+	}
+
+	migrationsTotal.WithLabelValues(outcomeMigrated).Inc()
+	if r.Recorder != nil {
+		r.Recorder.Event(&secret, corev1.EventTypeNormal, MigratedEventReason,
+			"migrated legacy provider connection, the original is kept in "+backupName(secret.Name))
+	}
 	return ctrl.Result{}, nil
 }
 
-func updateSecret(c client.Client, secret corev1.Secret) error {
+// SkipReason returns why the legacy "secret" must not be migrated, or "" when
+// it is due for migration.
+func SkipReason(secret corev1.Secret) string {
+	if secret.Annotations[RevertMigrationAnnotation] == "true" {
+		return "migration was reverted, remove " + RevertMigrationAnnotation + " to migrate it again"
+	}
+	return ""
+}
+
+// IsInvalidMetadata reports whether "err" was returned for a legacy secret
+// that can not be migrated until its metadata is fixed.
+func IsInvalidMetadata(err error) bool {
+	var invalid *invalidMetadataError
+	return errors.As(err, &invalid)
+}
+
+// Migrate backs up and migrates the legacy "secret", and adopts the copies
+// made from it. It returns false when "secret" was found to be no longer in
+// the legacy form, for example migrated concurrently. A secret that can not
+// be migrated is labelled MigrationFailed and its error satisfies
+// IsInvalidMetadata.
+func (r *OldProviderConnectionReconciler) Migrate(ctx context.Context, secret corev1.Secret) (bool, error) {
+	migrated, err := r.updateSecret(ctx, secret)
+	var invalid *invalidMetadataError
+	if errors.As(err, &invalid) {
+		if markErr := r.markMigrationFailed(ctx, secret, invalid); markErr != nil {
+			return false, markErr
+		}
+	}
+	return migrated, err
+}
+
+// markMigrationFailed records why "secret" was not migrated, as a Warning
+// Event and as MigrationStatusLabel, without modifying its data.
+func (r *OldProviderConnectionReconciler) markMigrationFailed(ctx context.Context, secret corev1.Secret, cause error) error {
+	msg := "refusing to migrate legacy provider connection " + secret.Namespace + "/" + secret.Name + ": " + cause.Error()
+	klog.Warning(msg)
+	if r.Recorder != nil {
+		r.Recorder.Event(&secret, corev1.EventTypeWarning, MigrationFailedEventReason, msg)
+	}
+
+	if secret.Labels[MigrationStatusLabel] == MigrationFailed {
+		return nil
+	}
+	failed := apply.NewSecret(secret.Namespace, secret.Name, "")
+	failed.Labels = map[string]string{MigrationStatusLabel: MigrationFailed}
+	if err := apply.Secret(ctx, r.Client, FieldManager, failed); err != nil {
+		klog.Error(err, "Failed to label the legacy secret as failed")
+		return err
+	}
+	return nil
+}
+
+// newAzureServicePrincipal validates that all four service principal fields
+// are present in the legacy metadata.
+func newAzureServicePrincipal(providerMetadata map[string]string) (*azureServicePrincipal, error) {
+	field := func(key string) (string, error) {
+		if value := providerMetadata[key]; value != "" {
+			return value, nil
+		}
+		return "", &invalidMetadataError{"metadata." + key + " is required for an Azure service principal"}
+	}
+
+	sp := &azureServicePrincipal{}
+	var err error
+	if sp.ClientID, err = field("clientId"); err != nil {
+		return nil, err
+	}
+	if sp.ClientSecret, err = field("clientSecret"); err != nil {
+		return nil, err
+	}
+	if sp.TenantID, err = field("tenantId"); err != nil {
+		return nil, err
+	}
+	if sp.SubscriptionID, err = field("subscriptionId"); err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+// encode returns the osServicePrincipal.json document in the key order and
+// spacing the controller has always produced, with every value JSON-escaped.
+func (sp *azureServicePrincipal) encode() ([]byte, error) {
+	values := make([]interface{}, 0, 4)
+	for _, v := range []string{sp.ClientID, sp.ClientSecret, sp.TenantID, sp.SubscriptionID} {
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, encoded)
+	}
+	return []byte(fmt.Sprintf(`{"clientId": %s, "clientSecret": %s, "tenantId": %s, "subscriptionId": %s}`, values...)), nil
+}
+
+// Convert returns the migrated form of the legacy "secret" and the record of
+// the conversion, without writing anything. The result carries the
+// credential hash when its provider type is supported, computed with the
+// transforms of "cfg", and the migration record annotation.
+func Convert(secret corev1.Secret, cfg *config.Configuration) (*corev1.Secret, *MigrationRecord, error) {
+	credType, err := providerType(secret.Labels)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	newLabels := make(map[string]string)
 	labels := secret.GetLabels()
 	if labels != nil {
 		for key, val := range labels {
 			if key == ProviderLabel {
-				newLabels[providercredential.ProviderTypeLabel] = val
+				newLabels[providercredential.ProviderTypeLabel] = credType
 			}
-			if key != CloudConnectionLabel && key != ProviderLabel {
+			if key != CloudConnectionLabel && key != ProviderLabel && key != MigrationStatusLabel {
 				newLabels[key] = val
 			}
 
@@ -83,77 +367,169 @@ func updateSecret(c client.Client, secret corev1.Secret) error {
 	}
 	newLabels[providercredential.CredentialLabel] = ""
 
-	secret.ObjectMeta.Labels = newLabels
-	providerMetadata, err := extractSecretMetadata(secret.Data)
+	providerMetadata, unknownKeys, err := parseLegacyMetadata(credType, secret.Data["metadata"])
 	if err != nil {
-		klog.Error(err, "\tsecret: ", secret.Name)
-		return err
+		return nil, nil, err
 	}
 
-	credType := labels[ProviderLabel]
+	// Work on a copy so a refused migration leaves the original untouched
+	migrated := secret.DeepCopy()
+	migrated.ObjectMeta.Labels = newLabels
+	keyMapping := map[string]string{}
+
 	switch credType {
 	case "azr":
-		osServicePrincipal := `{"clientId": "` + fmt.Sprintf("%v", providerMetadata["clientId"]) + `", "clientSecret": "` + fmt.Sprintf("%v", providerMetadata["clientSecret"]) + `", "tenantId": "` + fmt.Sprintf("%v", providerMetadata["tenantId"]) + `", "subscriptionId": "` + fmt.Sprintf("%v", providerMetadata["subscriptionId"]) + `"}`
-		secret.Data["osServicePrincipal.json"] = []byte(osServicePrincipal)
-		delete(providerMetadata, "clientId")
-		delete(providerMetadata, "clientSecret")
-		delete(providerMetadata, "tenantId")
-		delete(providerMetadata, "subscriptionId")
-	}
-
-	for key, meta := range providerMetadata {
-		var b []byte
-		if key == "sshKnownHosts" {
-			var sshKnownhost string
-			for _, host := range meta.([]interface{}) {
-				sshKnownhost = sshKnownhost + host.(string) + "\n"
-			}
-			sshKnownhost = strings.TrimSuffix(sshKnownhost, "\n")
-			b = []byte(sshKnownhost)
-		} else {
-			b = []byte(fmt.Sprintf("%v", meta.(interface{})))
+		sp, err := newAzureServicePrincipal(providerMetadata)
+		if err != nil {
+			return nil, nil, err
+		}
+		osServicePrincipal, err := sp.encode()
+		if err != nil {
+			return nil, nil, err
 		}
-		if hiveKey, ok := mapYamlKeys[key]; ok {
-			secret.Data[hiveKey] = b
-		} else {
-			secret.Data[key] = b
+		migrated.Data["osServicePrincipal.json"] = osServicePrincipal
+		for _, key := range []string{"clientId", "clientSecret", "tenantId", "subscriptionId"} {
+			keyMapping[key] = "osServicePrincipal.json"
+			delete(providerMetadata, key)
 		}
 	}
 
-	delete(secret.Data, "metadata")
-	err = c.Update(context.Background(), &secret)
+	for key, value := range providerMetadata {
+		migrated.Data[dataKey(credType, key)] = []byte(value)
+		keyMapping[key] = dataKey(credType, key)
+	}
+
+	delete(migrated.Data, "metadata")
 
+	if migrated.Annotations == nil {
+		migrated.Annotations = map[string]string{}
+	}
+
+	// Hand off to the providercredential controller with the fingerprint of
+	// the migrated data
+	if hash, err := providercredential.CredentialDataHash(*migrated, cfg); err == nil {
+		migrated.Annotations[providercredential.CredentialHash] = hash
+	}
+
+	migration := newMigrationRecord(secret.Name, keyMapping)
+	migration.UnknownKeys = unknownKeys
+	if err := migration.annotate(migrated); err != nil {
+		return nil, nil, err
+	}
+	return migrated, &migration, nil
+}
+
+// updateSecret migrates the legacy "secret", reading it again and retrying
+// when it was modified concurrently. It returns false when the secret read
+// again is no longer in the legacy form.
+func (r *OldProviderConnectionReconciler) updateSecret(ctx context.Context, secret corev1.Secret) (bool, error) {
+	migrated := false
+	err := apply.RetryOnConflict(func(attempt int) error {
+		if attempt > 0 {
+			if err := r.APIReader.Get(ctx, client.ObjectKeyFromObject(&secret), &secret); err != nil {
+				return err
+			}
+			if _, legacy := secret.Labels[CloudConnectionLabel]; !legacy {
+				migrated = false
+				return nil
+			}
+		}
+		if err := r.migrateSecret(ctx, secret); err != nil {
+			return err
+		}
+		migrated = true
+		return nil
+	})
 	if err != nil {
-		klog.Error(err, "Failed to patch the Provider secret label")
-		return err
-	} else {
+		klog.Error(err, "Failed to migrate the Provider secret")
+		return false, err
+	}
+	if migrated {
 		klog.V(0).Info("Updated secret with new label and yaml keys: ", secret.Name)
 	}
-	return nil
+	return migrated, nil
 }
 
-func (r *OldProviderConnectionReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Secret{}).WithEventFilter(predicate.Funcs{
-		DeleteFunc: func(e event.DeleteEvent) bool {
-			return false
-		},
-	}).WithOptions(controller.Options{
-		MaxConcurrentReconciles: 1, // This is the default
-	}).Complete(r)
-}
+func (r *OldProviderConnectionReconciler) migrateSecret(ctx context.Context, secret corev1.Secret) error {
+	migrated, migration, err := Convert(secret, r.Config.Get())
+	if err != nil {
+		return err
+	}
 
-func extractSecretMetadata(secretData map[string][]byte) (map[string]interface{}, error) {
-	if bytes.Compare(secretData["metadata"], []byte{}) == 0 {
-		return nil, errors.New("Did not find any credential information with key: metadata")
+	// Reconnect the copies made from the legacy form, so the first rotation
+	// after the migration reaches them
+	if hash, ok := migrated.Annotations[providercredential.CredentialHash]; ok {
+		if migration.AdoptedCopies, err = adoptLegacyCopies(ctx, r.Client, r.APIReader, r.Config.Get(), migrated, hash); err != nil {
+			klog.Error(err, "Failed to adopt the legacy copies of ", secret.Name)
+			return err
+		}
+		if err := migration.annotate(migrated); err != nil {
+			return err
+		}
 	}
-	providerMetadata := map[string]interface{}{}
 
-	err := yaml.Unmarshal(secretData["metadata"], &providerMetadata)
-	if err != nil {
-		klog.Error(err)
-		return nil, errors.New("Failed to unmarshal the Provider secret metadata")
+	// A secret with a migration record was partly migrated by an earlier
+	// attempt, and its backup already holds the legacy form
+	if _, partlyMigrated := secret.Annotations[MigrationRecordAnnotation]; !partlyMigrated {
+		if err := createBackup(ctx, r.Client, r.APIReader, &secret); err != nil {
+			klog.Error(err, "Failed to back up the legacy secret")
+			return err
+		}
+	}
+
+	// Apply the migrated form, owning only the keys, labels and annotations
+	// written by the migration
+	applied := apply.NewSecret(secret.Namespace, secret.Name, secret.ResourceVersion)
+	applied.Labels = map[string]string{providercredential.CredentialLabel: ""}
+	if credType, ok := migrated.Labels[providercredential.ProviderTypeLabel]; ok {
+		applied.Labels[providercredential.ProviderTypeLabel] = credType
+	}
+	applied.Annotations = map[string]string{MigrationRecordAnnotation: migrated.Annotations[MigrationRecordAnnotation]}
+	if hash, ok := migrated.Annotations[providercredential.CredentialHash]; ok {
+		applied.Annotations[providercredential.CredentialHash] = hash
+	}
+	applied.Data = map[string][]byte{}
+	for _, key := range migration.KeyMapping {
+		applied.Data[key] = migrated.Data[key]
+	}
+	if err := apply.Secret(ctx, r.Client, FieldManager, applied); err != nil {
+		return err
+	}
+
+	// Then drop the legacy form, which the tools that created it own
+	legacy := applied.DeepCopy()
+	delete(applied.Labels, CloudConnectionLabel)
+	delete(applied.Labels, ProviderLabel)
+	delete(applied.Labels, MigrationStatusLabel)
+	delete(applied.Data, "metadata")
+	if err := r.Patch(ctx, applied, client.MergeFromWithOptions(legacy, client.MergeFromWithOptimisticLock{})); err != nil {
+		return err
 	}
 
-	return providerMetadata, err
+	if len(migration.UnknownKeys) > 0 && r.Recorder != nil {
+		r.Recorder.Event(&secret, corev1.EventTypeWarning, UnknownMetadataKeysEventReason,
+			"migrated metadata keys not known for "+migrated.Labels[providercredential.ProviderTypeLabel]+
+				" provider connections as written: "+strings.Join(migration.UnknownKeys, ", "))
+	}
+	return nil
+}
+
+func (r *OldProviderConnectionReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	cfg := r.Config.Get()
+
+	if err := registerRemaining(r.Cache); err != nil {
+		return err
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("oldproviderconnection").
+		WatchesRawSource(source.Kind(r.Cache, &corev1.Secret{}), &handler.EnqueueRequestForObject{}).
+		WithEventFilter(predicate.Funcs{
+			DeleteFunc: func(e event.DeleteEvent) bool {
+				return false
+			},
+		}).WithOptions(controller.Options{
+		MaxConcurrentReconciles: cfg.Concurrency.MaxConcurrentReconciles,
+		RateLimiter:             cfg.RateLimiter(),
+	}).Complete(r)
 }
@@ -2,9 +2,12 @@ package oldproviderconnection
 
 import (
 	"context"
+	"encoding/json"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/stolostron/provider-credential-controller/pkg/config"
 	"go.uber.org/zap/zapcore"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -13,6 +16,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
@@ -29,6 +33,21 @@ func TestReconcile(t *testing.T) {
 	secretName := "test-ns"
 	azrMetadata := "clientId: a\nclientSecret: b\ntenantId: c\nsubscriptionId: d"
 	hostsMetadata := "sshKnownHosts:\n  - a\n  - b"
+	hostileAzrMetadata := "clientId: a\nclientSecret: 'q\"u\\o\"te'\ntenantId: c\nsubscriptionId: d"
+	incompleteAzrMetadata := "clientId: a\nclientSecret: b\ntenantId: c"
+	nonStringHostsMetadata := "sshKnownHosts:\n  - a\n  - {b: c}"
+	mappingHostsMetadata := "sshKnownHosts:\n  a: b"
+	nestedMetadata := "awsAccessKeyID:\n  - a\nawsSecretAccessKeyID: b"
+	duplicateMetadata := "awsAccessKeyID: a\nawsAccessKeyID: b"
+	rhvMetadata := "ovirtUrl: https://rhv.example.com/ovirt-engine/api\novirtFqdn: rhv.example.com\n" +
+		"ovirtUsername: admin@internal\novirtPassword: 'p@ss: word'\n" +
+		"ovirtCABundle: |\n  -----BEGIN CERTIFICATE-----\n  abc\n  -----END CERTIFICATE-----\n" +
+		"baseDomain: example.com\nsshPrivatekey: c\nsshPublickey: d"
+	incompleteRhvMetadata := "ovirtUrl: https://rhv.example.com/ovirt-engine/api\novirtUsername: admin@internal"
+	bmMetadata := "libvirtURI: qemu+ssh://root@host/system\nsshKnownHosts:\n  - host1 ssh-rsa AAA\n  - host2 ssh-rsa BBB\n" +
+		"imageMirror: mirror.example.com:5000/ocp\nbootstrapOSImage: https://mirror/rhcos-qemu.qcow2.gz\n" +
+		"clusterOSImage: https://mirror/rhcos-openstack.qcow2.gz\npullSecret: '{\"auths\":{}}'\n" +
+		"sshPrivatekey: c\nsshPublickey: d\nbaseDomain: example.com"
 	mappingMetadata := "awsAccessKeyID: a\nawsSecretAccessKeyID: b\nsshPrivatekey: c\nsshPublickey: d\ngcServiceAccountKey: e\ngcProjectID: f\nopenstackCloudsYaml: g\nopenstackCloud: h\nvcenter: i\nvmClusterName: j\ndatastore: k\nothers: others-values"
 
 	tests := []struct {
@@ -53,7 +72,7 @@ func TestReconcile(t *testing.T) {
 				ProviderLabel:        "aws",
 				CloudConnectionLabel: "abc",
 				"other-label":        "other-value",
-			}, azrMetadata),
+			}, "awsAccessKeyID: a\nawsSecretAccessKeyID: b"),
 			validateFunc: func(c client.Client, err error, t *testing.T) {
 				if err != nil {
 					t.Fatalf("unexpected err: %v", err)
@@ -78,6 +97,45 @@ func TestReconcile(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "translate provider label alias",
+			secret: newSecret(secretNamespace, secretName, map[string]string{
+				ProviderLabel:        "Amazon",
+				CloudConnectionLabel: "",
+			}, "awsAccessKeyID: a\nawsSecretAccessKeyID: b"),
+			validateFunc: func(c client.Client, err error, t *testing.T) {
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+
+				var secret corev1.Secret
+				if err := c.Get(context.Background(), types.NamespacedName{
+					Namespace: secretNamespace,
+					Name:      secretName,
+				}, &secret); err != nil {
+					t.Fatalf("failed to fetch secret: %v", err)
+				}
+
+				expectedLabels := map[string]string{
+					providercredential.ProviderTypeLabel: "aws",
+					providercredential.CredentialLabel:   "",
+				}
+				if !reflect.DeepEqual(secret.Labels, expectedLabels) {
+					t.Fatalf("expected labels %v, but got %v", expectedLabels, secret.Labels)
+				}
+				if secret.Annotations[providercredential.CredentialHash] == "" {
+					t.Fatalf("expected the %v annotation to be set", providercredential.CredentialHash)
+				}
+			},
+		},
+		{
+			name: "refuse unknown provider label",
+			secret: newSecret(secretNamespace, secretName, map[string]string{
+				ProviderLabel: "digitalocean",
+			}, "token: a"),
+			validateFunc: expectMigrationFailed(secretNamespace, secretName, []byte("token: a"),
+				"is not a known provider type"),
+		},
 		{
 			name: "handle azr os service principal",
 			secret: newSecret(secretNamespace, secretName, map[string]string{
@@ -102,6 +160,69 @@ func TestReconcile(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "escape azr os service principal values",
+			secret: newSecret(secretNamespace, secretName, map[string]string{
+				ProviderLabel: "azr",
+			}, hostileAzrMetadata),
+			validateFunc: func(c client.Client, err error, t *testing.T) {
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+
+				var secret corev1.Secret
+				if err := c.Get(context.Background(), types.NamespacedName{
+					Namespace: secretNamespace,
+					Name:      secretName,
+				}, &secret); err != nil {
+					t.Fatalf("failed to fetch secret: %v", err)
+				}
+
+				sp := map[string]string{}
+				if err := json.Unmarshal(secret.Data["osServicePrincipal.json"], &sp); err != nil {
+					t.Fatalf("expected valid json, but got %v: %v", string(secret.Data["osServicePrincipal.json"]), err)
+				}
+				if sp["clientSecret"] != `q"u\o"te` {
+					t.Fatalf("expected clientSecret %v, but got %v", `q"u\o"te`, sp["clientSecret"])
+				}
+			},
+		},
+		{
+			name: "refuse azr with missing service principal field",
+			secret: newSecret(secretNamespace, secretName, map[string]string{
+				ProviderLabel:        "azr",
+				CloudConnectionLabel: "",
+			}, incompleteAzrMetadata),
+			validateFunc: func(c client.Client, err error, t *testing.T) {
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+
+				var secret corev1.Secret
+				if err := c.Get(context.Background(), types.NamespacedName{
+					Namespace: secretNamespace,
+					Name:      secretName,
+				}, &secret); err != nil {
+					t.Fatalf("failed to fetch secret: %v", err)
+				}
+
+				expectedLabels := map[string]string{
+					ProviderLabel:        "azr",
+					CloudConnectionLabel: "",
+					MigrationStatusLabel: MigrationFailed,
+				}
+				if !reflect.DeepEqual(secret.Labels, expectedLabels) {
+					t.Fatalf("expected labels %v, but got %v", expectedLabels, secret.Labels)
+				}
+
+				expectedData := map[string][]byte{
+					"metadata": []byte(incompleteAzrMetadata),
+				}
+				if !reflect.DeepEqual(secret.Data, expectedData) {
+					t.Fatalf("expected data %v, but got %v", expectedData, secret.Data)
+				}
+			},
+		},
 		{
 			name:   "process sshKnownHosts",
 			secret: newSecret(secretNamespace, secretName, nil, hostsMetadata),
@@ -127,6 +248,199 @@ func TestReconcile(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:   "refuse non string sshKnownHosts",
+			secret: newSecret(secretNamespace, secretName, nil, nonStringHostsMetadata),
+			validateFunc: expectMigrationFailed(secretNamespace, secretName, []byte(nonStringHostsMetadata),
+				"metadata.sshKnownHosts[1] must be a string"),
+		},
+		{
+			name:   "refuse sshKnownHosts mapping",
+			secret: newSecret(secretNamespace, secretName, nil, mappingHostsMetadata),
+			validateFunc: expectMigrationFailed(secretNamespace, secretName, []byte(mappingHostsMetadata),
+				"metadata.sshKnownHosts must be a list of strings"),
+		},
+		{
+			name: "refuse nested value",
+			secret: newSecret(secretNamespace, secretName, map[string]string{
+				ProviderLabel: "aws",
+			}, nestedMetadata),
+			validateFunc: expectMigrationFailed(secretNamespace, secretName, []byte(nestedMetadata),
+				"metadata.awsAccessKeyID must be a string"),
+		},
+		{
+			name:   "refuse duplicate keys",
+			secret: newSecret(secretNamespace, secretName, nil, duplicateMetadata),
+			validateFunc: expectMigrationFailed(secretNamespace, secretName, []byte(duplicateMetadata),
+				"metadata is not a valid YAML mapping"),
+		},
+		{
+			name:   "refuse metadata that is not a mapping",
+			secret: newSecret(secretNamespace, secretName, nil, "just text"),
+			validateFunc: expectMigrationFailed(secretNamespace, secretName, []byte("just text"),
+				"metadata is not a valid YAML mapping"),
+		},
+		{
+			name: "refuse missing metadata",
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: secretNamespace,
+					Labels: map[string]string{CloudConnectionLabel: ""}},
+			},
+			validateFunc: expectMigrationFailed(secretNamespace, secretName, nil,
+				"did not find any credential information"),
+		},
+		{
+			name: "map redhatvirtualization metadata",
+			secret: newSecret(secretNamespace, secretName, map[string]string{
+				ProviderLabel: "redhatvirtualization",
+			}, rhvMetadata),
+			validateFunc: func(c client.Client, err error, t *testing.T) {
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+
+				var secret corev1.Secret
+				if err := c.Get(context.Background(), types.NamespacedName{
+					Namespace: secretNamespace,
+					Name:      secretName,
+				}, &secret); err != nil {
+					t.Fatalf("failed to fetch secret: %v", err)
+				}
+
+				expectedData := map[string][]byte{
+					"ovirt_url":       []byte("https://rhv.example.com/ovirt-engine/api"),
+					"ovirt_fqdn":      []byte("rhv.example.com"),
+					"ovirt_username":  []byte("admin@internal"),
+					"ovirt_password":  []byte("p@ss: word"),
+					"ovirt_ca_bundle": []byte("-----BEGIN CERTIFICATE-----\nabc\n-----END CERTIFICATE-----\n"),
+					"baseDomain":      []byte("example.com"),
+					"ssh-privatekey":  []byte("c"),
+					"ssh-publickey":   []byte("d"),
+				}
+				if !reflect.DeepEqual(secret.Data, expectedData) {
+					t.Fatalf("expected data %v, but got %v", expectedData, secret.Data)
+				}
+				if secret.Annotations[providercredential.CredentialHash] == "" {
+					t.Fatalf("expected the %v annotation to be set", providercredential.CredentialHash)
+				}
+			},
+		},
+		{
+			name: "refuse redhatvirtualization without password",
+			secret: newSecret(secretNamespace, secretName, map[string]string{
+				ProviderLabel: "redhatvirtualization",
+			}, incompleteRhvMetadata),
+			validateFunc: expectMigrationFailed(secretNamespace, secretName, []byte(incompleteRhvMetadata),
+				"metadata.ovirtPassword is required"),
+		},
+		{
+			name: "map bm metadata",
+			secret: newSecret(secretNamespace, secretName, map[string]string{
+				ProviderLabel: "bm",
+			}, bmMetadata),
+			validateFunc: func(c client.Client, err error, t *testing.T) {
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+
+				var secret corev1.Secret
+				if err := c.Get(context.Background(), types.NamespacedName{
+					Namespace: secretNamespace,
+					Name:      secretName,
+				}, &secret); err != nil {
+					t.Fatalf("failed to fetch secret: %v", err)
+				}
+
+				expectedData := map[string][]byte{
+					"libvirtURI":       []byte("qemu+ssh://root@host/system"),
+					"sshKnownHosts":    []byte("host1 ssh-rsa AAA\nhost2 ssh-rsa BBB"),
+					"imageMirror":      []byte("mirror.example.com:5000/ocp"),
+					"bootstrapOSImage": []byte("https://mirror/rhcos-qemu.qcow2.gz"),
+					"clusterOSImage":   []byte("https://mirror/rhcos-openstack.qcow2.gz"),
+					"pullSecret":       []byte(`{"auths":{}}`),
+					"ssh-privatekey":   []byte("c"),
+					"ssh-publickey":    []byte("d"),
+					"baseDomain":       []byte("example.com"),
+				}
+				if !reflect.DeepEqual(secret.Data, expectedData) {
+					t.Fatalf("expected data %v, but got %v", expectedData, secret.Data)
+				}
+			},
+		},
+		{
+			name: "refuse bm without libvirtURI",
+			secret: newSecret(secretNamespace, secretName, map[string]string{
+				ProviderLabel: "bm",
+			}, "imageMirror: mirror.example.com:5000/ocp"),
+			validateFunc: expectMigrationFailed(secretNamespace, secretName, []byte("imageMirror: mirror.example.com:5000/ocp"),
+				"metadata.libvirtURI is required"),
+		},
+		{
+			name: "keep unknown scalar key of a known provider type",
+			secret: newSecret(secretNamespace, secretName, map[string]string{
+				ProviderLabel: "aws",
+			}, "awsAccessKeyID: a\nawsSecretAccessKeyID: b\nregion: us-east-1"),
+			validateFunc: func(c client.Client, err error, t *testing.T) {
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+
+				var secret corev1.Secret
+				if err := c.Get(context.Background(), types.NamespacedName{
+					Namespace: secretNamespace,
+					Name:      secretName,
+				}, &secret); err != nil {
+					t.Fatalf("failed to fetch secret: %v", err)
+				}
+
+				expectedData := map[string][]byte{
+					"aws_access_key_id":     []byte("a"),
+					"aws_secret_access_key": []byte("b"),
+					"region":                []byte("us-east-1"),
+				}
+				if !reflect.DeepEqual(secret.Data, expectedData) {
+					t.Fatalf("expected data %v, but got %v", expectedData, secret.Data)
+				}
+			},
+		},
+		{
+			name: "refuse unknown key of a known provider type holding a mapping",
+			secret: newSecret(secretNamespace, secretName, map[string]string{
+				ProviderLabel: "aws",
+			}, "awsAccessKeyID: a\nawsSecretAccessKeyID: b\nregion:\n  name: us-east-1"),
+			validateFunc: expectMigrationFailed(secretNamespace, secretName, []byte("awsAccessKeyID: a\nawsSecretAccessKeyID: b\nregion:\n  name: us-east-1"),
+				"metadata.region must be a string, got a mapping"),
+		},
+		{
+			name: "keep scalars as written",
+			secret: newSecret(secretNamespace, secretName, map[string]string{
+				ProviderLabel: "aws",
+			}, "awsAccessKeyID: 1e+06\nawsSecretAccessKeyID: 0x1F\nbaseDomain: 1.10\nisOcp: yes\nnoProxy: ~"),
+			validateFunc: func(c client.Client, err error, t *testing.T) {
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+
+				var secret corev1.Secret
+				if err := c.Get(context.Background(), types.NamespacedName{
+					Namespace: secretNamespace,
+					Name:      secretName,
+				}, &secret); err != nil {
+					t.Fatalf("failed to fetch secret: %v", err)
+				}
+
+				expectedData := map[string][]byte{
+					"aws_access_key_id":     []byte("1e+06"),
+					"aws_secret_access_key": []byte("0x1F"),
+					"baseDomain":            []byte("1.10"),
+					"isOcp":                 []byte("yes"),
+					"noProxy":               {},
+				}
+				if !reflect.DeepEqual(secret.Data, expectedData) {
+					t.Fatalf("expected data %q, but got %q", expectedData, secret.Data)
+				}
+			},
+		},
 		{
 			name:   "map metadata to key",
 			secret: newSecret(secretNamespace, secretName, nil, mappingMetadata),
@@ -175,9 +489,11 @@ func TestReconcile(t *testing.T) {
 			fakeClient := fake.NewFakeClient(objs...)
 			s := scheme.Scheme
 			reconciler := &OldProviderConnectionReconciler{
-				Client: fakeClient,
-				Log:    ctrl.Log.WithName("controllers").WithName("OldProviderConnectionReconciler"),
-				Scheme: s,
+				Client:    fakeClient,
+				APIReader: fakeClient,
+				Log:       ctrl.Log.WithName("controllers").WithName("OldProviderConnectionReconciler"),
+				Scheme:    s,
+				Recorder:  record.NewFakeRecorder(10),
 			}
 
 			req := reconcile.Request{
@@ -192,12 +508,185 @@ func TestReconcile(t *testing.T) {
 	}
 }
 
+func TestReconcileUnknownMetadataKeysEvent(t *testing.T) {
+	secret := newSecret("secret1", "test-ns", map[string]string{
+		ProviderLabel: "aws",
+	}, "awsAccessKeyID: a\nawsSecretAccessKeyID: b\nregion: us-east-1\nzone: us-east-1a")
+
+	fakeClient := fake.NewFakeClient(secret)
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &OldProviderConnectionReconciler{
+		Client:    fakeClient,
+		APIReader: fakeClient,
+		Log:       ctrl.Log.WithName("controllers").WithName("OldProviderConnectionReconciler"),
+		Scheme:    scheme.Scheme,
+		Recorder:  recorder,
+	}
+
+	_, err := reconciler.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	close(recorder.Events)
+	var warnings []string
+	for e := range recorder.Events {
+		if strings.HasPrefix(e, corev1.EventTypeWarning) {
+			warnings = append(warnings, e)
+		}
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], UnknownMetadataKeysEventReason) ||
+		!strings.Contains(warnings[0], "region, zone") {
+		t.Fatalf("expected a %v warning naming region and zone, but got %v", UnknownMetadataKeysEventReason, warnings)
+	}
+
+	var migrated corev1.Secret
+	if err := fakeClient.Get(context.Background(), client.ObjectKeyFromObject(secret), &migrated); err != nil {
+		t.Fatalf("failed to fetch secret: %v", err)
+	}
+	var migration MigrationRecord
+	if err := json.Unmarshal([]byte(migrated.Annotations[MigrationRecordAnnotation]), &migration); err != nil {
+		t.Fatalf("failed to decode the migration record: %v", err)
+	}
+	if !reflect.DeepEqual(migration.UnknownKeys, []string{"region", "zone"}) {
+		t.Fatalf("expected the migration record to list region and zone, but got %v", migration.UnknownKeys)
+	}
+}
+
+func TestReconcileMigrationFailedEvent(t *testing.T) {
+	secret := newSecret("secret1", "test-ns", map[string]string{
+		ProviderLabel: "azr",
+	}, "clientId: a\nclientSecret: \"\"\ntenantId: c\nsubscriptionId: d")
+
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &OldProviderConnectionReconciler{
+		Client:   fake.NewFakeClient(secret),
+		Log:      ctrl.Log.WithName("controllers").WithName("OldProviderConnectionReconciler"),
+		Scheme:   scheme.Scheme,
+		Recorder: recorder,
+	}
+
+	_, err := reconciler.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	close(recorder.Events)
+	var events []string
+	for e := range recorder.Events {
+		events = append(events, e)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected one event, but got %v", events)
+	}
+	if !strings.Contains(events[0], corev1.EventTypeWarning+" "+MigrationFailedEventReason) ||
+		!strings.Contains(events[0], "metadata.clientSecret") {
+		t.Fatalf("expected a %v warning naming metadata.clientSecret, but got %v", MigrationFailedEventReason, events[0])
+	}
+}
+
+func TestReconcileIgnoresOtherSecrets(t *testing.T) {
+	// The label may be removed while a reconcile of the secret is queued
+	secret := newSecret("secret1", "test-ns", map[string]string{ProviderLabel: "aws"}, "awsAccessKeyID: a\nawsSecretAccessKeyID: b")
+	delete(secret.Labels, CloudConnectionLabel)
+
+	fakeClient := fake.NewFakeClient(secret)
+	reconciler := &OldProviderConnectionReconciler{
+		Client:    fakeClient,
+		APIReader: fakeClient,
+		Log:       ctrl.Log.WithName("controllers").WithName("OldProviderConnectionReconciler"),
+		Scheme:    scheme.Scheme,
+	}
+
+	_, err := reconciler.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	var unchanged corev1.Secret
+	if err := fakeClient.Get(context.Background(), client.ObjectKeyFromObject(secret), &unchanged); err != nil {
+		t.Fatalf("failed to fetch secret: %v", err)
+	}
+	if !reflect.DeepEqual(unchanged.Data, secret.Data) || !reflect.DeepEqual(unchanged.Labels, secret.Labels) {
+		t.Fatalf("expected a secret without %v to be left alone, but got %v", CloudConnectionLabel, unchanged)
+	}
+}
+
+// expectMigrationFailed checks the secret was labelled as failed, with its
+// metadata left untouched, and the recorded reason contains "reason".
+func expectMigrationFailed(namespace, name string, metadata []byte, reason string) func(c client.Client, err error, t *testing.T) {
+	return func(c client.Client, err error, t *testing.T) {
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		var secret corev1.Secret
+		if err := c.Get(context.Background(), types.NamespacedName{
+			Namespace: namespace,
+			Name:      name,
+		}, &secret); err != nil {
+			t.Fatalf("failed to fetch secret: %v", err)
+		}
+
+		if secret.Labels[MigrationStatusLabel] != MigrationFailed {
+			t.Fatalf("expected label %v=%v, but got %v", MigrationStatusLabel, MigrationFailed, secret.Labels)
+		}
+		if !reflect.DeepEqual(secret.Data["metadata"], metadata) {
+			t.Fatalf("expected metadata %q, but got %q", metadata, secret.Data["metadata"])
+		}
+		if _, _, err := Convert(secret, config.Default()); err == nil || !strings.Contains(err.Error(), reason) {
+			t.Fatalf("expected an error containing %q, but got %v", reason, err)
+		}
+	}
+}
+
+func TestProviderType(t *testing.T) {
+	tests := []struct {
+		labels   map[string]string
+		expected string
+		err      bool
+	}{
+		{labels: nil, expected: ""},
+		{labels: map[string]string{ProviderLabel: "aws"}, expected: "aws"},
+		{labels: map[string]string{ProviderLabel: "azure"}, expected: "azr"},
+		{labels: map[string]string{ProviderLabel: "vsphere"}, expected: "vmw"},
+		{labels: map[string]string{ProviderLabel: "openstack"}, expected: "ost"},
+		{labels: map[string]string{ProviderLabel: "rhv"}, expected: "redhatvirtualization"},
+		{labels: map[string]string{ProviderLabel: "baremetal"}, expected: "bm"},
+		{labels: map[string]string{ProviderLabel: "ansible"}, expected: "ans"},
+		{labels: map[string]string{ProviderLabel: ""}, err: true},
+		{labels: map[string]string{ProviderLabel: "digitalocean"}, err: true},
+	}
+
+	for _, tt := range tests {
+		credType, err := providerType(tt.labels)
+		if tt.err != (err != nil) {
+			t.Fatalf("%v: expected error %v, but got %v", tt.labels, tt.err, err)
+		}
+		if credType != tt.expected {
+			t.Fatalf("%v: expected %q, but got %q", tt.labels, tt.expected, credType)
+		}
+	}
+}
+
+// newSecret returns a legacy provider connection, labelled with
+// CloudConnectionLabel in addition to "labels".
 func newSecret(namespace, name string, labels map[string]string, metadata string) *corev1.Secret {
+	legacyLabels := map[string]string{CloudConnectionLabel: ""}
+	for key, value := range labels {
+		legacyLabels[key] = value
+	}
 	return &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
 			Namespace: namespace,
-			Labels:    labels,
+			Labels:    legacyLabels,
 		},
 		Data: map[string][]byte{
 			"metadata": []byte(metadata),
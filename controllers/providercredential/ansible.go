@@ -0,0 +1,206 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package providercredential
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/stolostron/provider-credential-controller/pkg/apply"
+	"github.com/stolostron/provider-credential-controller/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// SyncClusterCuratorsAnnotation, set to "true" on an Ansible ("ans")
+// Provider secret, keeps the host and token of the Ansible secrets that
+// ClusterCurators in Joined ManagedCluster namespaces reference in sync with
+// it, even when those secrets are not labelled as its copies.
+const SyncClusterCuratorsAnnotation = "cluster.open-cluster-management.io/sync-cluster-curators"
+
+// RefreshedClusterCuratorsAnnotation is set on an Ansible Provider secret to
+// the JSON list of the ClusterCurators whose Ansible secrets received the
+// last rotation.
+const RefreshedClusterCuratorsAnnotation = "cluster.open-cluster-management.io/refreshed-cluster-curators"
+
+// ClusterCuratorsRefreshedEventReason is the Normal Event reason recorded on
+// an Ansible Provider secret listing the ClusterCurators a rotation refreshed.
+const ClusterCuratorsRefreshedEventReason = "ClusterCuratorsRefreshed"
+
+// ClusterCuratorGVK identifies the namespaced ClusterCurator resource. Like
+// ManagedClusterGVK, it is read via unstructured.Unstructured.
+var ClusterCuratorGVK = schema.GroupVersionKind{
+	Group:   "cluster.open-cluster-management.io",
+	Version: "v1beta1",
+	Kind:    "ClusterCurator",
+}
+
+// clusterCuratorActions are the ClusterCurator spec fields whose
+// towerAuthSecret names the Ansible secret used by their hooks.
+var clusterCuratorActions = []string{"install", "upgrade", "destroy", "scale"}
+
+// ansibleKeys are the keys of an Ansible secret kept in sync.
+var ansibleKeys = []string{"host", "token"}
+
+// RefreshedClusterCurator is an entry of the RefreshedClusterCuratorsAnnotation.
+type RefreshedClusterCurator struct {
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	Secrets   []string `json:"secrets"`
+}
+
+// towerAuthSecrets returns the Ansible secret names referenced by "curator".
+func towerAuthSecrets(curator *unstructured.Unstructured) []string {
+	names := []string{}
+	for _, action := range clusterCuratorActions {
+		name, _, _ := unstructured.NestedString(curator.Object, "spec", action, "towerAuthSecret")
+		if name != "" && !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ansibleData returns the host and token of "data".
+func ansibleData(data map[string][]byte) map[string][]byte {
+	subset := map[string][]byte{}
+	for _, key := range ansibleKeys {
+		if value, ok := data[key]; ok {
+			subset[key] = value
+		}
+	}
+	return subset
+}
+
+// derivedFrom returns true if "data", the data of a secret referenced by a
+// ClusterCurator, was copied from the Provider secret before its rotation:
+// either all of it, or its host and token, hash to "originalHash".
+func derivedFrom(data map[string][]byte, originalHash []byte) bool {
+	expected := base64.StdEncoding.EncodeToString(originalHash)
+	for _, candidate := range []map[string][]byte{data, ansibleData(data)} {
+		if hash, err := DataHash(candidate); err == nil && hash == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshClusterCurators keeps the Ansible secrets referenced by the
+// ClusterCurators in Joined ManagedCluster namespaces in sync with the
+// rotated Provider secret "secret". Copies of "secret" were already updated
+// and are only reported; unlabelled secrets derived from "originalHash" have
+// their host and token set from "secretData". It returns the refreshed
+// ClusterCurators.
+func (r *ProviderCredentialSecretReconciler) refreshClusterCurators(ctx context.Context, log logr.Logger, secret *corev1.Secret, originalHash, currentHash []byte, secretData map[string][]byte, cfg *config.Configuration) ([]RefreshedClusterCurator, error) {
+	namespaces, err := JoinedManagedClusterNamespaces(ctx, r.APIReader)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshed := []RefreshedClusterCurator{}
+	for _, namespace := range namespaces {
+		curators := &unstructured.UnstructuredList{}
+		curators.SetGroupVersionKind(ClusterCuratorGVK.GroupVersion().WithKind(ClusterCuratorGVK.Kind + "List"))
+		if err := r.APIReader.List(ctx, curators, client.InNamespace(namespace)); err != nil {
+			if meta.IsNoMatchError(err) {
+				return refreshed, nil
+			}
+			return nil, err
+		}
+
+		for i := range curators.Items {
+			curator := RefreshedClusterCurator{Namespace: namespace, Name: curators.Items[i].GetName(), Secrets: []string{}}
+			for _, name := range towerAuthSecrets(&curators.Items[i]) {
+				ok, err := r.refreshAnsibleSecret(ctx, secret, types.NamespacedName{Namespace: namespace, Name: name},
+					originalHash, currentHash, secretData, cfg)
+				if err != nil {
+					log.Error(err, "|--X Failed to refresh the Ansible secret "+namespace+"/"+name+
+						" of ClusterCurator "+curator.Name)
+					continue
+				}
+				if ok {
+					curator.Secrets = append(curator.Secrets, name)
+				}
+			}
+			if len(curator.Secrets) > 0 {
+				log.V(0).Info("|--> Refreshed ClusterCurator " + namespace + "/" + curator.Name)
+				refreshed = append(refreshed, curator)
+			}
+		}
+	}
+	return refreshed, nil
+}
+
+// refreshAnsibleSecret sets the host and token of the secret "key" from
+// "secretData" when it was derived from "secret". It returns true when the
+// secret holds the rotated credential.
+func (r *ProviderCredentialSecretReconciler) refreshAnsibleSecret(ctx context.Context, secret *corev1.Secret, key types.NamespacedName, originalHash, currentHash []byte, secretData map[string][]byte, cfg *config.Configuration) (bool, error) {
+	refreshed := false
+	err := apply.RetryOnConflict(func(attempt int) error {
+		var referenced corev1.Secret
+		if err := r.APIReader.Get(ctx, key, &referenced); err != nil {
+			if k8serrors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+
+		// Copies were updated with the rest of the rotation
+		if referenced.Labels[CopiedFromNamespaceLabel] == secret.Namespace && referenced.Labels[CopiedFromNameLabel] == secret.Name {
+			hash, err := DataHash(referenced.Data)
+			refreshed = err == nil && hash == base64.StdEncoding.EncodeToString(currentHash)
+			return nil
+		}
+		if _, labelled := referenced.Labels[CopiedFromNameLabel]; labelled || GitOpsOwner(&referenced, cfg) != "" {
+			return nil
+		}
+		if !derivedFrom(referenced.Data, originalHash) {
+			return nil
+		}
+
+		updated := apply.NewSecret(key.Namespace, key.Name, referenced.ResourceVersion)
+		updated.Data = ansibleData(secretData)
+		if err := apply.Secret(ctx, r.Client, FieldManager, updated); err != nil {
+			return err
+		}
+		refreshed = true
+		return nil
+	})
+	return refreshed, err
+}
+
+// refreshedClusterCuratorsAnnotation returns the RefreshedClusterCuratorsAnnotation
+// value listing "curators", sorted by namespace and name, and the summary
+// used in the ClusterCuratorsRefreshedEventReason Event.
+func refreshedClusterCuratorsAnnotation(curators []RefreshedClusterCurator) (string, string, error) {
+	sort.Slice(curators, func(i, j int) bool {
+		if curators[i].Namespace != curators[j].Namespace {
+			return curators[i].Namespace < curators[j].Namespace
+		}
+		return curators[i].Name < curators[j].Name
+	})
+	names := []string{}
+	for _, curator := range curators {
+		names = append(names, curator.Namespace+"/"+curator.Name)
+	}
+	value, err := json.Marshal(curators)
+	return string(value), "refreshed the Ansible credential of ClusterCurators " + strings.Join(names, ", "), err
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package providercredential
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/stolostron/provider-credential-controller/pkg/apply"
+	"github.com/stolostron/provider-credential-controller/pkg/envelope"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// EncryptionKeyAnnotation holds, on a copy's namespace, the PEM encoded RSA
+// public key copies in that namespace are encrypted to.
+const EncryptionKeyAnnotation = "cluster.open-cluster-management.io/credential-encryption-key"
+
+// EncryptionKeySecretName is the secret that may hold, in a copy's
+// namespace and under EncryptionKeySecretKey, the public key copies in that
+// namespace are encrypted to. It takes precedence over the annotation.
+const (
+	EncryptionKeySecretName = "provider-credential-encryption-key"
+	EncryptionKeySecretKey  = "publicKey"
+)
+
+// CredentialFingerprintAnnotation is set on encrypted copies in place of the
+// plaintext the hash gate checks: an HMAC-SHA256 of the raw CredentialHash
+// of the data the copy holds and of its namespace and name, keyed by the
+// Provider secret's fingerprint key. The CredentialHash is published on the
+// Provider secret, so the key is what keeps it from being forged; it does
+// not reveal the hash or carry over to another copy.
+const CredentialFingerprintAnnotation = "cluster.open-cluster-management.io/credential-fingerprint"
+
+// FingerprintKeySecretSuffix names the secret, next to a Provider secret,
+// that holds under FingerprintKeySecretKey the key of the fingerprints of
+// its encrypted copies. The controller creates it with a random key, owned
+// by the Provider secret, the first time it encrypts a copy.
+const (
+	FingerprintKeySecretSuffix = "-fingerprint-key"
+	FingerprintKeySecretKey    = "key"
+)
+
+// fingerprintKeySize is the size of a fingerprint key, that of the HMAC-SHA256 block.
+const fingerprintKeySize = 64
+
+func fingerprintKeyName(secretName string) string {
+	return secretName + FingerprintKeySecretSuffix
+}
+
+// fingerprintKey returns the key of the fingerprints of the encrypted copies
+// of "provider". When it has none yet, one is created if "create" is set,
+// else nil is returned and no encrypted copy matches.
+func (r *ProviderCredentialSecretReconciler) fingerprintKey(ctx context.Context, provider *corev1.Secret, create bool) ([]byte, error) {
+	var keySecret corev1.Secret
+	name := types.NamespacedName{Namespace: provider.Namespace, Name: fingerprintKeyName(provider.Name)}
+	err := r.APIReader.Get(ctx, name, &keySecret)
+	switch {
+	case err == nil:
+		if len(keySecret.Data[FingerprintKeySecretKey]) < fingerprintKeySize {
+			return nil, fmt.Errorf("invalid fingerprint key in %s/%s", name.Namespace, name.Name)
+		}
+		return keySecret.Data[FingerprintKeySecretKey], nil
+	case !k8serrors.IsNotFound(err) || !create:
+		return nil, client.IgnoreNotFound(err)
+	}
+
+	key := make([]byte, fingerprintKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	keySecret = corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: name.Namespace,
+			Name:      name.Name,
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "v1",
+				Kind:       "Secret",
+				Name:       provider.Name,
+				UID:        provider.UID,
+			}},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{FingerprintKeySecretKey: key},
+	}
+	if err := r.Create(ctx, &keySecret); err != nil {
+		if k8serrors.IsAlreadyExists(err) {
+			// Created concurrently, read it again
+			if key, err := r.fingerprintKey(ctx, provider, false); key != nil || err != nil {
+				return key, err
+			}
+		}
+		return nil, err
+	}
+	return key, nil
+}
+
+// encryptionKey returns the public key the copies in "namespace" are
+// encrypted to, or nil when they are stored in plaintext. An invalid key is
+// an error, so the credential is never written in plaintext by mistake.
+func (r *ProviderCredentialSecretReconciler) encryptionKey(ctx context.Context, namespace string) (*rsa.PublicKey, error) {
+	var keySecret corev1.Secret
+	err := r.APIReader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: EncryptionKeySecretName}, &keySecret)
+	switch {
+	case err == nil:
+		key, err := envelope.ParsePublicKey(keySecret.Data[EncryptionKeySecretKey])
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key in %s/%s: %w", namespace, EncryptionKeySecretName, err)
+		}
+		return key, nil
+	case !k8serrors.IsNotFound(err):
+		return nil, err
+	}
+
+	var ns corev1.Namespace
+	if err := r.APIReader.Get(ctx, types.NamespacedName{Name: namespace}, &ns); err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	value, ok := ns.Annotations[EncryptionKeyAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	key, err := envelope.ParsePublicKey([]byte(value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s on namespace %s: %w", EncryptionKeyAnnotation, namespace, err)
+	}
+	return key, nil
+}
+
+// copyFingerprint returns the CredentialFingerprintAnnotation, under the
+// fingerprint key "key", of the copy "namespace"/"name" holding data that
+// hashes to "hash".
+func copyFingerprint(key, hash []byte, namespace, name string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(hash)
+	mac.Write([]byte(namespace + "/" + name))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// isEncryptedCopy returns true if "secret" is a copy written encrypted.
+func isEncryptedCopy(secret *corev1.Secret) bool {
+	_, ok := secret.Annotations[CredentialFingerprintAnnotation]
+	return ok && envelope.IsSealed(secret.Data)
+}
+
+// encryptedCopyMatches returns true if the encrypted copy "secret" holds the
+// credential that hashes to "hash", according to its fingerprint under "key".
+func encryptedCopyMatches(secret *corev1.Secret, key, hash []byte) bool {
+	if key == nil || !isEncryptedCopy(secret) {
+		return false
+	}
+	expected := copyFingerprint(key, hash, secret.Namespace, secret.Name)
+	return hmac.Equal([]byte(expected), []byte(secret.Annotations[CredentialFingerprintAnnotation]))
+}
+
+// writeCopy writes "secretData", which hashes to "currentHash", to the copy
+// "childSecret" of "provider" as last read. Copies in namespaces with an encryption key
+// are replaced by their envelope and fingerprint, with an update rather than
+// an apply so that no plaintext key owned by another field manager remains.
+// Copies that were encrypted are replaced by the plaintext the same way when
+// their namespace no longer has a key.
+func (r *ProviderCredentialSecretReconciler) writeCopy(ctx context.Context, provider, childSecret *corev1.Secret, currentHash []byte, secretData map[string][]byte) error {
+	key, err := r.encryptionKey(ctx, childSecret.Namespace)
+	if err != nil {
+		return err
+	}
+
+	if key == nil && !isEncryptedCopy(childSecret) {
+		child := apply.NewSecret(childSecret.Namespace, childSecret.Name, childSecret.ResourceVersion)
+		child.Data = secretData
+		return apply.Secret(ctx, r.Client, FieldManager, child)
+	}
+
+	updated := childSecret.DeepCopy()
+	if updated.Annotations == nil {
+		updated.Annotations = map[string]string{}
+	}
+	if key != nil {
+		fingerprintKey, err := r.fingerprintKey(ctx, provider, true)
+		if err != nil {
+			return err
+		}
+		if updated.Data, err = envelope.Seal(key, childSecret.Namespace, childSecret.Name, secretData); err != nil {
+			return err
+		}
+		updated.Annotations[CredentialFingerprintAnnotation] = copyFingerprint(fingerprintKey, currentHash, childSecret.Namespace, childSecret.Name)
+	} else {
+		updated.Data = secretData
+		delete(updated.Annotations, CredentialFingerprintAnnotation)
+	}
+	return r.Update(ctx, updated, client.FieldOwner(FieldManager))
+}
@@ -0,0 +1,172 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package providercredential
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stolostron/provider-credential-controller/pkg/config"
+	"github.com/stolostron/provider-credential-controller/pkg/envelope"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	clientfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newEncryptionKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.Nil(t, err)
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestReconcileChildSecretsEncrypted(t *testing.T) {
+
+	secretKey, secretPEM := newEncryptionKey(t)
+	namespaceKey, namespacePEM := newEncryptionKey(t)
+
+	// cluster1 publishes its key in the known secret, cluster2 on its namespace
+	keySecret := corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{Namespace: ClusterNamespace1, Name: EncryptionKeySecretName},
+		Data:       map[string][]byte{EncryptionKeySecretKey: secretPEM},
+	}
+	namespace := corev1.Namespace{ObjectMeta: v1.ObjectMeta{
+		Name:        ClusterNamespace2,
+		Annotations: map[string]string{EncryptionKeyAnnotation: string(namespacePEM)},
+	}}
+
+	cps := getCPSecret()
+	cps.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "ans"}
+	originalHash, err := CredentialDataHash(cps, config.Default())
+	assert.Nil(t, err)
+	cps.Annotations = map[string]string{CredentialHash: originalHash}
+
+	copies := []corev1.Secret{}
+	for _, namespace := range []string{ClusterNamespace1, ClusterNamespace2} {
+		childSecret := getCPSecret()
+		childSecret.Name = "ansible"
+		childSecret.Namespace = namespace
+		childSecret.Labels = map[string]string{
+			CopiedFromNamespaceLabel: CPSNamespace,
+			CopiedFromNameLabel:      CPSName,
+		}
+		copies = append(copies, childSecret)
+	}
+
+	cpsr := GetProviderCredentialSecretReconciler()
+	cpsr.Client = clientfake.NewFakeClient(&cps, &copies[0], &copies[1], &keySecret, &namespace,
+		newManagedCluster(ClusterNamespace1, true), newManagedCluster(ClusterNamespace2, true))
+	cpsr.APIReader = cpsr.Client
+
+	fingerprintKeySecret := corev1.Secret{}
+	fingerprintKeyRef := client.ObjectKey{Namespace: CPSNamespace, Name: fingerprintKeyName(CPSName)}
+	rotate := func(token string) {
+		cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+		cps.Data[TOKEN] = []byte(token)
+		assert.Nil(t, cpsr.Update(context.Background(), &cps))
+
+		_, err := cpsr.Reconcile(context.Background(), getRequest())
+		assert.Nil(t, err)
+	}
+
+	keys := map[string]*rsa.PrivateKey{ClusterNamespace1: secretKey, ClusterNamespace2: namespaceKey}
+	expectEncrypted := func(token string) {
+		for i := range copies {
+			var child corev1.Secret
+			cpsr.Get(context.Background(), client.ObjectKeyFromObject(&copies[i]), &child)
+			assert.Equal(t, []string{envelope.DataKey}, keysOf(child.Data), "No plaintext key remains in %s", child.Namespace)
+
+			opened, err := envelope.Open(keys[child.Namespace], child.Namespace, child.Name, child.Data)
+			assert.Nil(t, err, "Nil, when opened by the consumer of %s", child.Namespace)
+			assert.Equal(t, map[string][]byte{HOST: []byte(userValue), TOKEN: []byte(token)}, opened)
+
+			cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+			assert.Nil(t, cpsr.Get(context.Background(), fingerprintKeyRef, &fingerprintKeySecret), "The fingerprint key is created")
+			fingerprintKey := fingerprintKeySecret.Data[FingerprintKeySecretKey]
+			assert.True(t, encryptedCopyMatches(&child, fingerprintKey, decodeHash(t, cps.Annotations[CredentialHash])),
+				"The fingerprint of %s matches the hash of the plaintext", child.Namespace)
+			assert.NotEqual(t, copyFingerprint(decodeHash(t, cps.Annotations[CredentialHash]), decodeHash(t, cps.Annotations[CredentialHash]), child.Namespace, child.Name),
+				child.Annotations[CredentialFingerprintAnnotation], "The fingerprint is not keyed by the published hash")
+		}
+	}
+
+	// Plaintext copies are encrypted by the first rotation
+	rotate("first")
+	expectEncrypted("first")
+
+	// Encrypted copies are trusted through their fingerprint
+	rotate("second")
+	expectEncrypted("second")
+
+	// A copy whose fingerprint was tampered with is left alone
+	cpsr.Get(context.Background(), client.ObjectKeyFromObject(&copies[0]), &copies[0])
+	copies[0].Annotations[CredentialFingerprintAnnotation] = copyFingerprint([]byte("guess"), decodeHash(t, cps.Annotations[CredentialHash]), ClusterNamespace1, "ansible")
+	assert.Nil(t, cpsr.Update(context.Background(), &copies[0]))
+	tampered := copies[0].Data[envelope.DataKey]
+
+	rotate("third")
+	var child corev1.Secret
+	cpsr.Get(context.Background(), client.ObjectKeyFromObject(&copies[0]), &child)
+	assert.Equal(t, tampered, child.Data[envelope.DataKey], "The tampered copy is not updated")
+	cpsr.Get(context.Background(), client.ObjectKeyFromObject(&copies[1]), &child)
+	opened, err := envelope.Open(namespaceKey, ClusterNamespace2, "ansible", child.Data)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("third"), opened[TOKEN])
+}
+
+func TestReconcileChildSecretsInvalidEncryptionKey(t *testing.T) {
+
+	keySecret := corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{Namespace: ClusterNamespace1, Name: EncryptionKeySecretName},
+		Data:       map[string][]byte{EncryptionKeySecretKey: []byte("not a key")},
+	}
+
+	cps := getCPSecret()
+	cps.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "ans"}
+	originalHash, err := CredentialDataHash(cps, config.Default())
+	assert.Nil(t, err)
+	cps.Annotations = map[string]string{CredentialHash: originalHash}
+
+	childSecret := getCPSecret()
+	childSecret.Name = "ansible"
+	childSecret.Namespace = ClusterNamespace1
+	childSecret.Labels = map[string]string{
+		CopiedFromNamespaceLabel: CPSNamespace,
+		CopiedFromNameLabel:      CPSName,
+	}
+
+	cpsr := GetProviderCredentialSecretReconciler()
+	cpsr.Client = clientfake.NewFakeClient(&cps, &childSecret)
+	cps.Data[TOKEN] = []byte("rotated")
+	assert.Nil(t, cpsr.Update(context.Background(), &cps))
+	cpsr.APIReader = clientfake.NewFakeClient(&cps, &childSecret, &keySecret, newManagedCluster(ClusterNamespace1, true))
+
+	_, err = cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err)
+
+	var child corev1.Secret
+	cpsr.Get(context.Background(), client.ObjectKeyFromObject(&childSecret), &child)
+	assert.Equal(t, []byte(tokenValue), child.Data[TOKEN], "The credential is not written in plaintext")
+}
+
+func keysOf(data map[string][]byte) []string {
+	keys := []string{}
+	for key := range data {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func decodeHash(t *testing.T, value string) []byte {
+	hash, err := base64.StdEncoding.DecodeString(value)
+	assert.Nil(t, err)
+	return hash
+}
@@ -0,0 +1,277 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package providercredential
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stolostron/provider-credential-controller/pkg/apply"
+	"github.com/stolostron/provider-credential-controller/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// LastRotatedAnnotation is set on a Provider secret to the RFC 3339 time its
+// CredentialHash last changed.
+const LastRotatedAnnotation = "cluster.open-cluster-management.io/credential-last-rotated"
+
+// AzureClientSecretExpiryAnnotation holds, on an Azure Provider secret, the
+// RFC 3339 expiry of its service principal's client secret, which Azure
+// does not let the controller read.
+const AzureClientSecretExpiryAnnotation = "cluster.open-cluster-management.io/azure-client-secret-expiry"
+
+// GCPKeyCreatedAnnotation holds, on a GCP Provider secret, the RFC 3339
+// creation time of its service account key, as listed by
+// "gcloud iam service-accounts keys list". It is the credential's age.
+const GCPKeyCreatedAnnotation = "cluster.open-cluster-management.io/gcp-key-created"
+
+// Warning Event reasons recorded on Provider secrets that should be rotated.
+const (
+	CredentialTooOldEventReason   = "CredentialTooOld"
+	CredentialExpiringEventReason = "CredentialExpiring"
+)
+
+// RotationWarnedAnnotation lists, comma separated, the thresholds a Provider
+// secret's credential has crossed and been warned about: maxAge, warnBefore,
+// expired or unknownExpiry. Each is warned once, and again only after the
+// credential has been rotated back under it.
+const RotationWarnedAnnotation = "cluster.open-cluster-management.io/rotation-warned"
+
+// ExpiryFieldManager owns the RotationWarnedAnnotation, which is applied
+// apart from the CredentialHash annotation.
+const ExpiryFieldManager = "provider-credential-controller-expiry"
+
+// Thresholds recorded in the RotationWarnedAnnotation.
+const (
+	thresholdMaxAge        = "maxAge"
+	thresholdWarnBefore    = "warnBefore"
+	thresholdExpired       = "expired"
+	thresholdUnknownExpiry = "unknownExpiry"
+)
+
+// maxReminderInterval is how long the controller waits at most before
+// checking a credential's age again.
+const maxReminderInterval = 24 * time.Hour
+
+// now is replaced by tests.
+var now = time.Now
+
+var credentialAgeDesc = prometheus.NewDesc(
+	"provider_credential_age_seconds",
+	"Time since the Provider secret's credential last changed.",
+	[]string{"namespace", "name", "type"}, nil,
+)
+
+var credentialExpiryDesc = prometheus.NewDesc(
+	"provider_credential_expiry_timestamp_seconds",
+	"Known expiry of the Provider secret's credential, by source: ovirt_ca_bundle or the Azure client secret annotation.",
+	[]string{"namespace", "name", "type", "source"}, nil,
+)
+
+// credentialLastChanged returns when the credential of "secret" last
+// changed: the GCP key creation time when known, else the time the
+// controller saw its CredentialHash change, else the secret's creation.
+func credentialLastChanged(secret *corev1.Secret) time.Time {
+	for _, annotation := range []string{GCPKeyCreatedAnnotation, LastRotatedAnnotation} {
+		if annotation == GCPKeyCreatedAnnotation && secret.Labels[ProviderTypeLabel] != "gcp" {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, secret.Annotations[annotation]); err == nil {
+			return t
+		}
+	}
+	return secret.CreationTimestamp.Time
+}
+
+// credentialExpiry returns the known expiry of the credential of "secret"
+// and where it comes from. "found" is false when no expiry is known.
+func credentialExpiry(secret *corev1.Secret) (expiry time.Time, source string, found bool, err error) {
+	switch secret.Labels[ProviderTypeLabel] {
+	case "redhatvirtualization":
+		rest := secret.Data["ovirt_ca_bundle"]
+		for {
+			var block *pem.Block
+			if block, rest = pem.Decode(rest); block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return time.Time{}, "", false, fmt.Errorf("ovirt_ca_bundle: %w", err)
+			}
+			if !found || cert.NotAfter.Before(expiry) {
+				expiry, found = cert.NotAfter, true
+			}
+		}
+		return expiry, "ovirt_ca_bundle", found, nil
+
+	case "azr":
+		value, ok := secret.Annotations[AzureClientSecretExpiryAnnotation]
+		if !ok {
+			return time.Time{}, "", false, nil
+		}
+		expiry, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, "", false, fmt.Errorf("%s: %w", AzureClientSecretExpiryAnnotation, err)
+		}
+		return expiry, AzureClientSecretExpiryAnnotation, true, nil
+	}
+	return time.Time{}, "", false, nil
+}
+
+// remindRotation records a Warning Event on "secret" when its credential
+// crosses the configured maximum age or gets close to its expiry, once per
+// threshold as tracked by the RotationWarnedAnnotation. It returns when to
+// check again, at most maxReminderInterval from now, or 0 when nothing is
+// tracked.
+func (r *ProviderCredentialSecretReconciler) remindRotation(ctx context.Context, log logr.Logger, secret *corev1.Secret, cfg *config.Configuration) time.Duration {
+	current := now()
+	var next time.Duration
+
+	warned := map[string]bool{}
+	for _, threshold := range strings.Split(secret.Annotations[RotationWarnedAnnotation], ",") {
+		warned[threshold] = true
+	}
+	crossed := []string{}
+	cross := func(threshold, reason, msg string) {
+		crossed = append(crossed, threshold)
+		if !warned[threshold] {
+			r.warn(secret, reason, msg)
+		}
+	}
+
+	if maxAge := cfg.Expiry.MaxAge.Duration; maxAge > 0 {
+		age := current.Sub(credentialLastChanged(secret))
+		if age >= maxAge {
+			cross(thresholdMaxAge, CredentialTooOldEventReason, fmt.Sprintf("credential was last rotated %s ago, more than the %s allowed",
+				age.Round(time.Hour), maxAge))
+			next = sooner(next, maxReminderInterval)
+		} else {
+			next = sooner(next, maxAge-age)
+		}
+	}
+
+	expiry, source, found, err := credentialExpiry(secret)
+	switch {
+	case err != nil:
+		log.Error(err, "Failed to read the credential expiry of "+secret.Namespace+"/"+secret.Name)
+		cross(thresholdUnknownExpiry, CredentialExpiringEventReason, "credential expiry is unknown: "+err.Error())
+	case found:
+		remaining := expiry.Sub(current)
+		switch {
+		case remaining <= 0:
+			cross(thresholdExpired, CredentialExpiringEventReason, fmt.Sprintf("%s expired on %s", source, expiry.Format(time.RFC3339)))
+			next = sooner(next, maxReminderInterval)
+		case remaining <= cfg.Expiry.WarnBefore.Duration:
+			cross(thresholdWarnBefore, CredentialExpiringEventReason, fmt.Sprintf("%s expires on %s, in %s", source,
+				expiry.Format(time.RFC3339), remaining.Round(time.Hour)))
+			next = sooner(next, remaining)
+		default:
+			next = sooner(next, remaining-cfg.Expiry.WarnBefore.Duration)
+		}
+	}
+
+	// The annotation is dropped by the apply once no threshold is crossed
+	sort.Strings(crossed)
+	if value := strings.Join(crossed, ","); value != secret.Annotations[RotationWarnedAnnotation] {
+		record := apply.NewSecret(secret.Namespace, secret.Name, "")
+		if value != "" {
+			record.Annotations = map[string]string{RotationWarnedAnnotation: value}
+		}
+		if err := apply.Secret(ctx, r.Client, ExpiryFieldManager, record); err != nil {
+			log.Error(err, "Failed to record the rotation reminders of "+secret.Namespace+"/"+secret.Name)
+		}
+	}
+	return next
+}
+
+// sooner returns the shortest of the non-zero "current" and "d", capped at
+// maxReminderInterval.
+func sooner(current, d time.Duration) time.Duration {
+	if d > maxReminderInterval {
+		d = maxReminderInterval
+	}
+	if current == 0 || d < current {
+		return d
+	}
+	return current
+}
+
+// requeueForReminder checks the credential age of "secret" and shortens the
+// RequeueAfter of "result" to the next reminder.
+func (r *ProviderCredentialSecretReconciler) requeueForReminder(ctx context.Context, log logr.Logger, secret *corev1.Secret, cfg *config.Configuration, result ctrl.Result) ctrl.Result {
+	if next := r.remindRotation(ctx, log, secret, cfg); next > 0 {
+		result.RequeueAfter = sooner(result.RequeueAfter, next)
+	}
+	return result
+}
+
+func (r *ProviderCredentialSecretReconciler) warn(secret *corev1.Secret, reason, msg string) {
+	if r.Recorder != nil {
+		r.Recorder.Event(secret, corev1.EventTypeWarning, reason, msg)
+	}
+}
+
+// credentialCollector reports the age and known expiry of the Provider
+// secrets held in the controller's cache when scraped.
+type credentialCollector struct {
+	reader client.Reader
+	config *config.Store
+}
+
+func (c *credentialCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- credentialAgeDesc
+	ch <- credentialExpiryDesc
+}
+
+// Collect reports nothing until the cache can be listed.
+func (c *credentialCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	secrets := &corev1.SecretList{}
+	if err := c.reader.List(ctx, secrets, client.HasLabels{CredentialLabel, ProviderTypeLabel}); err != nil {
+		return
+	}
+
+	cfg := c.config.Get()
+	current := now()
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		credType := secret.Labels[ProviderTypeLabel]
+		if !cfg.SupportsProviderType(credType) {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(credentialAgeDesc, prometheus.GaugeValue,
+			current.Sub(credentialLastChanged(secret)).Seconds(), secret.Namespace, secret.Name, credType)
+
+		if expiry, source, found, err := credentialExpiry(secret); err == nil && found {
+			ch <- prometheus.MustNewConstMetric(credentialExpiryDesc, prometheus.GaugeValue,
+				float64(expiry.Unix()), secret.Namespace, secret.Name, credType, source)
+		}
+	}
+}
+
+// registerCredentialCollector exposes the Provider secrets in "reader" on
+// the manager's metrics endpoint.
+func registerCredentialCollector(reader client.Reader, store *config.Store) error {
+	err := metrics.Registry.Register(&credentialCollector{reader: reader, config: store})
+	if errors.As(err, &prometheus.AlreadyRegisteredError{}) {
+		return nil
+	}
+	return err
+}
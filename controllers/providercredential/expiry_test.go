@@ -0,0 +1,281 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package providercredential
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stolostron/provider-credential-controller/pkg/config"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	clientfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var testNow = time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+func withNow(t *testing.T, current time.Time) {
+	now = func() time.Time { return current }
+	t.Cleanup(func() { now = time.Now })
+}
+
+// newCertificate returns a PEM encoded self-signed certificate valid until
+// "notAfter".
+func newCertificate(t *testing.T, notAfter time.Time) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    notAfter.AddDate(-1, 0, 0),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func drainEvents(recorder *record.FakeRecorder) []string {
+	events := []string{}
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	return events
+}
+
+func TestCredentialExpiry(t *testing.T) {
+
+	first := testNow.AddDate(0, 2, 0).Truncate(time.Second)
+	rhv := getCPSecretWithKeys(map[string][]byte{
+		"ovirt_ca_bundle": []byte(newCertificate(t, first.AddDate(1, 0, 0)) + newCertificate(t, first)),
+	})
+	rhv.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "redhatvirtualization"}
+
+	expiry, source, found, err := credentialExpiry(&rhv)
+	assert.Nil(t, err, "Nil, when the CA bundle holds certificates")
+	assert.True(t, found, "The first certificate to expire is the expiry")
+	assert.Equal(t, "ovirt_ca_bundle", source)
+	assert.True(t, first.Equal(expiry), "expected %v, got %v", first, expiry)
+
+	rhv.Data["ovirt_ca_bundle"] = []byte("-----BEGIN CERTIFICATE-----\ntest\n-----END CERTIFICATE-----")
+	_, _, _, err = credentialExpiry(&rhv)
+	assert.NotNil(t, err, "Not nil, when a certificate of the CA bundle is invalid")
+
+	azr := getCopiedSecretForProvider("azr")
+	azr.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "azr"}
+	_, _, found, err = credentialExpiry(&azr)
+	assert.Nil(t, err)
+	assert.False(t, found, "No expiry is known without the annotation")
+
+	azr.Annotations = map[string]string{AzureClientSecretExpiryAnnotation: "2024-05-01T00:00:00Z"}
+	expiry, source, found, err = credentialExpiry(&azr)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, AzureClientSecretExpiryAnnotation, source)
+	assert.Equal(t, time.Date(2024, time.May, 1, 0, 0, 0, 0, time.UTC), expiry)
+
+	azr.Annotations[AzureClientSecretExpiryAnnotation] = "next month"
+	_, _, _, err = credentialExpiry(&azr)
+	assert.NotNil(t, err, "Not nil, when the annotation is not RFC 3339")
+}
+
+func TestCredentialLastChanged(t *testing.T) {
+
+	gcp := getCopiedSecretForProvider("gcp")
+	gcp.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "gcp"}
+	gcp.CreationTimestamp = v1.NewTime(testNow.AddDate(-1, 0, 0))
+	assert.True(t, gcp.CreationTimestamp.Time.Equal(credentialLastChanged(&gcp)), "The age defaults to the creation of the secret")
+
+	gcp.Annotations = map[string]string{LastRotatedAnnotation: "2024-01-01T00:00:00Z"}
+	assert.Equal(t, time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC), credentialLastChanged(&gcp))
+
+	// The creation of the key is what ages, whatever the secret holds
+	gcp.Annotations[GCPKeyCreatedAnnotation] = "2023-06-01T00:00:00Z"
+	assert.Equal(t, time.Date(2023, time.June, 1, 0, 0, 0, 0, time.UTC), credentialLastChanged(&gcp))
+
+	gcp.Labels[ProviderTypeLabel] = "aws"
+	assert.Equal(t, time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC), credentialLastChanged(&gcp),
+		"Only GCP secrets hold the creation time of their key")
+}
+
+func TestReconcileLastRotated(t *testing.T) {
+
+	withNow(t, testNow)
+
+	cps := getCPSecret()
+	cps.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "ans"}
+	cps.Annotations = map[string]string{LastRotatedAnnotation: "2024-01-01T00:00:00Z"}
+	childSecret := getCPSecret()
+	childSecret.Name = "child"
+	childSecret.Namespace = ClusterNamespace1
+	childSecret.Labels = map[string]string{
+		CopiedFromNamespaceLabel: CPSNamespace,
+		CopiedFromNameLabel:      CPSName,
+	}
+
+	cpsr := GetProviderCredentialSecretReconciler()
+	cpsr.Client = clientfake.NewFakeClient(&cps, &childSecret)
+
+	// The first hash keeps the rotation time already recorded
+	_, err := cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err)
+	cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+	assert.Equal(t, "2024-01-01T00:00:00Z", cps.Annotations[LastRotatedAnnotation])
+
+	// A rotation records when it was seen
+	cps.Data[TOKEN] = []byte("rotated")
+	assert.Nil(t, cpsr.Update(context.Background(), &cps))
+	cpsr.APIReader = clientfake.NewFakeClient(&cps, &childSecret, newManagedCluster(ClusterNamespace1, true))
+
+	_, err = cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err)
+	cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+	assert.Equal(t, testNow.Format(time.RFC3339), cps.Annotations[LastRotatedAnnotation])
+}
+
+func TestReconcileLastRotatedWithoutCopies(t *testing.T) {
+
+	withNow(t, testNow)
+
+	cps := getCPSecret()
+	cps.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "ans"}
+	cps.Annotations = map[string]string{LastRotatedAnnotation: "2024-01-01T00:00:00Z"}
+
+	cpsr := GetProviderCredentialSecretReconciler()
+	cpsr.Client = clientfake.NewFakeClient(&cps)
+	cpsr.APIReader = cpsr.Client
+
+	_, err := cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err)
+	cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+	initialHash := cps.Annotations[CredentialHash]
+
+	// A rotation is recorded even though there is no copy to update
+	cps.Data[TOKEN] = []byte("rotated")
+	assert.Nil(t, cpsr.Update(context.Background(), &cps))
+
+	_, err = cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err)
+	cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+	assert.NotEqual(t, initialHash, cps.Annotations[CredentialHash], "The hash of the rotated credential is recorded")
+	expected, err := CredentialDataHash(cps, config.Default())
+	assert.Nil(t, err)
+	assert.Equal(t, expected, cps.Annotations[CredentialHash])
+	assert.Equal(t, testNow.Format(time.RFC3339), cps.Annotations[LastRotatedAnnotation])
+}
+
+func TestReconcileRemindRotation(t *testing.T) {
+
+	withNow(t, testNow)
+
+	cfg := config.Default()
+	cfg.Expiry.MaxAge = v1.Duration{Duration: 90 * 24 * time.Hour}
+
+	azr := getCopiedSecretForProvider("azr")
+	azr.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "azr"}
+	hash, err := CredentialDataHash(azr, cfg)
+	assert.Nil(t, err)
+	azr.Annotations = map[string]string{
+		CredentialHash:        hash,
+		LastRotatedAnnotation: testNow.AddDate(0, 0, -100).Format(time.RFC3339),
+		// Within the 30 days warned by default
+		AzureClientSecretExpiryAnnotation: testNow.AddDate(0, 0, 10).Format(time.RFC3339),
+	}
+
+	cpsr := GetProviderCredentialSecretReconciler()
+	cpsr.Client = clientfake.NewFakeClient(&azr)
+	cpsr.Config = config.NewStaticStore(cfg)
+
+	result, err := cpsr.Reconcile(context.Background(), getRequestWithName(azr.Name))
+	assert.Nil(t, err)
+	assert.Equal(t, maxReminderInterval, result.RequeueAfter, "Reminders are repeated daily")
+
+	events := drainEvents(cpsr.Recorder.(*record.FakeRecorder))
+	assert.Len(t, events, 2)
+	assert.True(t, strings.HasPrefix(events[0], corev1.EventTypeWarning+" "+CredentialTooOldEventReason), events[0])
+	assert.True(t, strings.HasPrefix(events[1], corev1.EventTypeWarning+" "+CredentialExpiringEventReason), events[1])
+
+	// The warnings are recorded, and not repeated on the next reconcile
+	assert.Nil(t, cpsr.Client.Get(context.Background(), getRequestWithName(azr.Name).NamespacedName, &azr))
+	assert.Equal(t, "maxAge,warnBefore", azr.Annotations[RotationWarnedAnnotation])
+
+	_, err = cpsr.Reconcile(context.Background(), getRequestWithName(azr.Name))
+	assert.Nil(t, err)
+	assert.Empty(t, drainEvents(cpsr.Recorder.(*record.FakeRecorder)), "A threshold is warned once")
+
+	// Crossing the next threshold is warned
+	withNow(t, testNow.AddDate(0, 0, 11))
+	_, err = cpsr.Reconcile(context.Background(), getRequestWithName(azr.Name))
+	assert.Nil(t, err)
+	events = drainEvents(cpsr.Recorder.(*record.FakeRecorder))
+	assert.Len(t, events, 1)
+	assert.Contains(t, events[0], "expired on")
+	withNow(t, testNow)
+	delete(azr.Annotations, RotationWarnedAnnotation)
+
+	// A recent credential is checked again when it reaches the maximum age
+	azr.Annotations[LastRotatedAnnotation] = testNow.Add(-90*24*time.Hour + time.Hour).Format(time.RFC3339)
+	azr.Annotations[AzureClientSecretExpiryAnnotation] = testNow.AddDate(1, 0, 0).Format(time.RFC3339)
+	cpsr.Client = clientfake.NewFakeClient(&azr)
+
+	result, err = cpsr.Reconcile(context.Background(), getRequestWithName(azr.Name))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, result.RequeueAfter)
+	assert.Empty(t, drainEvents(cpsr.Recorder.(*record.FakeRecorder)))
+
+	// Nothing is tracked when no maximum age is configured and no expiry is known
+	delete(azr.Annotations, AzureClientSecretExpiryAnnotation)
+	cpsr.Client = clientfake.NewFakeClient(&azr)
+	cpsr.Config = config.NewStaticStore(config.Default())
+
+	result, err = cpsr.Reconcile(context.Background(), getRequestWithName(azr.Name))
+	assert.Nil(t, err)
+	assert.Zero(t, result.RequeueAfter)
+}
+
+func TestCredentialCollector(t *testing.T) {
+
+	withNow(t, testNow)
+
+	aws := getCopiedSecretForProvider("aws")
+	aws.Name = "aws"
+	aws.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "aws"}
+	aws.Annotations = map[string]string{LastRotatedAnnotation: testNow.Add(-time.Hour).Format(time.RFC3339)}
+
+	azr := getCopiedSecretForProvider("azr")
+	azr.Name = "azr"
+	azr.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "azr"}
+	azr.Annotations = map[string]string{
+		LastRotatedAnnotation:             testNow.Add(-2 * time.Hour).Format(time.RFC3339),
+		AzureClientSecretExpiryAnnotation: "2024-05-01T00:00:00Z",
+	}
+
+	unsupported := getCPSecret()
+	unsupported.Name = "bm"
+	unsupported.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "bm"}
+
+	collector := &credentialCollector{reader: clientfake.NewFakeClient(&aws, &azr, &unsupported)}
+
+	expected := `
+# HELP provider_credential_age_seconds Time since the Provider secret's credential last changed.
+# TYPE provider_credential_age_seconds gauge
+provider_credential_age_seconds{name="aws",namespace="providers",type="aws"} 3600
+provider_credential_age_seconds{name="azr",namespace="providers",type="azr"} 7200
+# HELP provider_credential_expiry_timestamp_seconds Known expiry of the Provider secret's credential, by source: ovirt_ca_bundle or the Azure client secret annotation.
+# TYPE provider_credential_expiry_timestamp_seconds gauge
+provider_credential_expiry_timestamp_seconds{name="azr",namespace="providers",source="cluster.open-cluster-management.io/azure-client-secret-expiry",type="azr"} 1.7145216e+09
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
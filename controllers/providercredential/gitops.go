@@ -0,0 +1,67 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package providercredential
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/stolostron/provider-credential-controller/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// SkipCredentialSyncAnnotation, set to "true" on a copy, marks it as managed
+// elsewhere, for example rendered by a GitOps tool from a sealed secret. The
+// controller never writes to such copies.
+const SkipCredentialSyncAnnotation = "cluster.open-cluster-management.io/skip-credential-sync"
+
+// GitOpsCopiesAnnotation is set on a Provider secret to the JSON list of the
+// GitOps managed copies that were not updated by the last rotation. Their Git
+// source needs the rotated credential.
+const GitOpsCopiesAnnotation = "cluster.open-cluster-management.io/gitops-managed-copies"
+
+// GitOpsManagedCopyEventReason is the Warning Event reason recorded on a copy
+// that was not updated because a GitOps tool owns it.
+const GitOpsManagedCopyEventReason = "GitOpsManagedCopy"
+
+// GitOpsCopy is an entry of the GitOpsCopiesAnnotation.
+type GitOpsCopy struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	ManagedBy string `json:"managedBy"`
+}
+
+// GitOpsOwner returns why "secret" is owned by a GitOps tool according to
+// "cfg": its skip annotation, a GitOps field manager in its managedFields or
+// a GitOps owner reference. It returns "" when the controller may write to it.
+func GitOpsOwner(secret *corev1.Secret, cfg *config.Configuration) string {
+	if secret.Annotations[SkipCredentialSyncAnnotation] == "true" {
+		return "annotation " + SkipCredentialSyncAnnotation
+	}
+	for _, entry := range secret.ManagedFields {
+		if cfg.IsGitOpsFieldManager(entry.Manager) {
+			return "field manager " + entry.Manager
+		}
+	}
+	for _, owner := range secret.OwnerReferences {
+		gv, err := schema.ParseGroupVersion(owner.APIVersion)
+		if err == nil && cfg.IsGitOpsOwnerAPIGroup(gv.Group) {
+			return "owner " + owner.Kind + "." + gv.Group + "/" + owner.Name
+		}
+	}
+	return ""
+}
+
+// gitOpsCopiesAnnotation returns the GitOpsCopiesAnnotation value listing
+// "copies", sorted by namespace and name.
+func gitOpsCopiesAnnotation(copies []GitOpsCopy) (string, error) {
+	sort.Slice(copies, func(i, j int) bool {
+		if copies[i].Namespace != copies[j].Namespace {
+			return copies[i].Namespace < copies[j].Namespace
+		}
+		return copies[i].Name < copies[j].Name
+	})
+	value, err := json.Marshal(copies)
+	return string(value), err
+}
@@ -0,0 +1,157 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package providercredential
+
+import (
+	"context"
+	"encoding/base64"
+
+	"github.com/go-logr/logr"
+	"github.com/stolostron/provider-credential-controller/pkg/apply"
+	"github.com/stolostron/provider-credential-controller/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DiscoverHiveReferencesAnnotation, set to "true" on a Provider secret, opts
+// it in to adopting the secrets that Hive ClusterDeployments in Joined
+// ManagedCluster namespaces reference by name, when they hold the Provider
+// secret's credentials but lack the copiedFrom* labels.
+const DiscoverHiveReferencesAnnotation = "cluster.open-cluster-management.io/discover-hive-references"
+
+// HiveReferenceAdoptedEventReason is the Normal Event reason recorded on a
+// secret referenced by Hive when it is adopted as a copy.
+const HiveReferenceAdoptedEventReason = "HiveReferenceAdopted"
+
+// ClusterDeploymentGVK is the Hive resource whose spec.platform.<platform>.credentialsSecretRef
+// may name a secret derived from a Provider secret. Like ManagedClusterGVK,
+// it is read via unstructured.Unstructured to avoid depending on the Hive API.
+// MachinePools carry no credentials reference and use their ClusterDeployment's.
+var ClusterDeploymentGVK = schema.GroupVersionKind{Group: "hive.openshift.io", Version: "v1", Kind: "ClusterDeployment"}
+
+// hiveCredentialsSecretRefs returns the secrets referenced by
+// spec.platform.<platform>.credentialsSecretRef of the ClusterDeployments
+// listed with "opts". A Hive API that is not installed yields no secrets.
+func hiveCredentialsSecretRefs(ctx context.Context, reader client.Reader, opts ...client.ListOption) ([]types.NamespacedName, error) {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(ClusterDeploymentGVK.GroupVersion().WithKind(ClusterDeploymentGVK.Kind + "List"))
+
+	if err := reader.List(ctx, list, opts...); err != nil {
+		if meta.IsNoMatchError(err) || k8serrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	refs := []types.NamespacedName{}
+	for i := range list.Items {
+		platforms, _, _ := unstructured.NestedMap(list.Items[i].Object, "spec", "platform")
+		for platform := range platforms {
+			name, _, _ := unstructured.NestedString(platforms, platform, "credentialsSecretRef", "name")
+			if name != "" {
+				refs = append(refs, types.NamespacedName{Namespace: list.Items[i].GetNamespace(), Name: name})
+			}
+		}
+	}
+	return refs, nil
+}
+
+// listHiveReferences returns the secrets referenced by ClusterDeployments in
+// "namespaces". Like listChildSecrets, it lists cluster-wide unless the
+// reconciler is namespace-scoped.
+func (r *ProviderCredentialSecretReconciler) listHiveReferences(ctx context.Context, namespaces []string) ([]types.NamespacedName, error) {
+	if !r.NamespaceScoped {
+		joined := map[string]bool{}
+		for _, namespace := range namespaces {
+			joined[namespace] = true
+		}
+
+		all, err := hiveCredentialsSecretRefs(ctx, r.APIReader)
+		if err != nil {
+			return nil, err
+		}
+		refs := []types.NamespacedName{}
+		for _, ref := range all {
+			if joined[ref.Namespace] {
+				refs = append(refs, ref)
+			}
+		}
+		return refs, nil
+	}
+
+	refs := []types.NamespacedName{}
+	seen := map[string]bool{}
+	for _, namespace := range namespaces {
+		if seen[namespace] {
+			continue
+		}
+		seen[namespace] = true
+
+		inNamespace, err := hiveCredentialsSecretRefs(ctx, r.APIReader, client.InNamespace(namespace))
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, inNamespace...)
+	}
+	return refs, nil
+}
+
+// adoptHiveReferences labels as copies of "secret" the secrets referenced by
+// ClusterDeployments in Joined ManagedCluster namespaces whose data hashes to
+// "originalHash", so the rotation under way reaches them. Secrets already
+// labelled as copies, and those owned by a GitOps tool, are left alone.
+func (r *ProviderCredentialSecretReconciler) adoptHiveReferences(ctx context.Context, log logr.Logger, secret *corev1.Secret, originalHash []byte, cfg *config.Configuration) error {
+	namespaces, err := JoinedManagedClusterNamespaces(ctx, r.APIReader)
+	if err != nil {
+		return err
+	}
+
+	refs, err := r.listHiveReferences(ctx, namespaces)
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range refs {
+		var referenced corev1.Secret
+		if err := r.APIReader.Get(ctx, ref, &referenced); err != nil {
+			if k8serrors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+
+		if _, labelled := referenced.Labels[CopiedFromNameLabel]; labelled {
+			continue
+		}
+		if GitOpsOwner(&referenced, cfg) != "" {
+			continue
+		}
+		referencedHash, err := DataHash(referenced.Data)
+		if err != nil {
+			return err
+		}
+		if referencedHash != base64.StdEncoding.EncodeToString(originalHash) {
+			continue
+		}
+
+		labelled := apply.NewSecret(ref.Namespace, ref.Name, referenced.ResourceVersion)
+		labelled.Labels = map[string]string{
+			CopiedFromNamespaceLabel: secret.Namespace,
+			CopiedFromNameLabel:      secret.Name,
+		}
+		if err := apply.Secret(ctx, r.Client, FieldManager, labelled); err != nil {
+			return err
+		}
+		log.V(0).Info("|--> Adopted secret referenced by Hive: " + ref.String())
+		if r.Recorder != nil {
+			r.Recorder.Event(&referenced, corev1.EventTypeNormal, HiveReferenceAdoptedEventReason,
+				"referenced by Hive and adopted as a copy of "+secret.Namespace+"/"+secret.Name)
+		}
+	}
+	return nil
+}
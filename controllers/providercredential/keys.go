@@ -0,0 +1,160 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package providercredential
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/stolostron/provider-credential-controller/pkg/transform"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PropagateKeysAnnotation lists, comma separated, the keys of a Provider
+// secret to propagate and hash in addition to its type's credential keys,
+// for example "pullSecret,ssh-privatekey". Each key must be optional for the
+// provider type.
+const PropagateKeysAnnotation = "cluster.open-cluster-management.io/propagate-keys"
+
+// ExcludeKeysAnnotation lists, comma separated, the keys of a Provider
+// secret never to propagate or hash. The credential keys of the provider
+// type cannot be excluded.
+const ExcludeKeysAnnotation = "cluster.open-cluster-management.io/exclude-keys"
+
+// InvalidKeysEventReason is the Warning Event reason recorded on a Provider
+// secret whose PropagateKeysAnnotation or ExcludeKeysAnnotation is invalid.
+const InvalidKeysEventReason = "InvalidKeys"
+
+// invalidKeysError reports a Provider secret whose key annotations can never
+// be honoured. Retrying does not help, so it is not reconciled until they are
+// fixed.
+type invalidKeysError struct {
+	msg string
+}
+
+func (e *invalidKeysError) Error() string {
+	return e.msg
+}
+
+// isInvalidKeys reports whether "err" was returned for a Provider secret
+// whose key annotations must be fixed.
+func isInvalidKeys(err error) bool {
+	var invalid *invalidKeysError
+	return errors.As(err, &invalid)
+}
+
+// commonOptionalKeys are the install-config keys every cloud provider
+// secret may hold.
+var commonOptionalKeys = []string{
+	"baseDomain", "pullSecret", "ssh-privatekey", "ssh-publickey",
+	"httpProxy", "httpsProxy", "noProxy", "additionalTrustBundle",
+}
+
+// optionalKeys lists, by provider type, the keys that may be added with the
+// PropagateKeysAnnotation. Ansible secrets propagate all their keys.
+var optionalKeys = map[string][]string{
+	"aws":                  commonOptionalKeys,
+	"azr":                  append([]string{"baseDomainResourceGroupName", "cloudName"}, commonOptionalKeys...),
+	"gcp":                  append([]string{"projectID"}, commonOptionalKeys...),
+	"vmw":                  append([]string{"vCenter", "cluster", "datacenter", "defaultDatastore", "vsphereFolder", "vsphereResourcePool", "cacertificate"}, commonOptionalKeys...),
+	"ost":                  append([]string{"clusterOSImage"}, commonOptionalKeys...),
+	"redhatvirtualization": append([]string{"ovirt_fqdn"}, commonOptionalKeys...),
+}
+
+// requiredKeys lists, by provider type, the credential keys that may not
+// be excluded with the ExcludeKeysAnnotation.
+var requiredKeys = map[string][]string{
+	"ans":                  {"host", "token"},
+	"aws":                  {"aws_access_key_id", "aws_secret_access_key"},
+	"azr":                  {"osServicePrincipal.json"},
+	"gcp":                  {"osServiceAccount.json"},
+	"vmw":                  {"password", "username"},
+	"ost":                  {"cloud", "clouds.yaml"},
+	"redhatvirtualization": {"ovirt-config.yaml"},
+}
+
+// renderedFromKeys lists, by provider type, the keys of the Provider secret
+// that the type's default transforms render its credential from. Templates
+// may read them, but they are not propagated.
+var renderedFromKeys = map[string][]string{
+	"redhatvirtualization": {"ovirt_url", "ovirt_username", "ovirt_password", "ovirt_ca_bundle"},
+}
+
+// keysAnnotation returns the keys listed in "annotation" of "secret".
+func keysAnnotation(secret corev1.Secret, annotation string) []string {
+	keys := []string{}
+	for _, key := range strings.Split(secret.Annotations[annotation], ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// selectedKeys validates the PropagateKeysAnnotation and ExcludeKeysAnnotation
+// of the "credType" secret "secret" and returns the keys they add and remove.
+func selectedKeys(secret corev1.Secret, credType string) ([]string, []string, error) {
+	include := keysAnnotation(secret, PropagateKeysAnnotation)
+	exclude := keysAnnotation(secret, ExcludeKeysAnnotation)
+
+	problems := []string{}
+	for _, key := range include {
+		if !containsString(optionalKeys[credType], key) {
+			problems = append(problems, fmt.Sprintf("%s: %q is not an optional key of provider type %s", PropagateKeysAnnotation, key, credType))
+		}
+	}
+	for _, key := range exclude {
+		switch {
+		case containsString(requiredKeys[credType], key):
+			problems = append(problems, fmt.Sprintf("%s: %q is a credential key of provider type %s", ExcludeKeysAnnotation, key, credType))
+		case credType != "ans" && !containsString(optionalKeys[credType], key):
+			problems = append(problems, fmt.Sprintf("%s: %q is not an optional key of provider type %s", ExcludeKeysAnnotation, key, credType))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, nil, &invalidKeysError{fmt.Sprintf("invalid keys on %s/%s: %s", secret.Namespace, secret.Name, strings.Join(problems, "; "))}
+	}
+	return include, exclude, nil
+}
+
+// checkTransformKeys refuses the transforms of "secret" whose from key is
+// neither in "propagated", the data selected for its copies, nor listed in
+// its PropagateKeysAnnotation, so a rename cannot reach the keys left out.
+func checkTransformKeys(secret corev1.Secret, transforms []transform.Transform, propagated map[string][]byte) error {
+	include := keysAnnotation(secret, PropagateKeysAnnotation)
+
+	problems := []string{}
+	for _, t := range transforms {
+		if t.From == "" {
+			continue
+		}
+		if _, ok := propagated[t.From]; !ok && !containsString(include, t.From) {
+			problems = append(problems, fmt.Sprintf("%s: %q is not a propagated key of provider type %s", t.Key, t.From, secret.Labels[ProviderTypeLabel]))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return &invalidKeysError{fmt.Sprintf("invalid transforms on %s/%s: %s", secret.Namespace, secret.Name, strings.Join(problems, "; "))}
+	}
+	return nil
+}
+
+// transformSource returns the data the transforms of the "credType" secret
+// "secret" read: "propagated", the data selected for its copies, and the keys
+// its type's credential is rendered from. Keys left out of the selection are
+// not visible to templates.
+func transformSource(secret corev1.Secret, credType string, propagated map[string][]byte) map[string][]byte {
+	source := map[string][]byte{}
+	for key, value := range propagated {
+		source[key] = value
+	}
+	for _, key := range renderedFromKeys[credType] {
+		if value, ok := secret.Data[key]; ok {
+			source[key] = value
+		}
+	}
+	return source
+}
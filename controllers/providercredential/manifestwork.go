@@ -0,0 +1,292 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package providercredential
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stolostron/provider-credential-controller/pkg/apply"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ManifestWorkClusterSelectorAnnotation opts a Provider secret in to being
+// delivered to managed clusters. Its value is a label selector, for example
+// "cloud=aws,env=prod", matched against ManagedClusters: every Joined match
+// receives a ManifestWork holding the credential, kept up to date as it is
+// rotated. An empty selector matches every Joined ManagedCluster.
+const ManifestWorkClusterSelectorAnnotation = "cluster.open-cluster-management.io/manifestwork-cluster-selector"
+
+// ManifestWorkNamespaceAnnotation sets the namespace of the secret created on
+// the managed clusters. It defaults to the Provider secret's namespace.
+const ManifestWorkNamespaceAnnotation = "cluster.open-cluster-management.io/manifestwork-namespace"
+
+// ManifestWorkStatusAnnotation is set on a Provider secret delivered by
+// ManifestWork to the JSON map of each selected cluster to the state of its
+// ManifestWork: Applied, Pending or Failed.
+const ManifestWorkStatusAnnotation = "cluster.open-cluster-management.io/manifestwork-status"
+
+// ManifestWorkHashAnnotation is set on each ManifestWork to the hash of its
+// spec. A ManifestWork whose hash is current is not applied again.
+const ManifestWorkHashAnnotation = "cluster.open-cluster-management.io/manifestwork-hash"
+
+// ManifestWorkFieldManager owns the ManifestWorks and the
+// ManifestWorkStatusAnnotation. It is separate from FieldManager so the
+// status and the CredentialHash annotation can be applied independently.
+const ManifestWorkFieldManager = "provider-credential-controller-manifestwork"
+
+// ManifestWork states reported in the ManifestWorkStatusAnnotation.
+const (
+	ManifestWorkApplied = "Applied"
+	ManifestWorkPending = "Pending"
+	ManifestWorkFailed  = "Failed"
+)
+
+// manifestWorkRequeue is how long to wait before checking again on
+// ManifestWorks that are not applied yet.
+const manifestWorkRequeue = 30 * time.Second
+
+// ManifestWorkGVK identifies the namespaced ManifestWork resource. Like
+// ManagedClusterGVK, it is handled via unstructured.Unstructured.
+var ManifestWorkGVK = schema.GroupVersionKind{
+	Group:   "work.open-cluster-management.io",
+	Version: "v1",
+	Kind:    "ManifestWork",
+}
+
+// localClusterName and localClusterLabel identify the ManagedCluster of the
+// hub itself. A ManifestWork would write the delivered secret over the
+// Provider secret there, so the hub is never selected.
+const (
+	localClusterName  = "local-cluster"
+	localClusterLabel = "local-cluster"
+)
+
+// manifestWorkName is the name of the ManifestWork delivering "secret" in
+// each cluster namespace.
+func manifestWorkName(secret *corev1.Secret) string {
+	return "provider-credential-" + secret.Namespace + "-" + secret.Name
+}
+
+// selectedClusters returns the Joined ManagedClusters matched by the
+// ManifestWorkClusterSelectorAnnotation of "secret", except the hub. The
+// second result is false when "secret" is not delivered by ManifestWork.
+func (r *ProviderCredentialSecretReconciler) selectedClusters(ctx context.Context, secret *corev1.Secret) ([]string, bool, error) {
+	value, optedIn := secret.Annotations[ManifestWorkClusterSelectorAnnotation]
+	if !optedIn {
+		return nil, false, nil
+	}
+	selector, err := labels.Parse(value)
+	if err != nil {
+		return nil, true, err
+	}
+
+	mcList := &unstructured.UnstructuredList{}
+	mcList.SetGroupVersionKind(ManagedClusterGVK.GroupVersion().WithKind(ManagedClusterGVK.Kind + "List"))
+	if err := r.APIReader.List(ctx, mcList, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, true, err
+	}
+
+	clusters := []string{}
+	for i := range mcList.Items {
+		mc := &mcList.Items[i]
+		if mc.GetName() == localClusterName || mc.GetLabels()[localClusterLabel] == "true" {
+			continue
+		}
+		if isJoined(mc) {
+			clusters = append(clusters, mc.GetName())
+		}
+	}
+	return clusters, true, nil
+}
+
+// newManifestWork returns the ManifestWork delivering "secretData", the
+// credential of "secret", to "cluster", annotated with the hash of its spec.
+func newManifestWork(secret *corev1.Secret, cluster string, secretData map[string][]byte) (*unstructured.Unstructured, error) {
+	namespace := secret.Annotations[ManifestWorkNamespaceAnnotation]
+	if namespace == "" {
+		namespace = secret.Namespace
+	}
+
+	data := map[string]interface{}{}
+	for key, value := range secretData {
+		data[key] = base64.StdEncoding.EncodeToString(value)
+	}
+
+	work := &unstructured.Unstructured{}
+	work.SetGroupVersionKind(ManifestWorkGVK)
+	work.SetNamespace(cluster)
+	work.SetName(manifestWorkName(secret))
+	work.SetLabels(map[string]string{
+		CopiedFromNamespaceLabel: secret.Namespace,
+		CopiedFromNameLabel:      secret.Name,
+	})
+	work.Object["spec"] = map[string]interface{}{
+		"workload": map[string]interface{}{
+			"manifests": []interface{}{
+				map[string]interface{}{
+					"apiVersion": "v1",
+					"kind":       "Secret",
+					"type":       string(corev1.SecretTypeOpaque),
+					"metadata": map[string]interface{}{
+						"name":      secret.Name,
+						"namespace": namespace,
+						"labels": map[string]interface{}{
+							CredentialLabel:   "",
+							ProviderTypeLabel: secret.Labels[ProviderTypeLabel],
+						},
+					},
+					"data": data,
+				},
+			},
+		},
+	}
+
+	specBytes, err := json.Marshal(work.Object["spec"])
+	if err != nil {
+		return nil, err
+	}
+	hash, err := generateHash(specBytes)
+	if err != nil {
+		return nil, err
+	}
+	work.SetAnnotations(map[string]string{ManifestWorkHashAnnotation: base64.StdEncoding.EncodeToString(hash)})
+	return work, nil
+}
+
+// manifestWorkState returns the ManifestWorkStatusAnnotation state of "work"
+// from its Applied condition, once the condition reflects the current spec.
+func manifestWorkState(work *unstructured.Unstructured) string {
+	conditions, _, _ := unstructured.NestedSlice(work.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok || condition["type"] != ManifestWorkApplied {
+			continue
+		}
+		if generation, found, _ := unstructured.NestedInt64(condition, "observedGeneration"); found && generation < work.GetGeneration() {
+			return ManifestWorkPending
+		}
+		switch condition["status"] {
+		case "True":
+			return ManifestWorkApplied
+		case "False":
+			return ManifestWorkFailed
+		}
+	}
+	return ManifestWorkPending
+}
+
+// syncManifestWorks applies a ManifestWork delivering "secretData" to each
+// cluster selected by "secret" whose ManifestWork is missing or out of date,
+// removes the ManifestWorks of clusters that are no longer selected, and
+// records their states on "secret". It returns true while a ManifestWork is
+// not applied yet.
+func (r *ProviderCredentialSecretReconciler) syncManifestWorks(ctx context.Context, log logr.Logger, secret *corev1.Secret, secretData map[string][]byte) (bool, error) {
+	clusters, optedIn, err := r.selectedClusters(ctx, secret)
+	if err != nil {
+		return false, err
+	}
+	if !optedIn {
+		if _, delivered := secret.Annotations[ManifestWorkStatusAnnotation]; !delivered {
+			return false, nil
+		}
+	}
+
+	existing, err := r.listManifestWorks(ctx, secret)
+	if err != nil {
+		return false, err
+	}
+
+	states := map[string]string{}
+	pending := false
+	for _, cluster := range clusters {
+		work, err := newManifestWork(secret, cluster, secretData)
+		if err != nil {
+			return false, err
+		}
+		if current, ok := existing[cluster]; ok &&
+			current.GetAnnotations()[ManifestWorkHashAnnotation] == work.GetAnnotations()[ManifestWorkHashAnnotation] {
+			// Already delivered, only its state is reported
+			work = current
+		} else if err := r.Patch(ctx, work, client.Apply, client.FieldOwner(ManifestWorkFieldManager), client.ForceOwnership); err != nil {
+			return false, err
+		}
+		states[cluster] = manifestWorkState(work)
+		if states[cluster] != ManifestWorkApplied {
+			pending = true
+		}
+	}
+
+	for cluster, work := range existing {
+		if _, ok := states[cluster]; ok {
+			continue
+		}
+		if err := r.Delete(ctx, work); err != nil && !k8serrors.IsNotFound(err) {
+			return false, err
+		}
+		log.V(0).Info("|--> Deleted ManifestWork of unselected cluster: " + cluster + "/" + work.GetName())
+	}
+
+	status := apply.NewSecret(secret.Namespace, secret.Name, "")
+	if optedIn {
+		value, err := json.Marshal(states)
+		if err != nil {
+			return false, err
+		}
+		status.Annotations = map[string]string{ManifestWorkStatusAnnotation: string(value)}
+	}
+	return pending, apply.Secret(ctx, r.Client, ManifestWorkFieldManager, status)
+}
+
+// listManifestWorks returns the ManifestWorks delivering "secret", by
+// cluster. They are listed in the namespaces of Joined ManagedClusters and of
+// the clusters recorded in the ManifestWorkStatusAnnotation, so the
+// ManifestWork of a cluster that has left is found too.
+func (r *ProviderCredentialSecretReconciler) listManifestWorks(ctx context.Context, secret *corev1.Secret) (map[string]*unstructured.Unstructured, error) {
+	namespaces, err := JoinedManagedClusterNamespaces(ctx, r.APIReader)
+	if err != nil {
+		return nil, err
+	}
+	recorded := map[string]string{}
+	_ = json.Unmarshal([]byte(secret.Annotations[ManifestWorkStatusAnnotation]), &recorded)
+	for cluster := range recorded {
+		namespaces = append(namespaces, cluster)
+	}
+
+	works := map[string]*unstructured.Unstructured{}
+	seen := map[string]bool{}
+	for _, namespace := range namespaces {
+		if seen[namespace] {
+			continue
+		}
+		seen[namespace] = true
+
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(ManifestWorkGVK.GroupVersion().WithKind(ManifestWorkGVK.Kind + "List"))
+		if err := r.APIReader.List(ctx, list, client.InNamespace(namespace), client.MatchingLabels{
+			CopiedFromNamespaceLabel: secret.Namespace,
+			CopiedFromNameLabel:      secret.Name,
+		}); err != nil {
+			if meta.IsNoMatchError(err) {
+				return works, nil
+			}
+			return nil, err
+		}
+
+		for i := range list.Items {
+			if list.Items[i].GetName() == manifestWorkName(secret) {
+				works[namespace] = &list.Items[i]
+			}
+		}
+	}
+	return works, nil
+}
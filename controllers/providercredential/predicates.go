@@ -0,0 +1,104 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package providercredential
+
+import (
+	"crypto/sha256"
+	"sort"
+
+	"github.com/stolostron/provider-credential-controller/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// inputAnnotations are the annotations of a Provider secret that change what
+// is propagated, where, or the reminders raised. The annotations the
+// controller writes itself, such as LastRotatedAnnotation, are not inputs.
+var inputAnnotations = []string{
+	PropagateKeysAnnotation,
+	ExcludeKeysAnnotation,
+	TransformsAnnotation,
+	CredentialSourceAnnotation,
+	ManifestWorkClusterSelectorAnnotation,
+	ManifestWorkNamespaceAnnotation,
+	DiscoverHiveReferencesAnnotation,
+	SyncClusterCuratorsAnnotation,
+	AzureClientSecretExpiryAnnotation,
+	GCPKeyCreatedAnnotation,
+}
+
+// inputFingerprint returns a digest of what a reconcile of the Provider
+// secret "secret" reads: the data propagated to its copies, as selected and
+// transformed with "cfg", its provider type and its input annotations. Keys
+// that are not propagated do not change it. A secret whose data cannot be
+// extracted is fingerprinted by the error instead.
+func inputFingerprint(secret *corev1.Secret, cfg *config.Configuration) [sha256.Size]byte {
+	hash := sha256.New()
+	write := func(value []byte) {
+		// Length prefixes keep "ab"+"c" apart from "a"+"bc"
+		var length [8]byte
+		for i, n := 0, len(value); i < 8; i, n = i+1, n>>8 {
+			length[i] = byte(n)
+		}
+		hash.Write(length[:])
+		hash.Write(value)
+	}
+
+	data, err := extractImportantData(*secret, cfg)
+	if err != nil {
+		write([]byte(err.Error()))
+	}
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		write([]byte(key))
+		write(data[key])
+	}
+
+	write([]byte(secret.Labels[ProviderTypeLabel]))
+	for _, annotation := range inputAnnotations {
+		value, ok := secret.Annotations[annotation]
+		if ok {
+			write([]byte{1})
+		} else {
+			write([]byte{0})
+		}
+		write([]byte(value))
+	}
+
+	var sum [sha256.Size]byte
+	copy(sum[:], hash.Sum(nil))
+	return sum
+}
+
+// updateNeedsReconcile returns true if the update of the Provider secret
+// "old" to "updated" can change what the controller propagates. Metadata
+// churn and the controller's own annotation writes are ignored. A missing
+// CredentialHash, or one that changed to a value the controller would not
+// have written, is reconciled so that the hash is restored.
+func updateNeedsReconcile(old, updated *corev1.Secret, cfg *config.Configuration) bool {
+	if !IsProviderSecret(updated) || !cfg.SupportsProviderType(updated.Labels[ProviderTypeLabel]) {
+		return false
+	}
+	if inputFingerprint(old, cfg) != inputFingerprint(updated, cfg) {
+		return true
+	}
+
+	hash := updated.Annotations[CredentialHash]
+	if hash == "" {
+		return true
+	}
+	if hash == old.Annotations[CredentialHash] {
+		return false
+	}
+
+	// The controller writes the hash of the data. The data of secrets using
+	// a credential source is not in the secret, so it cannot be checked here.
+	if _, ok := updated.Annotations[CredentialSourceAnnotation]; ok {
+		return true
+	}
+	expected, err := CredentialDataHash(*updated, cfg)
+	return err != nil || expected != hash
+}
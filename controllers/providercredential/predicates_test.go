@@ -0,0 +1,112 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package providercredential
+
+import (
+	"testing"
+
+	"github.com/stolostron/provider-credential-controller/pkg/config"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestUpdateNeedsReconcile(t *testing.T) {
+
+	cfg := config.Default()
+
+	old := getCPSecretWithKeys(map[string][]byte{HOST: []byte(userValue), TOKEN: []byte(tokenValue)})
+	old.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "ans"}
+	old.Annotations = map[string]string{}
+	hash, err := CredentialDataHash(old, cfg)
+	assert.Nil(t, err)
+	old.Annotations[CredentialHash] = hash
+
+	tests := []struct {
+		name   string
+		update func(secret *corev1.Secret)
+		want   bool
+	}{
+		{"resync", func(secret *corev1.Secret) {}, false},
+		{"metadata churn", func(secret *corev1.Secret) {
+			secret.ResourceVersion = "2"
+			secret.Labels["team"] = "platform"
+			secret.Annotations["kubectl.kubernetes.io/last-applied-configuration"] = "{}"
+		}, false},
+		{"controller annotations", func(secret *corev1.Secret) {
+			secret.Annotations[LastRotatedAnnotation] = "2026-10-18T00:00:00Z"
+			secret.Annotations[RefreshedClusterCuratorsAnnotation] = "curator"
+		}, false},
+		{"data changed", func(secret *corev1.Secret) {
+			secret.Data[TOKEN] = []byte("rotated")
+		}, true},
+		{"key added", func(secret *corev1.Secret) {
+			secret.Data["extra"] = []byte{}
+		}, true},
+		{"propagated keys changed", func(secret *corev1.Secret) {
+			secret.Annotations[ExcludeKeysAnnotation] = HOST
+		}, true},
+		{"expiry changed", func(secret *corev1.Secret) {
+			secret.Annotations[AzureClientSecretExpiryAnnotation] = "2027-01-01T00:00:00Z"
+		}, true},
+		{"hash removed", func(secret *corev1.Secret) {
+			delete(secret.Annotations, CredentialHash)
+		}, true},
+		{"hash tampered with", func(secret *corev1.Secret) {
+			secret.Annotations[CredentialHash] = "tampered"
+		}, true},
+		{"no longer a Provider secret", func(secret *corev1.Secret) {
+			delete(secret.Labels, CredentialLabel)
+			secret.Data = nil
+		}, false},
+		{"unsupported type", func(secret *corev1.Secret) {
+			secret.Labels[ProviderTypeLabel] = "unknown"
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			updated := *old.DeepCopy()
+			test.update(&updated)
+			assert.Equal(t, test.want, updateNeedsReconcile(&old, &updated, cfg))
+		})
+	}
+
+	// Only the keys propagated to the copies are inputs
+	aws := getCopiedSecretForProvider("aws")
+	aws.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "aws"}
+	aws.Data["pullSecret"] = []byte("{}")
+	aws.Annotations = map[string]string{}
+	aws.Annotations[CredentialHash], err = CredentialDataHash(aws, cfg)
+	assert.Nil(t, err)
+
+	updated := *aws.DeepCopy()
+	updated.Data["pullSecret"] = []byte(`{"auths": {}}`)
+	updated.Data["notes"] = []byte("rotated next quarter")
+	assert.False(t, updateNeedsReconcile(&aws, &updated, cfg), "Keys that are not propagated are not inputs")
+
+	updated.Annotations[PropagateKeysAnnotation] = "pullSecret"
+	assert.True(t, updateNeedsReconcile(&aws, &updated, cfg), "Selecting a key is an input")
+
+	updated = *aws.DeepCopy()
+	updated.Data["aws_secret_access_key"] = []byte("rotated")
+	assert.True(t, updateNeedsReconcile(&aws, &updated, cfg))
+
+	// The controller's own hash write, following a change of the data, is
+	// not reconciled again
+	rotated := *old.DeepCopy()
+	rotated.Data[TOKEN] = []byte("rotated")
+	delete(rotated.Annotations, CredentialHash)
+	assert.True(t, updateNeedsReconcile(&old, &rotated, cfg))
+
+	written := *rotated.DeepCopy()
+	written.Annotations[CredentialHash], err = CredentialDataHash(rotated, cfg)
+	assert.Nil(t, err)
+	assert.False(t, updateNeedsReconcile(&rotated, &written, cfg))
+
+	// The hash of a secret using a credential source cannot be checked
+	// without reading the store
+	sourced := *old.DeepCopy()
+	sourced.Annotations[CredentialSourceAnnotation] = "vault://secret/ans"
+	stored := *sourced.DeepCopy()
+	stored.Annotations[CredentialHash] = "from-the-store"
+	assert.True(t, updateNeedsReconcile(&sourced, &stored, cfg))
+}
@@ -9,13 +9,17 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/stolostron/provider-credential-controller/pkg/apply"
+	"github.com/stolostron/provider-credential-controller/pkg/config"
+	"github.com/stolostron/provider-credential-controller/pkg/health"
+	"github.com/stolostron/provider-credential-controller/pkg/source"
+	"github.com/stolostron/provider-credential-controller/pkg/transform"
+	"github.com/stolostron/provider-credential-controller/pkg/verify"
 	corev1 "k8s.io/api/core/v1"
-	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -31,16 +35,26 @@ import (
 
 const CredentialHash = "credential-hash" //#nosec G101
 const ProviderTypeLabel = "cluster.open-cluster-management.io/type"
-const copiedFromNamespaceLabel = "cluster.open-cluster-management.io/copiedFromNamespace"
-const copiedFromNameLabel = "cluster.open-cluster-management.io/copiedFromSecretName"
+const CopiedFromNamespaceLabel = "cluster.open-cluster-management.io/copiedFromNamespace"
+const CopiedFromNameLabel = "cluster.open-cluster-management.io/copiedFromSecretName"
 const CredentialLabel = "cluster.open-cluster-management.io/credentials" //#nosec G101
 
-// managedClusterGVK identifies the cluster-scoped ManagedCluster resource
+// IsProviderSecret reports whether "secret" is labelled with CredentialLabel.
+func IsProviderSecret(secret client.Object) bool {
+	_, ok := secret.GetLabels()[CredentialLabel]
+	return ok
+}
+
+// FieldManager owns the credential keys of the copies and the CredentialHash
+// annotation of Provider secrets, which the controller server-side applies.
+const FieldManager = "provider-credential-controller"
+
+// ManagedClusterGVK identifies the cluster-scoped ManagedCluster resource
 // (group cluster.open-cluster-management.io, version v1). It is looked up
 // via unstructured.Unstructured rather than the typed
 // open-cluster-management.io/api client to avoid taking on that module as a
 // dependency here.
-var managedClusterGVK = schema.GroupVersionKind{
+var ManagedClusterGVK = schema.GroupVersionKind{
 	Group:   "cluster.open-cluster-management.io",
 	Version: "v1",
 	Kind:    "ManagedCluster",
@@ -65,13 +79,10 @@ const managedClusterJoinedCondition = "ManagedClusterJoined"
 // theft attempt, not just a benign misconfiguration.
 const UnauthorizedCredentialCopyEventReason = "UnauthorizedCredentialCopy"
 
-const rhvConfigTemplate = `ovirt_url: %s
-ovirt_username: %s
-ovirt_password: %s
-ovirt_ca_bundle: |+
-  %s`
-
-var hash = sha256.New()
+// TransformsAnnotation adds, on a Provider secret, transforms applied after
+// those its provider type is configured with. Its value is a JSON list of
+// transforms, for example [{"key": "token.json", "template": "{{ json .token }}"}].
+const TransformsAnnotation = "cluster.open-cluster-management.io/transforms"
 
 // ProviderCredentialSecretReconciler reconciles a Provider secret
 type ProviderCredentialSecretReconciler struct {
@@ -80,16 +91,59 @@ type ProviderCredentialSecretReconciler struct {
 	Log       logr.Logger
 	Scheme    *runtime.Scheme
 	Recorder  record.EventRecorder
+	Watchdog  *health.Watchdog
+	Config    *config.Store
+
+	// NamespaceScoped is set when the controller only has RBAC for secrets
+	// in the watched namespaces and in ManagedCluster namespaces.
+	NamespaceScoped bool
+
+	// Verifiers replace, by provider type, the built-in verifiers the
+	// configuration enables. A changed credential is only propagated once
+	// the verifier of its type accepts it.
+	Verifiers map[string]verify.Verifier
+
+	// Sources replace, by reference scheme, the built-in external stores
+	// the configuration enables.
+	Sources map[string]source.Source
+
+	vault vaultSource
 }
 
 func generateHash(valueBytes []byte) ([]byte, error) {
 
-	hash.Reset()
+	// A fresh hash per call keeps this safe with MaxConcurrentReconciles > 1
+	hash := sha256.New()
 	_, err := hash.Write(valueBytes)
 
 	return hash.Sum(nil), err
 }
 
+// CredentialDataHash returns the CredentialHash annotation value of the
+// Provider secret "secret": the fingerprint of the data its copies hold.
+// Copies whose data hashes to the same value are the ones the controller
+// updates on the next rotation. "cfg" holds the transforms of its type.
+func CredentialDataHash(secret corev1.Secret, cfg *config.Configuration) (string, error) {
+	secretData, err := extractImportantData(secret, cfg)
+	if err != nil {
+		return "", err
+	}
+	return DataHash(secretData)
+}
+
+// DataHash returns the base64 fingerprint of a copy's "data".
+func DataHash(data map[string][]byte) (string, error) {
+	secretBytes, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	hash, err := generateHash(secretBytes)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(hash), nil
+}
+
 // isJoinedManagedClusterNamespace returns true iff "namespace" is the name
 // of a ManagedCluster that has joined the hub.
 //
@@ -104,12 +158,36 @@ func generateHash(valueBytes []byte) ([]byte, error) {
 // error (including NotFound) fails closed.
 func isJoinedManagedClusterNamespace(ctx context.Context, reader client.Reader, namespace string) bool {
 	mc := &unstructured.Unstructured{}
-	mc.SetGroupVersionKind(managedClusterGVK)
+	mc.SetGroupVersionKind(ManagedClusterGVK)
 
 	if err := reader.Get(ctx, types.NamespacedName{Name: namespace}, mc); err != nil {
 		return false
 	}
 
+	return isJoined(mc)
+}
+
+// JoinedManagedClusterNamespaces returns the names of every ManagedCluster
+// that has joined the hub, which are also the names of the hub namespaces
+// that hold each cluster's copies.
+func JoinedManagedClusterNamespaces(ctx context.Context, reader client.Reader) ([]string, error) {
+	mcList := &unstructured.UnstructuredList{}
+	mcList.SetGroupVersionKind(ManagedClusterGVK.GroupVersion().WithKind(ManagedClusterGVK.Kind + "List"))
+
+	if err := reader.List(ctx, mcList); err != nil {
+		return nil, err
+	}
+
+	namespaces := []string{}
+	for i := range mcList.Items {
+		if isJoined(&mcList.Items[i]) {
+			namespaces = append(namespaces, mcList.Items[i].GetName())
+		}
+	}
+	return namespaces, nil
+}
+
+func isJoined(mc *unstructured.Unstructured) bool {
 	conditions, found, err := unstructured.NestedSlice(mc.Object, "status", "conditions")
 	if err != nil || !found {
 		return false
@@ -128,22 +206,71 @@ func isJoinedManagedClusterNamespace(ctx context.Context, reader client.Reader,
 	return false
 }
 
+// listChildSecrets returns the copies labelled as coming from the Provider
+// secret "req". When the controller is namespace-scoped it may not list
+// secrets cluster-wide, so copies are only looked up in the namespaces of
+// Joined ManagedClusters and in the configured exempt namespaces.
+func (r *ProviderCredentialSecretReconciler) listChildSecrets(ctx context.Context, req ctrl.Request, cfg *config.Configuration) ([]corev1.Secret, error) {
+	matchingLabels := client.MatchingLabels{CopiedFromNamespaceLabel: req.Namespace, CopiedFromNameLabel: req.Name}
+
+	if !r.NamespaceScoped {
+		secrets := &corev1.SecretList{}
+		if err := r.APIReader.List(ctx, secrets, matchingLabels); err != nil {
+			return nil, err
+		}
+		return secrets.Items, nil
+	}
+
+	namespaces, err := JoinedManagedClusterNamespaces(ctx, r.APIReader)
+	if err != nil {
+		return nil, err
+	}
+	namespaces = append(namespaces, cfg.Gating.ExemptNamespaces...)
+
+	children := []corev1.Secret{}
+	seen := map[string]bool{}
+	for _, namespace := range namespaces {
+		if seen[namespace] {
+			continue
+		}
+		seen[namespace] = true
+
+		secrets := &corev1.SecretList{}
+		if err := r.APIReader.List(ctx, secrets, client.InNamespace(namespace), matchingLabels); err != nil {
+			return nil, err
+		}
+		children = append(children, secrets.Items...)
+	}
+	return children, nil
+}
+
 func (r *ProviderCredentialSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 
 	log := r.Log.WithValues("ProviderCredentialSecretReconciler", req.NamespacedName)
 
+	r.Watchdog.Begin(req.String())
+	defer r.Watchdog.End(req.String())
+
 	var secret corev1.Secret
 	if err := r.Get(ctx, req.NamespacedName, &secret); err != nil {
 		log.V(0).Info("Resource deleted")
 		return ctrl.Result{}, err
 	}
 
+	// The credential label may have been removed since the event was queued
+	if !IsProviderSecret(&secret) {
+		log.V(1).Info("Not a Provider secret")
+		return ctrl.Result{}, nil
+	}
+
 	log.V(1).Info("Reconcile secret")
 
+	cfg := r.Config.Get()
+
 	// This is the hash for the original secret.Data
 	var originalHash []byte
 	a := secret.GetAnnotations()
-	if a != nil {
+	if a[CredentialHash] != "" {
 		var err error
 		originalHash, err = base64.StdEncoding.DecodeString(a[CredentialHash])
 		if err != nil {
@@ -152,8 +279,35 @@ func (r *ProviderCredentialSecretReconciler) Reconcile(ctx context.Context, req
 		}
 	}
 
+	// A credential kept in an external store replaces the keys of the secret
+	poll, err := r.readSource(ctx, &secret, cfg)
+	if isSourceDenied(err) {
+		// Checked again at the pace of the store, as the allowed paths are
+		// hot reloaded
+		log.Error(err, "Not reading the credential source of "+secret.Namespace+"/"+secret.Name)
+		if r.Recorder != nil {
+			r.Recorder.Event(&secret, corev1.EventTypeWarning, CredentialSourceDeniedEventReason, err.Error())
+		}
+		return ctrl.Result{RequeueAfter: cfg.Sources.PollInterval.Duration}, nil
+	}
+	if err != nil {
+		log.Error(err, "Failed to read the credential source of "+secret.Namespace+"/"+secret.Name)
+		if r.Recorder != nil {
+			r.Recorder.Event(&secret, corev1.EventTypeWarning, CredentialSourceFailedEventReason, err.Error())
+		}
+		return ctrl.Result{}, err
+	}
+
 	// We need to extract the specific secret.Data
-	secretData, err := extractImportantData(secret)
+	secretData, err := extractImportantData(secret, cfg)
+	if isInvalidKeys(err) {
+		// Retrying does not help, the annotations must be fixed
+		log.Error(err, "Not reconciling "+secret.Namespace+"/"+secret.Name)
+		if r.Recorder != nil {
+			r.Recorder.Event(&secret, corev1.EventTypeWarning, InvalidKeysEventReason, err.Error())
+		}
+		return ctrl.Result{}, nil
+	}
 	if err != nil {
 		log.Error(err, "Failed to extract secret.Data[metadata] from "+secret.Namespace+"/"+secret.Name)
 		return ctrl.Result{}, err
@@ -176,6 +330,34 @@ func (r *ProviderCredentialSecretReconciler) Reconcile(ctx context.Context, req
 	log.V(0).Info("ORIGINAL Provider hash: " + base64.StdEncoding.EncodeToString([]byte(originalHash)))
 	log.V(0).Info("NEW Provider hash: " + base64.StdEncoding.EncodeToString([]byte(currentHash)))
 
+	// A changed credential must be accepted by its provider before it is
+	// delivered anywhere. The hash is left as is, so it is verified again.
+	if !bytes.Equal(originalHash, currentHash) {
+		if err := r.verifyCredential(ctx, &secret, cfg); err != nil {
+			log.Error(err, "Credential verification failed, not propagating "+secret.Namespace+"/"+secret.Name)
+			return ctrl.Result{RequeueAfter: sooner(poll, verificationRequeue)}, nil
+		}
+	}
+
+	// Deliver the credential to the managed clusters selected by the Provider
+	// secret, checking back until every ManifestWork is applied
+	result := ctrl.Result{RequeueAfter: poll}
+	pending, err := r.syncManifestWorks(ctx, log, &secret, secretData)
+	if err != nil {
+		log.Error(err, "Failed to sync the ManifestWorks of "+secret.Namespace+"/"+secret.Name)
+		return ctrl.Result{}, err
+	}
+	if pending {
+		log.V(0).Info("Waiting for ManifestWorks to be applied")
+		result.RequeueAfter = sooner(result.RequeueAfter, manifestWorkRequeue)
+	}
+
+	// Copies owned by GitOps tools that need the rotated credential from Git
+	var gitOpsCopies []GitOpsCopy
+
+	// ClusterCurators whose Ansible secrets received the rotated credential
+	var refreshedCurators []RefreshedClusterCurator
+
 	// If no hash is found, store the currentHash (this is for NEW or MIGRATED Provider Secrets)
 	if originalHash == nil {
 
@@ -186,27 +368,45 @@ func (r *ProviderCredentialSecretReconciler) Reconcile(ctx context.Context, req
 
 		log.V(0).Info("Provider secret data has changed, reconcile ALL copies")
 
+		// Secrets referenced by Hive still hold the credentials hashing to
+		// originalHash until they are updated below
+		if secret.Annotations[DiscoverHiveReferencesAnnotation] == "true" {
+			if err := r.adoptHiveReferences(ctx, log, &secret, originalHash, cfg); err != nil {
+				log.Error(err, "Failed to adopt the secrets referenced by Hive")
+				return ctrl.Result{}, err
+			}
+		}
+
 		// Retreives all copied secrets that have labels pointing to this Provider
-		secrets := &corev1.SecretList{}
-		err = r.APIReader.List(
-			ctx,
-			secrets,
-			client.MatchingLabels{copiedFromNamespaceLabel: req.Namespace, copiedFromNameLabel: req.Name})
+		secrets, err := r.listChildSecrets(ctx, req, cfg)
+
+		// ClusterCurators may reference Ansible secrets that are not copies
+		syncCurators := secret.Labels[ProviderTypeLabel] == "ans" && secret.Annotations[SyncClusterCuratorsAnnotation] == "true"
 
 		// Check if we found any copies
-		secretCount := len(secrets.Items)
-		if err != nil || secretCount == 0 {
-			log.V(0).Info("Did not find any copied secrets")
-			return ctrl.Result{}, nil
+		secretCount := len(secrets)
+		if err != nil {
+			log.Error(err, "Failed to list the copied secrets")
+			return r.requeueForReminder(ctx, log, &secret, cfg, result), nil
 		}
 
+		// Without copies the rotation is still recorded below
 		log.V(0).Info("Found " + strconv.Itoa(secretCount) + " copies")
 
+		// Encrypted copies prove they hold the credential with a fingerprint
+		// under this key
+		fingerprintKey, err := r.fingerprintKey(ctx, &secret, false)
+		if err != nil {
+			log.Error(err, "Failed to read the fingerprint key")
+			return ctrl.Result{}, err
+		}
+
 		// Loop through all retreived copies
 
-		for i := range secrets.Items {
+		for i := range secrets {
 
-			childSecret := secrets.Items[i]
+			childSecret := secrets[i]
+			r.Watchdog.Progress(req.String())
 
 			log.V(0).Info("Child secret:" + childSecret.Namespace + "/" + childSecret.Name)
 
@@ -215,7 +415,8 @@ func (r *ProviderCredentialSecretReconciler) Reconcile(ctx context.Context, req
 			// so neither establishes that the child lives in a namespace
 			// the hub actually controls. Require that the child's
 			// namespace be a Joined ManagedCluster before propagating.
-			if !isJoinedManagedClusterNamespace(ctx, r.APIReader, childSecret.Namespace) {
+			if cfg.RequiresJoinedManagedCluster(childSecret.Namespace) &&
+				!isJoinedManagedClusterNamespace(ctx, r.APIReader, childSecret.Namespace) {
 				msg := "namespace " + childSecret.Namespace +
 					" is not a Joined ManagedCluster; refusing to propagate credentials from " +
 					secret.Namespace + "/" + secret.Name + " into " +
@@ -246,15 +447,33 @@ func (r *ProviderCredentialSecretReconciler) Reconcile(ctx context.Context, req
 
 			log.V(0).Info("Child hash: " + base64.StdEncoding.EncodeToString([]byte(childHash)))
 
-			// If both hashes match, the copied secret is from the Provider
-			if bytes.Compare(originalHash, childHash) == 0 {
+			// If both hashes match, the copied secret is from the Provider.
+			// Encrypted copies prove it with their fingerprint instead.
+			if bytes.Compare(originalHash, childHash) == 0 || encryptedCopyMatches(&childSecret, fingerprintKey, originalHash) {
 				log.V(0).Info("Child secret hash matches, update the child secret")
 
-				childSecret.Data = secretData
-				if err := r.Client.Update(ctx, &childSecret); err != nil {
+				// Writing to a copy reconciled from Git would only be reverted,
+				// so leave it to the GitOps tool and report it instead
+				if managedBy := GitOpsOwner(&childSecret, cfg); managedBy != "" {
+					msg := "copy of " + secret.Namespace + "/" + secret.Name + " is managed by GitOps (" + managedBy +
+						"); update its Git source with the rotated credential"
+					log.V(0).Info("|--X Skipping secret " + childSecret.Namespace + "/" + childSecret.Name + ": " + msg)
+					if r.Recorder != nil {
+						r.Recorder.Event(&childSecret, corev1.EventTypeWarning, GitOpsManagedCopyEventReason, msg)
+					}
+					gitOpsCopies = append(gitOpsCopies, GitOpsCopy{
+						Namespace: childSecret.Namespace,
+						Name:      childSecret.Name,
+						ManagedBy: managedBy,
+					})
+					continue
+				}
+
+				if err := r.updateChildSecret(ctx, &secret, &childSecret, originalHash, currentHash, secretData); err != nil {
 					log.Error(err, "|--X Failed to update child secret: "+childSecret.Namespace+"/"+childSecret.Name)
+				} else {
+					log.V(0).Info("|--> Updated secret: " + childSecret.Namespace + "/" + childSecret.Name)
 				}
-				log.V(0).Info("|--> Updated secret: " + childSecret.Namespace + "/" + childSecret.Name)
 
 				// The hashes don't match, so this copied secret can NOT be trusted
 			} else {
@@ -267,10 +486,17 @@ func (r *ProviderCredentialSecretReconciler) Reconcile(ctx context.Context, req
 				klog.Infof("childHash: %v", base64.StdEncoding.EncodeToString([]byte(childHash)))
 			}
 		}
+
+		if syncCurators {
+			if refreshedCurators, err = r.refreshClusterCurators(ctx, log, &secret, originalHash, currentHash, secretData, cfg); err != nil {
+				log.Error(err, "Failed to refresh the ClusterCurators")
+				return ctrl.Result{}, err
+			}
+		}
 	} else {
 		log.V(0).Info("Provider secret data has not changed")
 
-		return ctrl.Result{}, nil
+		return r.requeueForReminder(ctx, log, &secret, cfg, result), nil
 	}
 
 	/* When we finish processing all copied secrets, update the Provider secret with the currentHash
@@ -285,58 +511,118 @@ func (r *ProviderCredentialSecretReconciler) Reconcile(ctx context.Context, req
 	*/
 
 	currentCredHash := base64.StdEncoding.EncodeToString([]byte(currentHash))
-	patch := &map[string]interface{}{
-		"metadata": map[string]interface{}{
-			"annotations": map[string]string{
-				CredentialHash: currentCredHash,
-			},
-		},
+	hashed := apply.NewSecret(secret.Namespace, secret.Name, "")
+	hashed.Annotations = map[string]string{
+		CredentialHash: currentCredHash,
 	}
-	patchBytes, err := json.Marshal(patch)
 
-	err = r.Patch(context.Background(), &corev1.Secret{
-		ObjectMeta: v1.ObjectMeta{
-			Name:      secret.Name,
-			Namespace: secret.Namespace,
-		},
-	}, client.RawPatch(types.StrategicMergePatchType, patchBytes))
+	// The age of the credential starts over when its hash changes. A first
+	// hash keeps any rotation time already recorded, else the age is counted
+	// from the creation of the secret.
+	if originalHash != nil {
+		hashed.Annotations[LastRotatedAnnotation] = now().UTC().Format(time.RFC3339)
+	} else if lastRotated, ok := secret.Annotations[LastRotatedAnnotation]; ok {
+		hashed.Annotations[LastRotatedAnnotation] = lastRotated
+	}
 
-	if err != nil {
+	// The annotation is dropped by the apply once no GitOps copy is pending
+	if len(gitOpsCopies) > 0 {
+		if hashed.Annotations[GitOpsCopiesAnnotation], err = gitOpsCopiesAnnotation(gitOpsCopies); err != nil {
+			log.Error(err, "Failed to marshal the GitOps managed copies")
+			return ctrl.Result{}, err
+		}
+	}
+	if len(refreshedCurators) > 0 {
+		var msg string
+		if hashed.Annotations[RefreshedClusterCuratorsAnnotation], msg, err = refreshedClusterCuratorsAnnotation(refreshedCurators); err != nil {
+			log.Error(err, "Failed to marshal the refreshed ClusterCurators")
+			return ctrl.Result{}, err
+		}
+		if r.Recorder != nil {
+			r.Recorder.Event(&secret, corev1.EventTypeNormal, ClusterCuratorsRefreshedEventReason, msg)
+		}
+	}
+
+	if err := apply.Secret(ctx, r.Client, FieldManager, hashed); err != nil {
 		log.Error(err, "Failed to patch the Provider secret annotation with the new hash")
 	}
 	log.V(0).Info("Updated Provider secret hash")
 
-	return ctrl.Result{}, nil
+	if lastRotated, ok := hashed.Annotations[LastRotatedAnnotation]; ok {
+		if secret.Annotations == nil {
+			secret.Annotations = map[string]string{}
+		}
+		secret.Annotations[LastRotatedAnnotation] = lastRotated
+	}
+	return r.requeueForReminder(ctx, log, &secret, cfg, result), nil
+}
+
+// updateChildSecret writes "secretData", which hashes to "currentHash", to
+// the copy "childSecret" of "provider", only if the copy was not modified since it was
+// read. On a conflict the copy is read again and only updated if its data
+// still hashes, or its fingerprint still matches, "originalHash".
+func (r *ProviderCredentialSecretReconciler) updateChildSecret(ctx context.Context, provider, childSecret *corev1.Secret, originalHash, currentHash []byte, secretData map[string][]byte) error {
+	return apply.RetryOnConflict(func(attempt int) error {
+		if attempt > 0 {
+			if err := r.APIReader.Get(ctx, client.ObjectKeyFromObject(childSecret), childSecret); err != nil {
+				return err
+			}
+			secretBytes, err := json.Marshal(childSecret.Data)
+			if err != nil {
+				return err
+			}
+			childHash, err := generateHash(secretBytes)
+			if err != nil {
+				return err
+			}
+			fingerprintKey, err := r.fingerprintKey(ctx, provider, false)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(originalHash, childHash) && !encryptedCopyMatches(childSecret, fingerprintKey, originalHash) {
+				return errors.New("the copy changed while it was updated and its hash no longer matches")
+			}
+			if managedBy := GitOpsOwner(childSecret, r.Config.Get()); managedBy != "" {
+				return errors.New("the copy changed while it was updated and is now managed by GitOps (" + managedBy + ")")
+			}
+		}
+
+		return r.writeCopy(ctx, provider, childSecret, currentHash, secretData)
+	})
 }
 
 func (r *ProviderCredentialSecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	cfg := r.Config.Get()
+
+	if err := registerCredentialCollector(mgr.GetClient(), r.Config); err != nil {
+		return err
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
+		Named("providercredential").
 		For(&corev1.Secret{}).WithEventFilter(predicate.Funcs{
 		CreateFunc: func(e event.CreateEvent) bool {
-			switch e.Object.GetLabels()[ProviderTypeLabel] {
-			case "ans", "aws", "gcp", "vmw", "azr", "ost", "redhatvirtualization": //, "bm"
-				return true
-			}
 			// Add the hash check here??
-
-			return false
+			return IsProviderSecret(e.Object) && r.Config.Get().SupportsProviderType(e.Object.GetLabels()[ProviderTypeLabel])
 		},
 		UpdateFunc: func(e event.UpdateEvent) bool {
-			switch e.ObjectNew.GetLabels()[ProviderTypeLabel] {
-			case "ans", "aws", "gcp", "vmw", "azr", "ost", "redhatvirtualization": //, "bm"
-				return true
+			old, okOld := e.ObjectOld.(*corev1.Secret)
+			updated, okNew := e.ObjectNew.(*corev1.Secret)
+			if !okOld || !okNew {
+				return false
 			}
-			return false
+			return updateNeedsReconcile(old, updated, r.Config.Get())
 		},
 		DeleteFunc: func(e event.DeleteEvent) bool {
 			return false
 		},
 	}).WithOptions(controller.Options{
-		MaxConcurrentReconciles: 1, // This is the default
+		MaxConcurrentReconciles: cfg.Concurrency.MaxConcurrentReconciles,
+		RateLimiter:             cfg.RateLimiter(),
 	}).Complete(r)
 }
 
-func extractImportantData(credentialSecret corev1.Secret) (map[string][]byte, error) {
+func extractImportantData(credentialSecret corev1.Secret, cfg *config.Configuration) (map[string][]byte, error) {
 	returnData := map[string][]byte{}
 
 	var err error
@@ -347,7 +633,9 @@ func extractImportantData(credentialSecret corev1.Secret) (map[string][]byte, er
 
 	switch credType {
 	case "ans":
-		returnData = credentialSecret.Data
+		for key, value := range credentialSecret.Data {
+			returnData[key] = value
+		}
 
 	case "aws":
 		returnData["aws_access_key_id"] = credentialSecret.Data["aws_access_key_id"]
@@ -368,22 +656,39 @@ func extractImportantData(credentialSecret corev1.Secret) (map[string][]byte, er
 		returnData["clouds.yaml"] = credentialSecret.Data["clouds.yaml"]
 
 	case "redhatvirtualization":
-		returnData["ovirt-config.yaml"] = []byte(fmt.Sprintf(
-			rhvConfigTemplate,
-			credentialSecret.Data["ovirt_url"],
-			credentialSecret.Data["ovirt_username"],
-			credentialSecret.Data["ovirt_password"],
-			indent(2, credentialSecret.Data["ovirt_ca_bundle"]),
-		))
+		// ovirt-config.yaml is rendered by the default transforms
 
 	default:
-		err = errors.New("Label:" + ProviderTypeLabel + " is not supported for value: " + credType)
+		return returnData, errors.New("Label:" + ProviderTypeLabel + " is not supported for value: " + credType)
 	}
 
-	return returnData, err
-}
+	// Keys selected on the secret itself are propagated and hashed too
+	include, exclude, err := selectedKeys(credentialSecret, credType)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range include {
+		if value, ok := credentialSecret.Data[key]; ok {
+			returnData[key] = value
+		}
+	}
+	for _, key := range exclude {
+		delete(returnData, key)
+	}
 
-func indent(indention int, v []byte) string {
-	newline := "\n" + strings.Repeat(" ", indention)
-	return strings.Replace(string(v), "\n", newline, -1)
+	// Reshape the data for the copies' consumers. The annotation adds to the
+	// transforms of the type, which some types need to render their credential
+	transforms := cfg.Transforms[credType]
+	if value, ok := credentialSecret.Annotations[TransformsAnnotation]; ok {
+		added, err := transform.Parse(value)
+		if err != nil {
+			return nil, errors.New("invalid " + TransformsAnnotation + " on " +
+				credentialSecret.Namespace + "/" + credentialSecret.Name + ": " + err.Error())
+		}
+		transforms = append(append([]transform.Transform{}, transforms...), added...)
+	}
+	if err := checkTransformKeys(credentialSecret, transforms, returnData); err != nil {
+		return nil, err
+	}
+	return transform.Apply(transforms, transformSource(credentialSecret, credType, returnData), returnData)
 }
@@ -22,8 +22,8 @@ func init() {
 func getChildSecret(secretName string) corev1.Secret {
 	copiedSecret := getCPSecret()
 	copiedSecret.ObjectMeta.Labels = map[string]string{
-		copiedFromNamespaceLabel: CPSNamespace,
-		copiedFromNameLabel:      CPSName,
+		CopiedFromNamespaceLabel: CPSNamespace,
+		CopiedFromNameLabel:      CPSName,
 	}
 	copiedSecret.Namespace = "default"
 	copiedSecret.Name = secretName
@@ -49,6 +49,7 @@ func TestInitializeSecrets(t *testing.T) {
 	providerSecret := getCPSecret()
 
 	providerSecret.ObjectMeta.Labels = map[string]string{
+		CredentialLabel:   "",
 		ProviderTypeLabel: "ans",
 	}
 	t.Log("Create Provider Credential secret")
@@ -77,6 +78,7 @@ func TestCleanUpSecrets(t *testing.T) {
 
 	providerSecret := getCPSecret()
 	providerSecret.ObjectMeta.Labels = map[string]string{
+		CredentialLabel:   "",
 		ProviderTypeLabel: "ans",
 	}
 
@@ -87,8 +89,8 @@ func TestCleanUpSecrets(t *testing.T) {
 
 	copiedSecret := getCPSecret()
 	copiedSecret.ObjectMeta.Labels = map[string]string{
-		copiedFromNamespaceLabel: providerSecret.Namespace,
-		copiedFromNameLabel:      providerSecret.Name,
+		CopiedFromNamespaceLabel: providerSecret.Namespace,
+		CopiedFromNameLabel:      providerSecret.Name,
 	}
 	copiedSecret.Namespace = "default"
 
@@ -4,19 +4,28 @@ package providercredential
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"testing"
 
+	"github.com/stolostron/provider-credential-controller/pkg/config"
+	"github.com/stolostron/provider-credential-controller/pkg/transform"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap/zapcore"
 	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	clientfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/yaml"
 )
 
 const CPSName = "my-cloud-provider-secret"
@@ -105,6 +114,7 @@ func getCPSecretMetadata(credentialType string) corev1.Secret {
 			Namespace: CPSNamespace,
 			Name:      CPSName + "-" + credentialType,
 			Labels: map[string]string{
+				CredentialLabel:   "",
 				ProviderTypeLabel: credentialType,
 			},
 		},
@@ -119,7 +129,7 @@ func getCPSecretMetadata(credentialType string) corev1.Secret {
 // condition, for use as an APIReader fixture in tests.
 func newManagedCluster(name string, joined bool) *unstructured.Unstructured {
 	mc := &unstructured.Unstructured{}
-	mc.SetGroupVersionKind(managedClusterGVK)
+	mc.SetGroupVersionKind(ManagedClusterGVK)
 	mc.SetName(name)
 
 	if joined {
@@ -178,6 +188,7 @@ func TestReconcileNewCPSecret(t *testing.T) {
 
 		cps := getCPSecret()
 		cps.ObjectMeta.Labels = map[string]string{
+			CredentialLabel:   "",
 			ProviderTypeLabel: providerName,
 		}
 		cps.Data["metadata"] = []byte("fakeKey: fakeValue\n")
@@ -198,6 +209,30 @@ func TestReconcileNewCPSecret(t *testing.T) {
 	}
 }
 
+func TestCredentialDataHashMatchesReconcile(t *testing.T) {
+
+	for _, providerName := range []string{"aws", "gcp", "vmw", "ost", "azr", "redhatvirtualization"} {
+
+		cps := getCopiedSecretForProvider(providerName)
+		cps.ObjectMeta.Labels = map[string]string{
+			CredentialLabel:   "",
+			ProviderTypeLabel: providerName,
+		}
+
+		expectedHash, err := CredentialDataHash(cps, config.Default())
+		assert.Nil(t, err, "Nil, when the provider type is supported")
+
+		cpsr := GetProviderCredentialSecretReconciler()
+		cpsr.Client = clientfake.NewFakeClient(&cps)
+
+		_, err = cpsr.Reconcile(context.Background(), getRequest())
+		assert.Nil(t, err, "Nil, when Provider secret found, and hash is set")
+
+		cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+		assert.Equal(t, expectedHash, cps.Annotations[CredentialHash], providerName+" hashes are equal")
+	}
+}
+
 func TestReconcileInvalidProviderLabel(t *testing.T) {
 
 	// Missing "bm"
@@ -205,6 +240,7 @@ func TestReconcileInvalidProviderLabel(t *testing.T) {
 
 		cps := getCPSecret()
 		cps.ObjectMeta.Labels = map[string]string{
+			CredentialLabel:   "",
 			ProviderTypeLabel: providerName,
 		}
 		cps.Data["metadata"] = []byte("fakeKey: fakeValue\n")
@@ -224,6 +260,7 @@ func TestReconcileNoCPSecretChange(t *testing.T) {
 
 	cps := getCPSecret()
 	cps.ObjectMeta.Labels = map[string]string{
+		CredentialLabel:   "",
 		ProviderTypeLabel: "ans",
 	}
 
@@ -263,6 +300,7 @@ func TestReconcileChildSecrets(t *testing.T) {
 
 	cps := getCPSecret()
 	cps.ObjectMeta.Labels = map[string]string{
+		CredentialLabel:   "",
 		ProviderTypeLabel: "ans",
 	}
 
@@ -282,8 +320,8 @@ func TestReconcileChildSecrets(t *testing.T) {
 	copy2 := getCPSecret()
 
 	labels := map[string]string{
-		copiedFromNamespaceLabel: CPSNamespace,
-		copiedFromNameLabel:      CPSName,
+		CopiedFromNamespaceLabel: CPSNamespace,
+		CopiedFromNameLabel:      CPSName,
 	}
 
 	copy1.ObjectMeta.Labels = labels
@@ -345,8 +383,8 @@ func TestReconcileChildSecretsAllCloudProviders(t *testing.T) {
 		copy2 := getCopiedSecretForProvider(provider)
 
 		labels := map[string]string{
-			copiedFromNamespaceLabel: CPSNamespace,
-			copiedFromNameLabel:      cps.Name,
+			CopiedFromNamespaceLabel: CPSNamespace,
+			CopiedFromNameLabel:      cps.Name,
 		}
 
 		copy1.ObjectMeta.Labels = labels
@@ -372,6 +410,7 @@ func TestReconcileChangeWithNoCopiedSecrets(t *testing.T) {
 
 	cps := getCPSecret()
 	cps.ObjectMeta.Labels = map[string]string{
+		CredentialLabel:   "",
 		ProviderTypeLabel: "ans",
 	}
 
@@ -400,6 +439,7 @@ func TestReconcileChildSecretsInjectionAttack(t *testing.T) {
 
 	cps := getCPSecret()
 	cps.ObjectMeta.Labels = map[string]string{
+		CredentialLabel:   "",
 		ProviderTypeLabel: "ans",
 	}
 
@@ -420,8 +460,8 @@ func TestReconcileChildSecretsInjectionAttack(t *testing.T) {
 	copy2 := getCPSecret()
 
 	labels := map[string]string{
-		copiedFromNamespaceLabel: CPSNamespace,
-		copiedFromNameLabel:      CPSName,
+		CopiedFromNamespaceLabel: CPSNamespace,
+		CopiedFromNameLabel:      CPSName,
 	}
 
 	copy1.ObjectMeta.Labels = labels
@@ -484,6 +524,7 @@ func TestReconcileChildSecretsManagedClusterGate(t *testing.T) {
 
 	cps := getCPSecret()
 	cps.ObjectMeta.Labels = map[string]string{
+		CredentialLabel:   "",
 		ProviderTypeLabel: "ans",
 	}
 
@@ -499,8 +540,8 @@ func TestReconcileChildSecretsManagedClusterGate(t *testing.T) {
 	authorized.ObjectMeta.Name = "cluster-creds"
 	authorized.ObjectMeta.Namespace = ClusterNamespace1
 	authorized.ObjectMeta.Labels = map[string]string{
-		copiedFromNamespaceLabel: CPSNamespace,
-		copiedFromNameLabel:      CPSName,
+		CopiedFromNamespaceLabel: CPSNamespace,
+		CopiedFromNameLabel:      CPSName,
 	}
 
 	// Attacker child in a tenant namespace with no ManagedCluster at all:
@@ -509,8 +550,8 @@ func TestReconcileChildSecretsManagedClusterGate(t *testing.T) {
 	attacker.ObjectMeta.Name = "catch"
 	attacker.ObjectMeta.Namespace = "tenant-x"
 	attacker.ObjectMeta.Labels = map[string]string{
-		copiedFromNamespaceLabel: CPSNamespace,
-		copiedFromNameLabel:      CPSName,
+		CopiedFromNamespaceLabel: CPSNamespace,
+		CopiedFromNameLabel:      CPSName,
 	}
 
 	// Child in a namespace whose ManagedCluster exists but has not joined
@@ -519,8 +560,8 @@ func TestReconcileChildSecretsManagedClusterGate(t *testing.T) {
 	pending.ObjectMeta.Name = "pending-creds"
 	pending.ObjectMeta.Namespace = ClusterNamespace2
 	pending.ObjectMeta.Labels = map[string]string{
-		copiedFromNamespaceLabel: CPSNamespace,
-		copiedFromNameLabel:      CPSName,
+		CopiedFromNamespaceLabel: CPSNamespace,
+		CopiedFromNameLabel:      CPSName,
 	}
 
 	// Admin rotates the source credential.
@@ -571,3 +612,804 @@ func TestReconcileChildSecretsManagedClusterGate(t *testing.T) {
 		assert.Contains(t, e, UnauthorizedCredentialCopyEventReason)
 	}
 }
+
+// TestReconcileChildSecretsExemptNamespace verifies that a namespace listed in
+// the configuration's gating.exemptNamespaces receives rotated credentials
+// without being a Joined ManagedCluster, while other namespaces stay gated.
+func TestReconcileChildSecretsExemptNamespace(t *testing.T) {
+
+	cps := getCPSecret()
+	cps.ObjectMeta.Labels = map[string]string{
+		CredentialLabel:   "",
+		ProviderTypeLabel: "ans",
+	}
+
+	cfg := config.Default()
+	cfg.Gating.ExemptNamespaces = []string{"hub-local"}
+
+	cpsr := GetProviderCredentialSecretReconciler()
+	cpsr.Client = clientfake.NewFakeClient(&cps)
+	cpsr.Config = config.NewStaticStore(cfg)
+
+	_, err := cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err, "Nil, when Cloud Provider secret found, and hash is set")
+
+	exempt := getCPSecret()
+	exempt.ObjectMeta.Name = "hub-creds"
+	exempt.ObjectMeta.Namespace = "hub-local"
+	exempt.ObjectMeta.Labels = map[string]string{
+		CopiedFromNamespaceLabel: CPSNamespace,
+		CopiedFromNameLabel:      CPSName,
+	}
+
+	gated := getCPSecret()
+	gated.ObjectMeta.Name = "tenant-creds"
+	gated.ObjectMeta.Namespace = "tenant-x"
+	gated.ObjectMeta.Labels = exempt.ObjectMeta.Labels
+
+	cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+	cps.Data[TOKEN] = []byte("rotated-token")
+	cpsr.Update(context.Background(), &cps)
+
+	cpsr.Create(context.Background(), &exempt)
+	cpsr.Create(context.Background(), &gated)
+
+	cpsr.APIReader = clientfake.NewFakeClient(&cps, &exempt, &gated)
+
+	_, err = cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err, "Nil, when Cloud Provider secret found")
+
+	got := corev1.Secret{}
+	cpsr.Get(context.Background(), types.NamespacedName{Namespace: exempt.Namespace, Name: exempt.Name}, &got)
+	assert.Equal(t, []byte("rotated-token"), got.Data[TOKEN],
+		"child in an exempt namespace must receive the rotated credential")
+
+	got = corev1.Secret{}
+	cpsr.Get(context.Background(), types.NamespacedName{Namespace: gated.Namespace, Name: gated.Name}, &got)
+	assert.Equal(t, []byte(tokenValue), got.Data[TOKEN],
+		"child in a namespace that is not exempt must still be gated")
+}
+
+// TestReconcileChildSecretsNamespaceScoped verifies that in namespace-scoped
+// mode copies are resolved through the Joined ManagedCluster namespaces, so
+// a labelled copy elsewhere is never even listed.
+func TestReconcileChildSecretsNamespaceScoped(t *testing.T) {
+
+	cps := getCPSecret()
+	cps.ObjectMeta.Labels = map[string]string{
+		CredentialLabel:   "",
+		ProviderTypeLabel: "ans",
+	}
+
+	cpsr := GetProviderCredentialSecretReconciler()
+	cpsr.Client = clientfake.NewFakeClient(&cps)
+	cpsr.NamespaceScoped = true
+
+	_, err := cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err, "Nil, when Cloud Provider secret found, and hash is set")
+
+	labels := map[string]string{
+		CopiedFromNamespaceLabel: CPSNamespace,
+		CopiedFromNameLabel:      CPSName,
+	}
+
+	joined := getCPSecret()
+	joined.ObjectMeta.Name = "cluster-creds"
+	joined.ObjectMeta.Namespace = ClusterNamespace1
+	joined.ObjectMeta.Labels = labels
+
+	pending := getCPSecret()
+	pending.ObjectMeta.Name = "cluster-creds"
+	pending.ObjectMeta.Namespace = ClusterNamespace2
+	pending.ObjectMeta.Labels = labels
+
+	cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+	cps.Data[TOKEN] = []byte("rotated-token")
+	cpsr.Update(context.Background(), &cps)
+
+	cpsr.Create(context.Background(), &joined)
+	cpsr.Create(context.Background(), &pending)
+
+	cpsr.APIReader = clientfake.NewFakeClient(
+		&cps, &joined, &pending,
+		newManagedCluster(ClusterNamespace1, true),
+		newManagedCluster(ClusterNamespace2, false),
+	)
+
+	_, err = cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err, "Nil, when Cloud Provider secret found")
+
+	got := corev1.Secret{}
+	cpsr.Get(context.Background(), types.NamespacedName{Namespace: joined.Namespace, Name: joined.Name}, &got)
+	assert.Equal(t, []byte("rotated-token"), got.Data[TOKEN],
+		"child in a Joined ManagedCluster namespace must receive the rotated credential")
+
+	got = corev1.Secret{}
+	cpsr.Get(context.Background(), types.NamespacedName{Namespace: pending.Namespace, Name: pending.Name}, &got)
+	assert.Equal(t, []byte(tokenValue), got.Data[TOKEN],
+		"child in a namespace whose ManagedCluster has not Joined must not be listed")
+
+	// Nothing was skipped by the gate, the pending namespace was never listed.
+	fakeRecorder := cpsr.Recorder.(*record.FakeRecorder)
+	assert.Len(t, fakeRecorder.Events, 0, "no copy outside the Joined namespaces should be considered")
+}
+
+// getApplyConflictReconciler returns a reconciler whose client fails the
+// first server-side apply to the copy "cluster1/<CPSName>" with a Conflict,
+// after running "onConflict" against the underlying client.
+func getApplyConflictReconciler(t *testing.T, onConflict func(c client.WithWatch)) (*ProviderCredentialSecretReconciler, *int) {
+	cps := getCPSecret()
+	cps.ObjectMeta.Labels = map[string]string{
+		CredentialLabel:   "",
+		ProviderTypeLabel: "ans",
+	}
+
+	child := getCPSecret()
+	child.ObjectMeta.Namespace = ClusterNamespace1
+	child.ObjectMeta.Labels = map[string]string{
+		CopiedFromNamespaceLabel: CPSNamespace,
+		CopiedFromNameLabel:      CPSName,
+	}
+
+	applies := 0
+	c := clientfake.NewClientBuilder().
+		WithObjects(&cps, &child, newManagedCluster(ClusterNamespace1, true)).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+				if obj.GetNamespace() != ClusterNamespace1 {
+					return c.Patch(ctx, obj, patch, opts...)
+				}
+				assert.Equal(t, types.ApplyPatchType, patch.Type(), "Copies are server-side applied")
+				patchOpts := &client.PatchOptions{}
+				patchOpts.ApplyOptions(opts)
+				assert.Equal(t, FieldManager, patchOpts.FieldManager)
+
+				applies++
+				if applies == 1 {
+					onConflict(c)
+					return k8serrors.NewConflict(schema.GroupResource{Resource: "secrets"}, obj.GetName(), errors.New("modified"))
+				}
+				return c.Patch(ctx, obj, patch, opts...)
+			},
+		}).Build()
+
+	cpsr := GetProviderCredentialSecretReconciler()
+	cpsr.Client = c
+	cpsr.APIReader = c
+
+	// Try #1 initializes the credential-hash, then rotate the token
+	_, err := cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err, "Nil, when Cloud Provider secret found, and hash is set")
+
+	cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+	cps.Data[TOKEN] = []byte("something-new")
+	cpsr.Update(context.Background(), &cps)
+
+	return cpsr, &applies
+}
+
+func TestReconcileChildSecretsApplyConflictRetry(t *testing.T) {
+
+	cpsr, applies := getApplyConflictReconciler(t, func(c client.WithWatch) {
+		// An unrelated change bumps the copy's resourceVersion
+		var child corev1.Secret
+		c.Get(context.Background(), types.NamespacedName{Namespace: ClusterNamespace1, Name: CPSName}, &child)
+		child.Annotations = map[string]string{"touched-by": "console"}
+		c.Update(context.Background(), &child)
+	})
+
+	_, err := cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err, "Nil, when the copy is updated after a conflict")
+	assert.Equal(t, 2, *applies, "The apply is retried after a conflict")
+
+	var child corev1.Secret
+	cpsr.Get(context.Background(), types.NamespacedName{Namespace: ClusterNamespace1, Name: CPSName}, &child)
+	assert.Equal(t, []byte("something-new"), child.Data[TOKEN], "The copy received the rotated token")
+	assert.Equal(t, "console", child.Annotations["touched-by"], "The concurrent change is kept")
+}
+
+func TestReconcileChildSecretsApplyConflictTampered(t *testing.T) {
+
+	cpsr, applies := getApplyConflictReconciler(t, func(c client.WithWatch) {
+		// The copy's data is replaced while it is being updated
+		var child corev1.Secret
+		c.Get(context.Background(), types.NamespacedName{Namespace: ClusterNamespace1, Name: CPSName}, &child)
+		child.Data[TOKEN] = []byte("attacker-token")
+		c.Update(context.Background(), &child)
+	})
+
+	_, err := cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err, "Nil, the copy is skipped")
+	assert.Equal(t, 1, *applies, "The apply is not retried once the hash no longer matches")
+
+	var child corev1.Secret
+	cpsr.Get(context.Background(), types.NamespacedName{Namespace: ClusterNamespace1, Name: CPSName}, &child)
+	assert.Equal(t, []byte("attacker-token"), child.Data[TOKEN], "The tampered copy is not updated")
+}
+
+// TestReconcileChildSecretsGitOpsManaged verifies that copies owned by a
+// GitOps tool are never written to, and are reported by an Event and on the
+// Provider secret instead.
+func TestReconcileChildSecretsGitOpsManaged(t *testing.T) {
+
+	cps := getCPSecret()
+	cps.ObjectMeta.Labels = map[string]string{
+		CredentialLabel:   "",
+		ProviderTypeLabel: "ans",
+	}
+
+	newChild := func(namespace string) corev1.Secret {
+		child := getCPSecret()
+		child.ObjectMeta.Namespace = namespace
+		child.ObjectMeta.Labels = map[string]string{
+			CopiedFromNamespaceLabel: CPSNamespace,
+			CopiedFromNameLabel:      CPSName,
+		}
+		return child
+	}
+
+	plain := newChild("cluster1")
+	annotated := newChild("cluster2")
+	annotated.Annotations = map[string]string{SkipCredentialSyncAnnotation: "true"}
+	argo := newChild("cluster3")
+	argo.ManagedFields = []v1.ManagedFieldsEntry{{Manager: "argocd-controller", Operation: v1.ManagedFieldsOperationApply}}
+	sealed := newChild("cluster4")
+	sealed.OwnerReferences = []v1.OwnerReference{{APIVersion: "bitnami.com/v1alpha1", Kind: "SealedSecret", Name: CPSName, UID: "1"}}
+
+	c := clientfake.NewClientBuilder().WithObjects(&cps, &plain, &annotated, &argo, &sealed,
+		newManagedCluster("cluster1", true), newManagedCluster("cluster2", true),
+		newManagedCluster("cluster3", true), newManagedCluster("cluster4", true)).Build()
+
+	cpsr := GetProviderCredentialSecretReconciler()
+	cpsr.Client = c
+	cpsr.APIReader = c
+
+	// Try #1 initializes the credential-hash, then rotate the token
+	_, err := cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err, "Nil, when Cloud Provider secret found, and hash is set")
+
+	cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+	cps.Data[TOKEN] = []byte("rotated-token")
+	cpsr.Update(context.Background(), &cps)
+
+	_, err = cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err, "Nil, when Cloud Provider secret found")
+
+	for namespace, expected := range map[string]string{
+		"cluster1": "rotated-token",
+		"cluster2": tokenValue,
+		"cluster3": tokenValue,
+		"cluster4": tokenValue,
+	} {
+		got := corev1.Secret{}
+		cpsr.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: CPSName}, &got)
+		assert.Equal(t, []byte(expected), got.Data[TOKEN], "copy in %s", namespace)
+	}
+
+	cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+	assert.JSONEq(t, `[
+		{"namespace": "cluster2", "name": "`+CPSName+`", "managedBy": "annotation `+SkipCredentialSyncAnnotation+`"},
+		{"namespace": "cluster3", "name": "`+CPSName+`", "managedBy": "field manager argocd-controller"},
+		{"namespace": "cluster4", "name": "`+CPSName+`", "managedBy": "owner SealedSecret.bitnami.com/`+CPSName+`"}
+	]`, cps.Annotations[GitOpsCopiesAnnotation])
+
+	fakeRecorder := cpsr.Recorder.(*record.FakeRecorder)
+	close(fakeRecorder.Events)
+	var events []string
+	for e := range fakeRecorder.Events {
+		events = append(events, e)
+	}
+	assert.Len(t, events, 3, "expected one Warning event per GitOps managed copy")
+	for _, e := range events {
+		assert.Contains(t, e, "Warning "+GitOpsManagedCopyEventReason)
+	}
+}
+
+// newHiveResource returns an unstructured Hive resource of "kind" in
+// "namespace" whose spec.platform.aws.credentialsSecretRef names "secretName".
+func newHiveResource(kind, namespace, name, secretName string) *unstructured.Unstructured {
+	hive := &unstructured.Unstructured{}
+	hive.SetGroupVersionKind(schema.GroupVersionKind{Group: "hive.openshift.io", Version: "v1", Kind: kind})
+	hive.SetNamespace(namespace)
+	hive.SetName(name)
+	_ = unstructured.SetNestedField(hive.Object, secretName, "spec", "platform", "aws", "credentialsSecretRef", "name")
+	return hive
+}
+
+// TestReconcileChildSecretsHiveReferences verifies that, once opted in, the
+// unlabelled secrets referenced by Hive in Joined namespaces that hold the
+// Provider secret's credentials receive the rotation.
+func TestReconcileChildSecretsHiveReferences(t *testing.T) {
+
+	for _, tc := range []struct{ optIn, namespaceScoped bool }{{false, false}, {true, false}, {true, true}} {
+		optIn := tc.optIn
+		cps := getCPSecret()
+		cps.ObjectMeta.Labels = map[string]string{
+			CredentialLabel:   "",
+			ProviderTypeLabel: "ans",
+		}
+		if optIn {
+			cps.ObjectMeta.Annotations = map[string]string{DiscoverHiveReferencesAnnotation: "true"}
+		}
+
+		newReferenced := func(namespace, name string) *corev1.Secret {
+			referenced := getCPSecret()
+			referenced.ObjectMeta.Namespace = namespace
+			referenced.ObjectMeta.Name = name
+			return &referenced
+		}
+		deployed := newReferenced(ClusterNamespace1, "cluster1-aws-creds")
+		unrelated := newReferenced(ClusterNamespace1, "unrelated-creds")
+		unrelated.Data[TOKEN] = []byte("another-account")
+		notJoined := newReferenced(ClusterNamespace2, "cluster2-aws-creds")
+
+		c := clientfake.NewClientBuilder().WithObjects(&cps, deployed, unrelated, notJoined,
+			newManagedCluster(ClusterNamespace1, true), newManagedCluster(ClusterNamespace2, false),
+			newHiveResource("ClusterDeployment", ClusterNamespace1, "cluster1", "cluster1-aws-creds"),
+			newHiveResource("ClusterDeployment", ClusterNamespace1, "other", "unrelated-creds"),
+			newHiveResource("ClusterDeployment", ClusterNamespace2, "cluster2", "cluster2-aws-creds")).Build()
+
+		cpsr := GetProviderCredentialSecretReconciler()
+		cpsr.Client = c
+		cpsr.APIReader = c
+		cpsr.NamespaceScoped = tc.namespaceScoped
+
+		// Try #1 initializes the credential-hash, then rotate the token
+		_, err := cpsr.Reconcile(context.Background(), getRequest())
+		assert.Nil(t, err, "Nil, when Cloud Provider secret found, and hash is set")
+
+		cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+		cps.Data[TOKEN] = []byte("rotated-token")
+		cpsr.Update(context.Background(), &cps)
+
+		_, err = cpsr.Reconcile(context.Background(), getRequest())
+		assert.Nil(t, err, "Nil, when Cloud Provider secret found")
+
+		expectedToken := []byte(tokenValue)
+		if optIn {
+			expectedToken = []byte("rotated-token")
+		}
+		got := corev1.Secret{}
+		cpsr.Get(context.Background(), client.ObjectKeyFromObject(deployed), &got)
+		assert.Equal(t, expectedToken, got.Data[TOKEN], "secret referenced by Hive, opted in: %v, namespace-scoped: %v", optIn, tc.namespaceScoped)
+
+		got = corev1.Secret{}
+		cpsr.Get(context.Background(), client.ObjectKeyFromObject(unrelated), &got)
+		assert.Equal(t, []byte("another-account"), got.Data[TOKEN], "A secret holding other credentials is not adopted")
+		assert.NotContains(t, got.Labels, CopiedFromNameLabel)
+
+		got = corev1.Secret{}
+		cpsr.Get(context.Background(), client.ObjectKeyFromObject(notJoined), &got)
+		assert.Equal(t, []byte(tokenValue), got.Data[TOKEN], "A secret outside Joined namespaces is not adopted")
+	}
+}
+
+// TestReconcileManifestWorks verifies that a Provider secret opted in with a
+// cluster selector is delivered by ManifestWork to the selected Joined
+// clusters, and that the ManifestWorks' Applied condition is tracked.
+func TestReconcileManifestWorks(t *testing.T) {
+
+	cps := getCPSecret()
+	cps.ObjectMeta.Labels = map[string]string{
+		CredentialLabel:   "",
+		ProviderTypeLabel: "ans",
+	}
+	cps.ObjectMeta.Annotations = map[string]string{
+		ManifestWorkClusterSelectorAnnotation: "env=prod",
+		ManifestWorkNamespaceAnnotation:       "cloud-credentials",
+	}
+
+	prod := newManagedCluster(ClusterNamespace1, true)
+	prod.SetLabels(map[string]string{"env": "prod"})
+	dev := newManagedCluster(ClusterNamespace2, true)
+	dev.SetLabels(map[string]string{"env": "dev"})
+	notJoined := newManagedCluster("cluster3", false)
+	notJoined.SetLabels(map[string]string{"env": "prod"})
+	// The hub's own ManagedCluster, by name or by label
+	localCluster := newManagedCluster("local-cluster", true)
+	localCluster.SetLabels(map[string]string{"env": "prod"})
+	hub := newManagedCluster("hub", true)
+	hub.SetLabels(map[string]string{"env": "prod", "local-cluster": "true"})
+
+	// The fake client cannot apply types it has no Go struct for, so the
+	// apply of a ManifestWork is emulated: it is created or its spec replaced
+	applies := 0
+	c := clientfake.NewClientBuilder().WithObjects(&cps, prod, dev, notJoined, localCluster, hub).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+				work, ok := obj.(*unstructured.Unstructured)
+				if !ok || patch.Type() != types.ApplyPatchType {
+					return c.Patch(ctx, obj, patch, opts...)
+				}
+				applies++
+				applied := work.DeepCopy()
+				if err := c.Get(ctx, client.ObjectKeyFromObject(work), applied); k8serrors.IsNotFound(err) {
+					return c.Create(ctx, work)
+				} else if err != nil {
+					return err
+				}
+				applied.SetLabels(work.GetLabels())
+				applied.SetAnnotations(work.GetAnnotations())
+				applied.Object["spec"] = work.Object["spec"]
+				if err := c.Update(ctx, applied); err != nil {
+					return err
+				}
+				work.Object = applied.Object
+				return nil
+			},
+		}).Build()
+
+	cpsr := GetProviderCredentialSecretReconciler()
+	cpsr.Client = c
+	cpsr.APIReader = c
+
+	getWork := func(cluster string) (*unstructured.Unstructured, error) {
+		work := &unstructured.Unstructured{}
+		work.SetGroupVersionKind(ManifestWorkGVK)
+		err := c.Get(context.Background(), types.NamespacedName{Namespace: cluster, Name: manifestWorkName(&cps)}, work)
+		return work, err
+	}
+	getStatus := func() string {
+		cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+		return cps.Annotations[ManifestWorkStatusAnnotation]
+	}
+
+	result, err := cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err, "Nil, when the ManifestWorks are applied")
+	assert.Equal(t, manifestWorkRequeue, result.RequeueAfter, "Requeue while the ManifestWork is pending")
+	assert.JSONEq(t, `{"cluster1": "Pending"}`, getStatus())
+
+	work, err := getWork(ClusterNamespace1)
+	assert.Nil(t, err, "Nil, the selected cluster receives a ManifestWork")
+	manifests, _, _ := unstructured.NestedSlice(work.Object, "spec", "workload", "manifests")
+	assert.Len(t, manifests, 1)
+	manifest := manifests[0].(map[string]interface{})
+	assert.Equal(t, "cloud-credentials", manifest["metadata"].(map[string]interface{})["namespace"])
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte(tokenValue)), manifest["data"].(map[string]interface{})[TOKEN])
+
+	_, err = getWork(ClusterNamespace2)
+	assert.True(t, k8serrors.IsNotFound(err), "A cluster that is not selected receives nothing")
+	_, err = getWork("cluster3")
+	assert.True(t, k8serrors.IsNotFound(err), "A cluster that has not Joined receives nothing")
+	_, err = getWork("local-cluster")
+	assert.True(t, k8serrors.IsNotFound(err), "The hub does not receive a copy of the secret over itself")
+	_, err = getWork("hub")
+	assert.True(t, k8serrors.IsNotFound(err), "The hub does not receive a copy of the secret over itself")
+
+	// The work agent reports the ManifestWork as applied
+	_ = unstructured.SetNestedSlice(work.Object, []interface{}{
+		map[string]interface{}{"type": "Applied", "status": "True"},
+	}, "status", "conditions")
+	assert.Nil(t, c.Update(context.Background(), work))
+
+	result, err = cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err, "Nil, when the ManifestWorks are applied")
+	assert.Zero(t, result.RequeueAfter, "No requeue once every ManifestWork is applied")
+	assert.JSONEq(t, `{"cluster1": "Applied"}`, getStatus())
+	assert.Equal(t, 1, applies, "A ManifestWork that is up to date is not applied again")
+
+	// A rotation reaches the ManifestWork
+	cps.Data[TOKEN] = []byte("rotated-token")
+	cpsr.Update(context.Background(), &cps)
+
+	_, err = cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err, "Nil, when the ManifestWorks are applied")
+	work, _ = getWork(ClusterNamespace1)
+	manifests, _, _ = unstructured.NestedSlice(work.Object, "spec", "workload", "manifests")
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("rotated-token")),
+		manifests[0].(map[string]interface{})["data"].(map[string]interface{})[TOKEN])
+	assert.Equal(t, 2, applies, "A rotation applies the ManifestWork")
+
+	// So does a change of the namespace it is delivered to
+	cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+	cps.Annotations[ManifestWorkNamespaceAnnotation] = "other-credentials"
+	cpsr.Update(context.Background(), &cps)
+
+	_, err = cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err, "Nil, when the ManifestWorks are applied")
+	assert.Equal(t, 3, applies, "A change of placement applies the ManifestWork")
+
+	// A cluster that is no longer selected loses its ManifestWork
+	prod.SetLabels(map[string]string{"env": "dev"})
+	assert.Nil(t, c.Update(context.Background(), prod))
+
+	_, err = cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err, "Nil, when the ManifestWorks are applied")
+	_, err = getWork(ClusterNamespace1)
+	assert.True(t, k8serrors.IsNotFound(err), "The ManifestWork of an unselected cluster is deleted")
+	assert.JSONEq(t, `{}`, getStatus())
+}
+
+// newClusterCurator returns an unstructured ClusterCurator whose "action"
+// hooks use the Ansible secret "secretName".
+func newClusterCurator(namespace, name string, secrets map[string]string) *unstructured.Unstructured {
+	curator := &unstructured.Unstructured{}
+	curator.SetGroupVersionKind(ClusterCuratorGVK)
+	curator.SetNamespace(namespace)
+	curator.SetName(name)
+	for action, secretName := range secrets {
+		_ = unstructured.SetNestedField(curator.Object, secretName, "spec", action, "towerAuthSecret")
+	}
+	return curator
+}
+
+// TestReconcileClusterCurators verifies that, once opted in, the Ansible
+// secrets referenced by ClusterCurators receive the rotated host and token,
+// and that the refreshed ClusterCurators are reported.
+func TestReconcileClusterCurators(t *testing.T) {
+
+	cps := getCPSecret()
+	cps.ObjectMeta.Labels = map[string]string{
+		CredentialLabel:   "",
+		ProviderTypeLabel: "ans",
+	}
+	cps.ObjectMeta.Annotations = map[string]string{SyncClusterCuratorsAnnotation: "true"}
+
+	newTowerSecret := func(namespace, name string) *corev1.Secret {
+		tower := getCPSecret()
+		tower.ObjectMeta.Namespace = namespace
+		tower.ObjectMeta.Name = name
+		return &tower
+	}
+	// Copied by hand along with a key of its own
+	install := newTowerSecret(ClusterNamespace1, "toweraccess-install")
+	install.Data["organization"] = []byte("ops")
+	// A labelled copy, updated with the other copies
+	upgrade := newTowerSecret(ClusterNamespace1, "toweraccess-upgrade")
+	upgrade.Labels = map[string]string{CopiedFromNamespaceLabel: CPSNamespace, CopiedFromNameLabel: CPSName}
+	other := newTowerSecret(ClusterNamespace1, "other-tower")
+	other.Data[TOKEN] = []byte("another-tower")
+	notJoined := newTowerSecret(ClusterNamespace2, "toweraccess-install")
+
+	c := clientfake.NewClientBuilder().WithObjects(&cps, install, upgrade, other, notJoined,
+		newManagedCluster(ClusterNamespace1, true), newManagedCluster(ClusterNamespace2, false),
+		newClusterCurator(ClusterNamespace1, "cluster1", map[string]string{
+			"install": "toweraccess-install", "upgrade": "toweraccess-upgrade", "destroy": "toweraccess-install"}),
+		newClusterCurator(ClusterNamespace1, "other", map[string]string{"scale": "other-tower"}),
+		newClusterCurator(ClusterNamespace2, "cluster2", map[string]string{"install": "toweraccess-install"})).Build()
+
+	cpsr := GetProviderCredentialSecretReconciler()
+	cpsr.Client = c
+	cpsr.APIReader = c
+
+	// Try #1 initializes the credential-hash, then rotate the token
+	_, err := cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err, "Nil, when Cloud Provider secret found, and hash is set")
+
+	cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+	cps.Data[TOKEN] = []byte("rotated-token")
+	cpsr.Update(context.Background(), &cps)
+
+	_, err = cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err, "Nil, when Cloud Provider secret found")
+
+	got := corev1.Secret{}
+	cpsr.Get(context.Background(), client.ObjectKeyFromObject(install), &got)
+	assert.Equal(t, []byte("rotated-token"), got.Data[TOKEN], "The referenced secret receives the rotated token")
+	assert.Equal(t, []byte("ops"), got.Data["organization"], "Other keys are kept")
+
+	got = corev1.Secret{}
+	cpsr.Get(context.Background(), client.ObjectKeyFromObject(other), &got)
+	assert.Equal(t, []byte("another-tower"), got.Data[TOKEN], "A secret of another Ansible instance is left alone")
+
+	got = corev1.Secret{}
+	cpsr.Get(context.Background(), client.ObjectKeyFromObject(notJoined), &got)
+	assert.Equal(t, []byte(tokenValue), got.Data[TOKEN], "A secret outside Joined namespaces is left alone")
+
+	cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+	assert.JSONEq(t, `[{"namespace": "cluster1", "name": "cluster1", "secrets": ["toweraccess-install", "toweraccess-upgrade"]}]`,
+		cps.Annotations[RefreshedClusterCuratorsAnnotation])
+
+	fakeRecorder := cpsr.Recorder.(*record.FakeRecorder)
+	close(fakeRecorder.Events)
+	var events []string
+	for e := range fakeRecorder.Events {
+		events = append(events, e)
+	}
+	assert.Equal(t, []string{"Normal " + ClusterCuratorsRefreshedEventReason +
+		" refreshed the Ansible credential of ClusterCurators cluster1/cluster1"}, events)
+}
+
+func TestExtractImportantDataSelectedKeys(t *testing.T) {
+
+	aws := getCopiedSecretForProvider("aws")
+	aws.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "aws"}
+	aws.Data["pullSecret"] = []byte("{}")
+	aws.Data["baseDomain"] = []byte("example.com")
+
+	ans := getCPSecret()
+	ans.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "ans"}
+	ans.Data["organization"] = []byte("ops")
+
+	for name, test := range map[string]struct {
+		secret      corev1.Secret
+		annotations map[string]string
+		keys        []string
+		valid       bool
+	}{
+		"default": {aws, nil, []string{"aws_access_key_id", "aws_secret_access_key"}, true},
+		"include": {aws, map[string]string{PropagateKeysAnnotation: "pullSecret, ssh-privatekey"},
+			[]string{"aws_access_key_id", "aws_secret_access_key", "pullSecret"}, true},
+		"include and exclude": {aws, map[string]string{PropagateKeysAnnotation: "pullSecret,baseDomain", ExcludeKeysAnnotation: "baseDomain"},
+			[]string{"aws_access_key_id", "aws_secret_access_key", "pullSecret"}, true},
+		"include unknown":            {aws, map[string]string{PropagateKeysAnnotation: "pullSecret,awsRegion"}, nil, false},
+		"exclude credential":         {aws, map[string]string{ExcludeKeysAnnotation: "aws_secret_access_key"}, nil, false},
+		"exclude ansible key":        {ans, map[string]string{ExcludeKeysAnnotation: "organization"}, []string{HOST, TOKEN}, true},
+		"exclude ansible credential": {ans, map[string]string{ExcludeKeysAnnotation: TOKEN}, nil, false},
+	} {
+		secret := *test.secret.DeepCopy()
+		secret.Annotations = test.annotations
+
+		data, err := extractImportantData(secret, config.Default())
+		if !test.valid {
+			assert.NotNil(t, err, "%s: Not nil, when the selected keys are invalid", name)
+			continue
+		}
+		assert.Nil(t, err, "%s: Nil, when the selected keys are valid", name)
+		keys := []string{}
+		for key := range data {
+			keys = append(keys, key)
+		}
+		assert.ElementsMatch(t, test.keys, keys, name)
+	}
+	assert.Contains(t, ans.Data, "organization", "Excluding a key leaves the Provider secret untouched")
+}
+
+func TestReconcileChildSecretsSelectedKeys(t *testing.T) {
+
+	cps := getCopiedSecretForProvider("aws")
+	cps.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "aws"}
+	cps.Data["pullSecret"] = []byte("old-pull-secret")
+
+	child := getCopiedSecretForProvider("aws")
+	child.Namespace = ClusterNamespace1
+	child.Labels = map[string]string{CopiedFromNamespaceLabel: CPSNamespace, CopiedFromNameLabel: CPSName}
+
+	c := clientfake.NewClientBuilder().WithObjects(&cps, &child, newManagedCluster(ClusterNamespace1, true)).Build()
+	cpsr := GetProviderCredentialSecretReconciler()
+	cpsr.Client = c
+	cpsr.APIReader = c
+
+	// Try #1 initializes the credential-hash over the access keys only
+	_, err := cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err, "Nil, when Cloud Provider secret found, and hash is set")
+
+	// Selecting the pull secret changes the hash, and it reaches the copy
+	cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+	cps.Annotations[PropagateKeysAnnotation] = "pullSecret"
+	cpsr.Update(context.Background(), &cps)
+
+	_, err = cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err, "Nil, when Cloud Provider secret found")
+
+	got := corev1.Secret{}
+	cpsr.Get(context.Background(), client.ObjectKeyFromObject(&child), &got)
+	assert.Equal(t, []byte("old-pull-secret"), got.Data["pullSecret"])
+
+	// Rotating the pull secret alone now reaches the copy
+	cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+	cps.Data["pullSecret"] = []byte("new-pull-secret")
+	cpsr.Update(context.Background(), &cps)
+
+	_, err = cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err, "Nil, when Cloud Provider secret found")
+
+	cpsr.Get(context.Background(), client.ObjectKeyFromObject(&child), &got)
+	assert.Equal(t, []byte("new-pull-secret"), got.Data["pullSecret"])
+
+	// An invalid selection is reported once and not retried
+	drainEvents(cpsr.Recorder.(*record.FakeRecorder))
+	cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+	cps.Annotations[ExcludeKeysAnnotation] = "aws_secret_access_key"
+	cps.Data["pullSecret"] = []byte("ignored-pull-secret")
+	cpsr.Update(context.Background(), &cps)
+
+	result, err := cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err, "Nil, an invalid selection is not retried")
+	assert.Zero(t, result, "No requeue, until the annotations are fixed")
+	events := drainEvents(cpsr.Recorder.(*record.FakeRecorder))
+	assert.Len(t, events, 1)
+	assert.Contains(t, events[0], "Warning "+InvalidKeysEventReason)
+
+	cpsr.Get(context.Background(), client.ObjectKeyFromObject(&child), &got)
+	assert.Equal(t, []byte("new-pull-secret"), got.Data["pullSecret"], "Nothing is propagated")
+}
+
+// TestExtractImportantDataRHV verifies that ovirt-config.yaml is valid YAML
+// holding the Provider secret's values exactly, whatever they contain.
+func TestExtractImportantDataRHV(t *testing.T) {
+
+	values := map[string]string{
+		"ovirt_url":      "https://rhv.example.com/ovirt-engine/api",
+		"ovirt_username": "admin@internal",
+		"ovirt_password": "'p@ss: #word\"",
+		"ovirt_ca_bundle": "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n" +
+			"-----BEGIN CERTIFICATE-----\nMIIC\n-----END CERTIFICATE-----\n",
+	}
+	data := map[string][]byte{}
+	for key, value := range values {
+		data[key] = []byte(value)
+	}
+	rhv := getCPSecretWithKeys(data)
+	rhv.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "redhatvirtualization"}
+
+	extracted, err := extractImportantData(rhv, config.Default())
+	assert.Nil(t, err, "Nil, when the Provider secret is valid")
+
+	var parsed map[string]string
+	assert.Nil(t, yaml.UnmarshalStrict(extracted["ovirt-config.yaml"], &parsed), "ovirt-config.yaml is valid YAML")
+	assert.Equal(t, values, parsed)
+}
+
+func TestExtractImportantDataTransforms(t *testing.T) {
+
+	ans := getCPSecret()
+	ans.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "ans"}
+
+	cfg := config.Default()
+	cfg.Transforms["ans"] = []transform.Transform{{Key: "tower_host", From: HOST}}
+
+	data, err := extractImportantData(ans, cfg)
+	assert.Nil(t, err, "Nil, when the configured transforms are valid")
+	assert.Equal(t, map[string][]byte{"tower_host": []byte(userValue), TOKEN: []byte(tokenValue)}, data)
+
+	// The annotation adds to the transforms of the provider type
+	ans.Annotations = map[string]string{TransformsAnnotation: `[{"key": "auth.json", "template": "{\"token\": {{ json .token }}}"}]`}
+	data, err = extractImportantData(ans, cfg)
+	assert.Nil(t, err, "Nil, when the annotation is valid")
+	assert.Equal(t, map[string][]byte{
+		"tower_host": []byte(userValue),
+		TOKEN:        []byte(tokenValue),
+		"auth.json":  []byte(`{"token": "` + tokenValue + `"}`),
+	}, data)
+
+	ans.Annotations[TransformsAnnotation] = `[{"key": "auth.json"}]`
+	_, err = extractImportantData(ans, cfg)
+	assert.NotNil(t, err, "Not nil, when the annotation is invalid")
+
+	// Red Hat Virtualization copies keep the ovirt-config.yaml of the defaults
+	rhv := getCPSecret()
+	rhv.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "redhatvirtualization"}
+	rhv.Data = map[string][]byte{"ovirt_url": []byte("https://rhv.example.com"), "ovirt_fqdn": []byte("rhv.example.com")}
+	rhv.Annotations = map[string]string{
+		PropagateKeysAnnotation: "ovirt_fqdn",
+		TransformsAnnotation:    `[{"key": "fqdn", "from": "ovirt_fqdn"}]`,
+	}
+	data, err = extractImportantData(rhv, config.Default())
+	assert.Nil(t, err, "Nil, when the annotation renames a propagated key")
+	assert.Contains(t, data, "ovirt-config.yaml")
+	assert.Equal(t, []byte("rhv.example.com"), data["fqdn"])
+
+	// A rename cannot reach keys the selection leaves out
+	aws := getCopiedSecretForProvider("aws")
+	aws.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "aws"}
+	aws.Data["pullSecret"] = []byte("{}")
+	aws.Annotations = map[string]string{TransformsAnnotation: `[{"key": "pull", "from": "pullSecret"}]`}
+	_, err = extractImportantData(aws, config.Default())
+	assert.True(t, isInvalidKeys(err), "Not nil, when the annotation renames a key that is not propagated")
+
+	ans.Annotations = map[string]string{
+		ExcludeKeysAnnotation: "organization",
+		TransformsAnnotation:  `[{"key": "org", "from": "organization"}]`,
+	}
+	ans.Data["organization"] = []byte("ops")
+	_, err = extractImportantData(ans, cfg)
+	assert.True(t, isInvalidKeys(err), "Not nil, when the annotation renames an excluded key")
+
+	// Nor can a template
+	ans.Annotations = map[string]string{
+		ExcludeKeysAnnotation: "organization",
+		TransformsAnnotation:  `[{"key": "org", "template": "{{ .organization }}"}]`,
+	}
+	data, err = extractImportantData(ans, cfg)
+	assert.Nil(t, err, "Nil, when a template reads an excluded key")
+	assert.Contains(t, data, "org")
+	assert.Empty(t, data["org"], "An excluded key renders as empty")
+	assert.NotContains(t, data, "organization")
+
+	aws.Annotations = map[string]string{TransformsAnnotation: `[{"key": "pull", "template": "{{ .pullSecret }}"}]`}
+	data, err = extractImportantData(aws, config.Default())
+	assert.Nil(t, err, "Nil, when a template reads a key that is not propagated")
+	assert.Contains(t, data, "pull")
+	assert.Empty(t, data["pull"], "A key that is not propagated renders as empty")
+}
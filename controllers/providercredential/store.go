@@ -0,0 +1,132 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package providercredential
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/stolostron/provider-credential-controller/pkg/config"
+	"github.com/stolostron/provider-credential-controller/pkg/source"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// CredentialSourceAnnotation points a Provider secret at the external store
+// holding its credential, for example vault://secret/aws/prod. The keys read
+// from the store replace those of the secret, which can keep the keys that
+// are not secret, such as baseDomain. The store is polled, and a change is a
+// rotation propagated like a change of the secret.
+const CredentialSourceAnnotation = "cluster.open-cluster-management.io/credential-source"
+
+// CredentialSourceFailedEventReason is the Warning Event reason recorded on
+// a Provider secret whose credential could not be read from its store.
+const CredentialSourceFailedEventReason = "CredentialSourceFailed"
+
+// CredentialSourceDeniedEventReason is the Warning Event reason recorded on
+// a Provider secret referencing a Vault path its namespace may not read.
+const CredentialSourceDeniedEventReason = "CredentialSourceDenied"
+
+// sourceDeniedError reports a reference outside the Vault paths allowed to
+// the namespace of the Provider secret.
+type sourceDeniedError struct {
+	msg string
+}
+
+func (e *sourceDeniedError) Error() string {
+	return e.msg
+}
+
+// isSourceDenied reports whether "err" was returned for a reference the
+// configuration does not allow.
+func isSourceDenied(err error) bool {
+	var denied *sourceDeniedError
+	return errors.As(err, &denied)
+}
+
+// vaultSource holds the Vault client built from the configuration, rebuilt
+// when a hot reload changes it. A client keeps its login token.
+type vaultSource struct {
+	mu     sync.Mutex
+	config config.VaultSource
+	vault  *source.Vault
+}
+
+func (v *vaultSource) get(cfg *config.VaultSource) (*source.Vault, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.vault == nil || !reflect.DeepEqual(v.config, *cfg) {
+		vault, err := source.NewVault(source.VaultOptions{
+			Address:   cfg.Address,
+			KVVersion: cfg.KVVersion,
+			TokenFile: cfg.TokenFile,
+			Role:      cfg.Role,
+			AuthMount: cfg.AuthMount,
+		}, cfg.CAFile, cfg.Timeout.Duration)
+		if err != nil {
+			return nil, err
+		}
+		v.vault, v.config = vault, *cfg
+	}
+	return v.vault, nil
+}
+
+// source returns the store of "scheme" references: the one plugged into the
+// reconciler, else the configured built-in store.
+func (r *ProviderCredentialSecretReconciler) source(scheme string, cfg *config.Configuration) (source.Source, error) {
+	if store, ok := r.Sources[scheme]; ok {
+		return store, nil
+	}
+	if scheme == source.VaultScheme && cfg.Sources.Vault != nil {
+		return r.vault.get(cfg.Sources.Vault)
+	}
+	return nil, fmt.Errorf("no %s store is configured", scheme)
+}
+
+// readSource replaces the keys of the Provider secret "secret", in memory,
+// with those read from the store its CredentialSourceAnnotation points at.
+// It returns when to read the store again, or 0 when "secret" does not use
+// a store. A Vault path its namespace may not read is refused with an error
+// satisfying isSourceDenied.
+func (r *ProviderCredentialSecretReconciler) readSource(ctx context.Context, secret *corev1.Secret, cfg *config.Configuration) (time.Duration, error) {
+	value, ok := secret.Annotations[CredentialSourceAnnotation]
+	if !ok {
+		return 0, nil
+	}
+	ref, err := source.ParseRef(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", CredentialSourceAnnotation, err)
+	}
+	store, err := r.source(ref.Scheme, cfg)
+	if err != nil {
+		return 0, err
+	}
+	// The built-in Vault store reads with the controller's identity
+	if _, plugged := r.Sources[ref.Scheme]; !plugged && ref.Scheme == source.VaultScheme &&
+		!cfg.Sources.Vault.Allows(secret.Namespace, ref.Path) {
+		return 0, &sourceDeniedError{fmt.Sprintf("%s is not in the sources.vault.allowedPaths of namespace %s", ref, secret.Namespace)}
+	}
+	values, err := store.Read(ctx, ref.Path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", ref, err)
+	}
+
+	data := map[string][]byte{}
+	for key, value := range secret.Data {
+		data[key] = value
+	}
+	for key, value := range values.Data {
+		data[key] = value
+	}
+	secret.Data = data
+
+	poll := cfg.Sources.PollInterval.Duration
+	if values.TTL > 0 && values.TTL < poll {
+		poll = values.TTL
+	}
+	return poll, nil
+}
@@ -0,0 +1,165 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package providercredential
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stolostron/provider-credential-controller/pkg/config"
+	"github.com/stolostron/provider-credential-controller/pkg/source"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	clientfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// sourceStub is an in-process external store.
+type sourceStub struct {
+	values map[string]*source.Values
+	err    error
+}
+
+func (s *sourceStub) Read(ctx context.Context, path string) (*source.Values, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	values, ok := s.values[path]
+	if !ok {
+		return nil, errors.New(path + " not found")
+	}
+	return values, nil
+}
+
+func TestReconcileCredentialSource(t *testing.T) {
+
+	stub := &sourceStub{values: map[string]*source.Values{
+		"secret/ans": {Data: map[string][]byte{TOKEN: []byte("from-vault")}, Version: "1"},
+	}}
+
+	// The secret only keeps the host, the token is in the store
+	cps := getCPSecretWithKeys(map[string][]byte{HOST: []byte(userValue)})
+	cps.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "ans"}
+	cps.Annotations = map[string]string{CredentialSourceAnnotation: "vault://secret/ans"}
+
+	childSecret := getCPSecretWithKeys(map[string][]byte{HOST: []byte(userValue), TOKEN: []byte("from-vault")})
+	childSecret.Name = "child"
+	childSecret.Namespace = ClusterNamespace1
+	childSecret.Labels = map[string]string{
+		CopiedFromNamespaceLabel: CPSNamespace,
+		CopiedFromNameLabel:      CPSName,
+	}
+
+	cpsr := GetProviderCredentialSecretReconciler()
+	cpsr.Client = clientfake.NewFakeClient(&cps, &childSecret)
+	cpsr.APIReader = clientfake.NewFakeClient(&childSecret, newManagedCluster(ClusterNamespace1, true))
+	cpsr.Sources = map[string]source.Source{source.VaultScheme: stub}
+
+	// The hash covers the stored credential, and the store is polled
+	result, err := cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err)
+	assert.Equal(t, 5*time.Minute, result.RequeueAfter)
+
+	expectedHash, err := DataHash(childSecret.Data)
+	assert.Nil(t, err)
+	cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+	assert.Equal(t, expectedHash, cps.Annotations[CredentialHash])
+	assert.Nil(t, cps.Data[TOKEN], "The stored credential is not written to the Provider secret")
+
+	// A change in the store is propagated like a rotation, at the pace of
+	// its lease
+	stub.values["secret/ans"] = &source.Values{Data: map[string][]byte{TOKEN: []byte("rotated-in-vault")}, Version: "2", TTL: time.Minute}
+
+	result, err = cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, result.RequeueAfter)
+
+	var child corev1.Secret
+	cpsr.Get(context.Background(), client.ObjectKeyFromObject(&childSecret), &child)
+	assert.Equal(t, []byte("rotated-in-vault"), child.Data[TOKEN])
+	assert.Equal(t, []byte(userValue), child.Data[HOST])
+
+	// Nothing is propagated while the store cannot be read
+	stub.err = errors.New("permission denied")
+	_, err = cpsr.Reconcile(context.Background(), getRequest())
+	assert.NotNil(t, err, "Not nil, when the store cannot be read")
+
+	events := drainEvents(cpsr.Recorder.(*record.FakeRecorder))
+	assert.Len(t, events, 1)
+	assert.True(t, strings.HasPrefix(events[0], corev1.EventTypeWarning+" "+CredentialSourceFailedEventReason), events[0])
+}
+
+func TestReconcileCredentialSourceVault(t *testing.T) {
+
+	// A stand-in Vault serving a KV version 2 secret
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" || r.URL.Path != "/v1/secret/data/aws/prod" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors": ["permission denied"]}`))
+			return
+		}
+		w.Write([]byte(`{"data": {"data": {"aws_access_key_id": "AKID", "aws_secret_access_key": "secret"}, "metadata": {"version": 1}}}`))
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("token"), 0600))
+
+	cfg := config.Default()
+	cfg.Sources.Vault = &config.VaultSource{Address: server.URL, KVVersion: 2, TokenFile: tokenFile,
+		AllowedPaths: map[string][]string{CPSNamespace: {"secret/aws"}}}
+
+	aws := getCPSecretWithKeys(map[string][]byte{})
+	aws.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "aws"}
+	aws.Annotations = map[string]string{CredentialSourceAnnotation: "vault://secret/aws/prod"}
+
+	cpsr := GetProviderCredentialSecretReconciler()
+	cpsr.Client = clientfake.NewFakeClient(&aws)
+	cpsr.Config = config.NewStaticStore(cfg)
+
+	_, err := cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err)
+
+	expectedHash, err := DataHash(map[string][]byte{"aws_access_key_id": []byte("AKID"), "aws_secret_access_key": []byte("secret")})
+	assert.Nil(t, err)
+	cpsr.Get(context.Background(), getRequest().NamespacedName, &aws)
+	assert.Equal(t, expectedHash, aws.Annotations[CredentialHash])
+
+	// A path outside those allowed to the namespace is refused, and not read
+	drainEvents(cpsr.Recorder.(*record.FakeRecorder))
+	for _, path := range []string{"vault://secret/awsx/prod", "vault://secret/aws/../team-b/prod"} {
+		aws.Annotations[CredentialSourceAnnotation] = path
+		assert.Nil(t, cpsr.Update(context.Background(), &aws))
+		result, err := cpsr.Reconcile(context.Background(), getRequest())
+		assert.Nil(t, err, "Nil, a refused source is not retried with backoff")
+		assert.Equal(t, cfg.Sources.PollInterval.Duration, result.RequeueAfter, "Checked again as the allowed paths may be reloaded")
+
+		events := drainEvents(cpsr.Recorder.(*record.FakeRecorder))
+		assert.Len(t, events, 1)
+		assert.True(t, strings.HasPrefix(events[0], corev1.EventTypeWarning+" "+CredentialSourceDeniedEventReason), events[0])
+	}
+
+	// So are the paths of a namespace without allowed paths
+	cfg.Sources.Vault.AllowedPaths = map[string][]string{"team-b": {"secret/aws"}}
+	aws.Annotations[CredentialSourceAnnotation] = "vault://secret/aws/prod"
+	assert.Nil(t, cpsr.Update(context.Background(), &aws))
+	_, err = cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err)
+	events := drainEvents(cpsr.Recorder.(*record.FakeRecorder))
+	assert.Len(t, events, 1)
+	assert.Contains(t, events[0], CredentialSourceDeniedEventReason)
+
+	// References to stores that are not configured fail
+	aws.Annotations[CredentialSourceAnnotation] = "conjur://secret/aws/prod"
+	assert.Nil(t, cpsr.Update(context.Background(), &aws))
+	_, err = cpsr.Reconcile(context.Background(), getRequest())
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,62 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package providercredential
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/stolostron/provider-credential-controller/pkg/config"
+	"github.com/stolostron/provider-credential-controller/pkg/verify"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Event reasons recorded on a Provider secret whose changed credential was
+// verified.
+const (
+	CredentialVerifiedEventReason           = "CredentialVerified"
+	CredentialVerificationFailedEventReason = "CredentialVerificationFailed"
+)
+
+// verificationRequeue is how long a credential that failed verification
+// waits before it is verified again, unless the Provider secret changes.
+const verificationRequeue = 5 * time.Minute
+
+// verifier returns the Verifier of the "credType" Provider secrets: the one
+// plugged into the reconciler, else the built-in verifier when the
+// configuration enables it, else nil.
+func (r *ProviderCredentialSecretReconciler) verifier(credType string, cfg *config.Configuration) verify.Verifier {
+	if verifier, ok := r.Verifiers[credType]; ok {
+		return verifier
+	}
+	if !cfg.Verifies(credType) {
+		return nil
+	}
+	return verify.BuiltIn(credType, verify.Options{
+		Endpoint: cfg.Verification.Endpoints[credType],
+		Client:   &http.Client{Timeout: cfg.Verification.Timeout.Duration},
+	})
+}
+
+// verifyCredential verifies the credential of the Provider secret "secret"
+// and records the outcome as an Event. The credential is verified as it is
+// stored in the Provider secret, before its keys are selected and reshaped.
+func (r *ProviderCredentialSecretReconciler) verifyCredential(ctx context.Context, secret *corev1.Secret, cfg *config.Configuration) error {
+	verifier := r.verifier(secret.Labels[ProviderTypeLabel], cfg)
+	if verifier == nil {
+		return nil
+	}
+
+	if err := verifier.Verify(ctx, secret.Data); err != nil {
+		if r.Recorder != nil {
+			r.Recorder.Event(secret, corev1.EventTypeWarning, CredentialVerificationFailedEventReason,
+				"the changed credential was not propagated: "+err.Error())
+		}
+		return err
+	}
+	if r.Recorder != nil {
+		r.Recorder.Event(secret, corev1.EventTypeNormal, CredentialVerifiedEventReason, "the changed credential was accepted by its provider")
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package providercredential
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stolostron/provider-credential-controller/pkg/config"
+	"github.com/stolostron/provider-credential-controller/pkg/verify"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	clientfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestReconcileVerification(t *testing.T) {
+
+	cps := getCPSecret()
+	cps.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "ans"}
+	hash, err := CredentialDataHash(cps, config.Default())
+	assert.Nil(t, err)
+	cps.Annotations = map[string]string{CredentialHash: hash}
+
+	childSecret := getCPSecret()
+	childSecret.Name = "child"
+	childSecret.Namespace = ClusterNamespace1
+	childSecret.Labels = map[string]string{
+		CopiedFromNamespaceLabel: CPSNamespace,
+		CopiedFromNameLabel:      CPSName,
+	}
+
+	// A stand-in Ansible Tower accepting a single token
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer rotated" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"count": 1}`))
+	}))
+	defer server.Close()
+
+	cfg := config.Default()
+	cfg.Verification.ProviderTypes = []string{"ans"}
+	cfg.Verification.Endpoints = map[string]string{"ans": server.URL}
+
+	cpsr := GetProviderCredentialSecretReconciler()
+	cpsr.Client = clientfake.NewFakeClient(&cps, &childSecret)
+	cpsr.Config = config.NewStaticStore(cfg)
+	fakeRecorder := cpsr.Recorder.(*record.FakeRecorder)
+
+	// A mistyped token is not propagated
+	cps.Data[TOKEN] = []byte("typo")
+	assert.Nil(t, cpsr.Update(context.Background(), &cps))
+	cpsr.APIReader = clientfake.NewFakeClient(&cps, &childSecret, newManagedCluster(ClusterNamespace1, true))
+
+	result, err := cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err)
+	assert.Equal(t, verificationRequeue, result.RequeueAfter, "The credential is verified again later")
+
+	events := drainEvents(fakeRecorder)
+	assert.Len(t, events, 1)
+	assert.True(t, strings.HasPrefix(events[0], corev1.EventTypeWarning+" "+CredentialVerificationFailedEventReason), events[0])
+
+	var child corev1.Secret
+	cpsr.Get(context.Background(), client.ObjectKeyFromObject(&childSecret), &child)
+	assert.Equal(t, []byte(tokenValue), child.Data[TOKEN], "The copy keeps the previous credential")
+	cpsr.Get(context.Background(), getRequest().NamespacedName, &cps)
+	assert.Equal(t, hash, cps.Annotations[CredentialHash], "The hash still matches the copies")
+
+	// The corrected token is propagated
+	cps.Data[TOKEN] = []byte("rotated")
+	assert.Nil(t, cpsr.Update(context.Background(), &cps))
+	cpsr.APIReader = clientfake.NewFakeClient(&cps, &childSecret, newManagedCluster(ClusterNamespace1, true))
+
+	result, err = cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err)
+	assert.Zero(t, result.RequeueAfter)
+
+	events = drainEvents(fakeRecorder)
+	assert.Len(t, events, 1)
+	assert.True(t, strings.HasPrefix(events[0], corev1.EventTypeNormal+" "+CredentialVerifiedEventReason), events[0])
+
+	cpsr.Get(context.Background(), client.ObjectKeyFromObject(&childSecret), &child)
+	assert.Equal(t, []byte("rotated"), child.Data[TOKEN])
+
+	// An unchanged credential is not verified again
+	_, err = cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err)
+	assert.Empty(t, drainEvents(fakeRecorder))
+}
+
+func TestReconcilePluggedVerifier(t *testing.T) {
+
+	ost := getCopiedSecretForProvider("ost")
+	ost.Labels = map[string]string{CredentialLabel: "", ProviderTypeLabel: "ost"}
+
+	verified := map[string][]byte{}
+	cpsr := GetProviderCredentialSecretReconciler()
+	cpsr.Client = clientfake.NewFakeClient(&ost)
+	cpsr.Verifiers = map[string]verify.Verifier{
+		"ost": verify.Func(func(ctx context.Context, data map[string][]byte) error {
+			verified = data
+			return errors.New("cloud is not reachable")
+		}),
+	}
+
+	result, err := cpsr.Reconcile(context.Background(), getRequest())
+	assert.Nil(t, err)
+	assert.Equal(t, verificationRequeue, result.RequeueAfter)
+	assert.Equal(t, ost.Data, verified, "The Provider secret's data is verified")
+
+	cpsr.Get(context.Background(), getRequest().NamespacedName, &ost)
+	assert.Empty(t, ost.Annotations[CredentialHash], "An unverified credential is not hashed")
+}
+
+// TestVerifierVSphereCACertificate verifies that the verifier of the
+// reconciler trusts a vCenter signed by the cacertificate of the secret.
+func TestVerifierVSphereCACertificate(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`"session"`))
+	}))
+	defer server.Close()
+
+	cfg := config.Default()
+	cfg.Verification.ProviderTypes = []string{"vmw"}
+	cfg.Verification.Endpoints = map[string]string{"vmw": server.URL}
+
+	data := map[string][]byte{
+		"vCenter":  []byte("vcenter.example.com"),
+		"username": []byte("administrator@vsphere.local"),
+		"password": []byte("secret"),
+	}
+	verifier := GetProviderCredentialSecretReconciler().verifier("vmw", cfg)
+	assert.NotNil(t, verifier.Verify(context.Background(), data), "Not nil, when the vCenter's CA is not trusted")
+
+	data["cacertificate"] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.Nil(t, verifier.Verify(context.Background(), data), "Nil, when cacertificate signs the vCenter's certificate")
+}
@@ -0,0 +1,118 @@
+#!/bin/bash
+# Copyright Contributors to the Open Cluster Management project.
+#
+# Generates the Role/RoleBinding pairs used when the controller runs
+# namespace-scoped (--watch-namespaces). Provider secret namespaces get
+# read/watch/update access, ManagedCluster namespaces get the access needed
+# to update copies, and the controller namespace gets leader election.
+#
+# Usage:
+#   ./generate-rbac.sh -c open-cluster-management -w providers,team-a \
+#       -m cluster1,cluster2 > rbac.yaml
+#
+# Re-run it whenever a ManagedCluster is added, or copies in the new
+# cluster namespace will not receive rotated credentials.
+
+set -euo pipefail
+
+CONTROLLER_NAMESPACE=open-cluster-management
+WATCH_NAMESPACES=""
+CLUSTER_NAMESPACES=""
+
+while getopts "c:w:m:" opt; do
+  case ${opt} in
+    c) CONTROLLER_NAMESPACE=${OPTARG} ;;
+    w) WATCH_NAMESPACES=${OPTARG} ;;
+    m) CLUSTER_NAMESPACES=${OPTARG} ;;
+    *) echo "usage: $0 [-c controller-namespace] -w watch-ns[,watch-ns] [-m cluster-ns[,cluster-ns]]" >&2; exit 1 ;;
+  esac
+done
+
+if [ -z "${WATCH_NAMESPACES}" ]; then
+  echo "at least one watch namespace (-w) is required" >&2
+  exit 1
+fi
+
+role() {
+  local namespace=$1 name=$2 verbs=$3 extra=${4:-}
+  cat <<YAML
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: ${name}
+  namespace: ${namespace}
+rules:
+- apiGroups: [""]
+  resources: ["secrets"]
+  verbs: [${verbs}]
+- apiGroups: [""]
+  resources: ["events"]
+  verbs: ["create","patch"]${extra}
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: ${name}
+  namespace: ${namespace}
+subjects:
+- kind: ServiceAccount
+  name: provider-credential-controller
+  namespace: ${CONTROLLER_NAMESPACE}
+roleRef:
+  kind: Role
+  name: ${name}
+  apiGroup: rbac.authorization.k8s.io
+YAML
+}
+
+cat <<YAML
+# Generated by deploy/namespaced/generate-rbac.sh -c ${CONTROLLER_NAMESPACE} -w ${WATCH_NAMESPACES} -m ${CLUSTER_NAMESPACES}
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: provider-credential-controller-leader-election
+  namespace: ${CONTROLLER_NAMESPACE}
+rules:
+- apiGroups: ["", "coordination.k8s.io"]
+  resources: ["configmaps","leases"]
+  verbs: ["get","list","watch","create","update","patch","delete"]
+- apiGroups: [""]
+  resources: ["events"]
+  verbs: ["create","patch"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: provider-credential-controller-leader-election
+  namespace: ${CONTROLLER_NAMESPACE}
+subjects:
+- kind: ServiceAccount
+  name: provider-credential-controller
+  namespace: ${CONTROLLER_NAMESPACE}
+roleRef:
+  kind: Role
+  name: provider-credential-controller-leader-election
+  apiGroup: rbac.authorization.k8s.io
+YAML
+
+for namespace in ${WATCH_NAMESPACES//,/ }; do
+  role "${namespace}" provider-credential-controller-provider '"get","list","watch","create","update","patch","delete"'
+done
+
+for namespace in ${CLUSTER_NAMESPACES//,/ }; do
+  # Hive resources name the secrets adopted with discover-hive-references,
+  # ClusterCurators those refreshed with sync-cluster-curators, and
+  # ManifestWorks deliver credentials to the managed clusters
+  role "${namespace}" provider-credential-controller-copies '"get","list","update","patch"' '
+- apiGroups: ["hive.openshift.io"]
+  resources: ["clusterdeployments"]
+  verbs: ["list"]
+- apiGroups: ["cluster.open-cluster-management.io"]
+  resources: ["clustercurators"]
+  verbs: ["list"]
+- apiGroups: ["work.open-cluster-management.io"]
+  resources: ["manifestworks"]
+  verbs: ["get","list","create","patch","delete"]'
+done
@@ -0,0 +1,48 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+// Package apply writes secrets with server-side apply, so the controllers
+// only own the credential keys, labels and annotations they set and coexist
+// with the console and GitOps tools managing the same secrets.
+package apply
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// NewSecret returns an empty apply configuration for the secret
+// "namespace/name". When "resourceVersion" is set, the apply fails with a
+// Conflict if the secret was modified since it was read.
+func NewSecret(namespace, name, resourceVersion string) *corev1.Secret {
+	return &corev1.Secret{
+		TypeMeta: v1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: v1.ObjectMeta{
+			Namespace:       namespace,
+			Name:            name,
+			ResourceVersion: resourceVersion,
+		},
+	}
+}
+
+// Secret server-side applies "secret" as "fieldManager", taking ownership of
+// the fields it sets from any other manager. Fields previously applied by
+// "fieldManager" and no longer set are removed.
+func Secret(ctx context.Context, c client.Client, fieldManager string, secret *corev1.Secret) error {
+	return c.Patch(ctx, secret, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership)
+}
+
+// RetryOnConflict runs "fn" until it does not fail with a Conflict, backing
+// off between attempts as retry.DefaultRetry does. "attempt" is 0 on the
+// first run, so later runs know to read the object again first.
+func RetryOnConflict(fn func(attempt int) error) error {
+	attempt := 0
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		err := fn(attempt)
+		attempt++
+		return err
+	})
+}
@@ -0,0 +1,441 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/stolostron/provider-credential-controller/pkg/transform"
+	"github.com/stolostron/provider-credential-controller/pkg/verify"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/time/rate"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/yaml"
+)
+
+// APIVersion and Kind identify the configuration file format. Bump the
+// version when a field changes meaning; new optional fields do not need it.
+const (
+	APIVersion = "provider-credential-controller.open-cluster-management.io/v1alpha1"
+	Kind       = "ControllerConfiguration"
+)
+
+// SupportedProviderTypes are the cluster.open-cluster-management.io/type
+// values the provider credential controller knows how to propagate.
+var SupportedProviderTypes = []string{"ans", "aws", "gcp", "vmw", "azr", "ost", "redhatvirtualization"}
+
+// Configuration is the versioned, file-based controller configuration. It
+// is usually mounted from a ConfigMap.
+//
+// Concurrency and RateLimit size the controllers' work queues when they are
+// created and take effect only on restart. Every other field is re-read on
+// each reconcile and is applied by a hot reload.
+type Configuration struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	// ProviderTypes lists the provider types whose secrets are reconciled.
+	ProviderTypes []string `json:"providerTypes,omitempty"`
+
+	Concurrency  Concurrency  `json:"concurrency,omitempty"`
+	RateLimit    RateLimit    `json:"rateLimit,omitempty"`
+	Gating       Gating       `json:"gating,omitempty"`
+	GitOps       GitOps       `json:"gitOps,omitempty"`
+	Expiry       Expiry       `json:"expiry,omitempty"`
+	Verification Verification `json:"verification,omitempty"`
+	Sources      Sources      `json:"sources,omitempty"`
+	Logging      Logging      `json:"logging,omitempty"`
+
+	// Transforms reshape, by provider type, the data propagated to copies.
+	// A provider type that is not listed keeps its default transforms.
+	Transforms map[string][]transform.Transform `json:"transforms,omitempty"`
+}
+
+// Concurrency configures how many reconciles each controller runs at once.
+type Concurrency struct {
+	MaxConcurrentReconciles int `json:"maxConcurrentReconciles,omitempty"`
+}
+
+// RateLimit configures the per-item exponential backoff and the overall
+// token bucket of each controller's work queue.
+type RateLimit struct {
+	BaseDelay metav1.Duration `json:"baseDelay,omitempty"`
+	MaxDelay  metav1.Duration `json:"maxDelay,omitempty"`
+	QPS       float64         `json:"qps,omitempty"`
+	Burst     int             `json:"burst,omitempty"`
+}
+
+// Gating configures which copies may receive rotated credentials.
+type Gating struct {
+	// RequireJoinedManagedCluster only propagates into copies whose namespace
+	// is a Joined ManagedCluster. Defaults to true. Setting it to false lets
+	// anyone who can label a secret in any namespace as a copy receive the
+	// rotated credentials; prefer ExemptNamespaces.
+	RequireJoinedManagedCluster *bool `json:"requireJoinedManagedCluster,omitempty"`
+
+	// ExemptNamespaces are trusted to receive copies without being a Joined
+	// ManagedCluster.
+	ExemptNamespaces []string `json:"exemptNamespaces,omitempty"`
+}
+
+// GitOps configures how copies reconciled by GitOps tools such as Argo CD or
+// Flux are recognised. Such copies are never written to, so the controller
+// does not fight the tool over their content.
+type GitOps struct {
+	// FieldManagers are the managedFields managers that mark a copy as owned
+	// by a GitOps tool.
+	FieldManagers []string `json:"fieldManagers,omitempty"`
+
+	// OwnerAPIGroups are the API groups of owner references that mark a copy
+	// as owned by a GitOps tool.
+	OwnerAPIGroups []string `json:"ownerAPIGroups,omitempty"`
+}
+
+// DefaultGitOpsFieldManagers are the managers Argo CD and Flux write with.
+var DefaultGitOpsFieldManagers = []string{"argocd-controller", "argocd-application-controller", "kustomize-controller", "helm-controller"}
+
+// DefaultGitOpsOwnerAPIGroups cover Argo CD, Flux and Sealed Secrets.
+var DefaultGitOpsOwnerAPIGroups = []string{"argoproj.io", "kustomize.toolkit.fluxcd.io", "helm.toolkit.fluxcd.io", "bitnami.com"}
+
+// Expiry configures the rotation reminders raised on Provider secrets.
+type Expiry struct {
+	// MaxAge is the age after which a credential should be rotated. Zero,
+	// the default, disables the age reminder.
+	MaxAge metav1.Duration `json:"maxAge,omitempty"`
+
+	// WarnBefore is how long before a known expiry reminders start.
+	// Defaults to 30 days.
+	WarnBefore metav1.Duration `json:"warnBefore,omitempty"`
+}
+
+// Verification configures the checks rotated credentials must pass before
+// they are propagated.
+type Verification struct {
+	// ProviderTypes lists the provider types whose credentials are verified
+	// by their built-in verifier. Empty, the default, verifies nothing.
+	ProviderTypes []string `json:"providerTypes,omitempty"`
+
+	// Endpoints replace, by provider type, the URL the built-in verifier
+	// calls, for example an STS VPC endpoint or an Azure sovereign cloud.
+	Endpoints map[string]string `json:"endpoints,omitempty"`
+
+	// Timeout bounds each verification. Defaults to 10s.
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+}
+
+// Sources configures the external secret stores a Provider secret may read
+// its credential from with the credential-source annotation.
+type Sources struct {
+	// PollInterval is how often credentials are read again from their store,
+	// unless the store asks for a shorter lease. Defaults to 5m.
+	PollInterval metav1.Duration `json:"pollInterval,omitempty"`
+
+	// Vault enables vault:// references.
+	Vault *VaultSource `json:"vault,omitempty"`
+}
+
+// VaultSource configures the HashiCorp Vault KV store.
+type VaultSource struct {
+	// Address is the URL of the Vault server.
+	Address string `json:"address"`
+
+	// KVVersion is the version of the KV secrets engine, 1 or 2. Defaults
+	// to 2.
+	KVVersion int `json:"kvVersion,omitempty"`
+
+	// TokenFile holds the Vault token, for example written by a Vault
+	// Agent. Set either TokenFile or Role.
+	TokenFile string `json:"tokenFile,omitempty"`
+
+	// Role logs in with the Kubernetes auth method mounted at AuthMount,
+	// which defaults to "kubernetes", using the controller's service account.
+	Role      string `json:"role,omitempty"`
+	AuthMount string `json:"authMount,omitempty"`
+
+	// CAFile is the CA bundle trusted for the server's certificate.
+	CAFile string `json:"caFile,omitempty"`
+
+	// Timeout bounds each request. Defaults to 10s.
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+
+	// AllowedPaths maps each namespace to the path prefixes its Provider
+	// secrets may read, for example {"team-a": ["secret/team-a"]}. Vault is
+	// read with the controller's identity, so references outside the
+	// prefixes of the secret's namespace are refused.
+	AllowedPaths map[string][]string `json:"allowedPaths,omitempty"`
+}
+
+// Allows returns true if Provider secrets in "namespace" may read the Vault
+// "path", which must be within one of the namespace's AllowedPaths.
+func (v *VaultSource) Allows(namespace, path string) bool {
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	for _, prefix := range v.AllowedPaths[namespace] {
+		prefix = strings.Trim(prefix, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// RHVConfigTemplate renders the ovirt-config.yaml key of Red Hat
+// Virtualization copies from the Provider secret's ovirt_* keys, in the
+// layout of earlier releases unless a value needs the YAML encoder.
+const RHVConfigTemplate = `{{ ovirtConfig . }}`
+
+// DefaultTransforms are the transforms every configuration starts with. The
+// transforms configured for a provider type are applied after them.
+var DefaultTransforms = map[string][]transform.Transform{
+	"redhatvirtualization": {{Key: "ovirt-config.yaml", Template: RHVConfigTemplate}},
+}
+
+// Logging configures the controller log level: debug, info, warn or error.
+type Logging struct {
+	Level string `json:"level,omitempty"`
+}
+
+// Default returns the configuration used when no file is provided.
+func Default() *Configuration {
+	cfg := &Configuration{APIVersion: APIVersion, Kind: Kind}
+	cfg.setDefaults()
+	return cfg
+}
+
+// Load reads, defaults and validates the configuration file at "path". An
+// empty path, or a path that does not exist (an optional ConfigMap that has
+// not been created), yields the defaults.
+func Load(path string) (*Configuration, error) {
+	if path == "" {
+		return Default(), nil
+	}
+
+	data, err := os.ReadFile(path) // #nosec G304 -- path is an operator supplied flag
+	if errors.Is(err, os.ErrNotExist) {
+		return Default(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse decodes, defaults and validates a configuration document. Unknown
+// fields are rejected so that typos do not silently fall back to defaults.
+func Parse(data []byte) (*Configuration, error) {
+	cfg := &Configuration{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode configuration: %w", err)
+	}
+	cfg.setDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Configuration) setDefaults() {
+	if c.ProviderTypes == nil {
+		c.ProviderTypes = append([]string{}, SupportedProviderTypes...)
+	}
+	if c.Concurrency.MaxConcurrentReconciles == 0 {
+		c.Concurrency.MaxConcurrentReconciles = 1
+	}
+	if c.RateLimit.BaseDelay.Duration == 0 {
+		c.RateLimit.BaseDelay.Duration = 5 * time.Millisecond
+	}
+	if c.RateLimit.MaxDelay.Duration == 0 {
+		c.RateLimit.MaxDelay.Duration = 1000 * time.Second
+	}
+	if c.RateLimit.QPS == 0 {
+		c.RateLimit.QPS = 10
+	}
+	if c.RateLimit.Burst == 0 {
+		c.RateLimit.Burst = 100
+	}
+	if c.Gating.RequireJoinedManagedCluster == nil {
+		requireJoined := true
+		c.Gating.RequireJoinedManagedCluster = &requireJoined
+	}
+	if c.GitOps.FieldManagers == nil {
+		c.GitOps.FieldManagers = append([]string{}, DefaultGitOpsFieldManagers...)
+	}
+	if c.GitOps.OwnerAPIGroups == nil {
+		c.GitOps.OwnerAPIGroups = append([]string{}, DefaultGitOpsOwnerAPIGroups...)
+	}
+	if c.Expiry.WarnBefore.Duration == 0 {
+		c.Expiry.WarnBefore.Duration = 30 * 24 * time.Hour
+	}
+	if c.Verification.Timeout.Duration == 0 {
+		c.Verification.Timeout.Duration = verify.DefaultTimeout
+	}
+	if c.Sources.PollInterval.Duration == 0 {
+		c.Sources.PollInterval.Duration = 5 * time.Minute
+	}
+	if c.Sources.Vault != nil {
+		if c.Sources.Vault.KVVersion == 0 {
+			c.Sources.Vault.KVVersion = 2
+		}
+		if c.Sources.Vault.Timeout.Duration == 0 {
+			c.Sources.Vault.Timeout.Duration = 10 * time.Second
+		}
+	}
+	if c.Transforms == nil {
+		c.Transforms = map[string][]transform.Transform{}
+	}
+	for providerType, transforms := range DefaultTransforms {
+		c.Transforms[providerType] = append(append([]transform.Transform{}, transforms...), c.Transforms[providerType]...)
+	}
+	if c.Logging.Level == "" {
+		c.Logging.Level = "info"
+	}
+}
+
+// Validate reports the first invalid setting in the configuration.
+func (c *Configuration) Validate() error {
+	if c.APIVersion != APIVersion {
+		return fmt.Errorf("apiVersion must be %q, got %q", APIVersion, c.APIVersion)
+	}
+	if c.Kind != Kind {
+		return fmt.Errorf("kind must be %q, got %q", Kind, c.Kind)
+	}
+	for _, providerType := range c.ProviderTypes {
+		if !contains(SupportedProviderTypes, providerType) {
+			return fmt.Errorf("providerTypes: %q is not supported", providerType)
+		}
+	}
+	if c.Concurrency.MaxConcurrentReconciles < 1 {
+		return errors.New("concurrency.maxConcurrentReconciles must be at least 1")
+	}
+	if c.RateLimit.BaseDelay.Duration < 0 || c.RateLimit.MaxDelay.Duration < c.RateLimit.BaseDelay.Duration {
+		return errors.New("rateLimit.maxDelay must be greater than or equal to rateLimit.baseDelay")
+	}
+	if c.RateLimit.QPS < 0 || c.RateLimit.Burst < 0 {
+		return errors.New("rateLimit.qps and rateLimit.burst must not be negative")
+	}
+	if c.Expiry.MaxAge.Duration < 0 || c.Expiry.WarnBefore.Duration < 0 {
+		return errors.New("expiry.maxAge and expiry.warnBefore must not be negative")
+	}
+	for _, providerType := range c.Verification.ProviderTypes {
+		if !verify.HasBuiltIn(providerType) {
+			return fmt.Errorf("verification.providerTypes: %q has no built-in verifier", providerType)
+		}
+	}
+	for providerType, endpoint := range c.Verification.Endpoints {
+		if !verify.HasBuiltIn(providerType) {
+			return fmt.Errorf("verification.endpoints: %q has no built-in verifier", providerType)
+		}
+		if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("verification.endpoints.%s: %q is not an http or https URL", providerType, endpoint)
+		}
+	}
+	if c.Verification.Timeout.Duration < 0 {
+		return errors.New("verification.timeout must not be negative")
+	}
+	if c.Sources.PollInterval.Duration < 0 {
+		return errors.New("sources.pollInterval must not be negative")
+	}
+	if vault := c.Sources.Vault; vault != nil {
+		if u, err := url.Parse(vault.Address); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("sources.vault.address: %q is not an http or https URL", vault.Address)
+		}
+		if vault.KVVersion != 1 && vault.KVVersion != 2 {
+			return errors.New("sources.vault.kvVersion must be 1 or 2")
+		}
+		if (vault.TokenFile == "") == (vault.Role == "") {
+			return errors.New("sources.vault: exactly one of tokenFile and role must be set")
+		}
+		if vault.Timeout.Duration < 0 {
+			return errors.New("sources.vault.timeout must not be negative")
+		}
+		for namespace, prefixes := range vault.AllowedPaths {
+			for _, prefix := range prefixes {
+				if strings.Trim(prefix, "/") == "" {
+					return fmt.Errorf("sources.vault.allowedPaths.%s: path prefixes must not be empty", namespace)
+				}
+			}
+		}
+	}
+	for providerType, transforms := range c.Transforms {
+		if !contains(SupportedProviderTypes, providerType) {
+			return fmt.Errorf("transforms: %q is not a supported provider type", providerType)
+		}
+		if err := transform.Validate(transforms); err != nil {
+			return fmt.Errorf("transforms.%s: %w", providerType, err)
+		}
+	}
+	if _, err := zapcore.ParseLevel(c.Logging.Level); err != nil {
+		return fmt.Errorf("logging.level: %w", err)
+	}
+	return nil
+}
+
+// SupportsProviderType returns true if secrets of "providerType" are reconciled.
+func (c *Configuration) SupportsProviderType(providerType string) bool {
+	return contains(c.ProviderTypes, providerType)
+}
+
+// RequiresJoinedManagedCluster returns true if a copy in "namespace" may only
+// receive credentials when the namespace is a Joined ManagedCluster.
+func (c *Configuration) RequiresJoinedManagedCluster(namespace string) bool {
+	if c.Gating.RequireJoinedManagedCluster != nil && !*c.Gating.RequireJoinedManagedCluster {
+		return false
+	}
+	return !contains(c.Gating.ExemptNamespaces, namespace)
+}
+
+// IsGitOpsFieldManager returns true if "manager" is a GitOps tool.
+func (c *Configuration) IsGitOpsFieldManager(manager string) bool {
+	return contains(c.GitOps.FieldManagers, manager)
+}
+
+// Verifies returns true if the credentials of "providerType" are verified
+// before they are propagated.
+func (c *Configuration) Verifies(providerType string) bool {
+	return contains(c.Verification.ProviderTypes, providerType)
+}
+
+// IsGitOpsOwnerAPIGroup returns true if owners in "group" are GitOps resources.
+func (c *Configuration) IsGitOpsOwnerAPIGroup(group string) bool {
+	return contains(c.GitOps.OwnerAPIGroups, group)
+}
+
+// RateLimiter returns the work queue rate limiter described by RateLimit.
+func (c *Configuration) RateLimiter() workqueue.RateLimiter {
+	return workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(c.RateLimit.BaseDelay.Duration, c.RateLimit.MaxDelay.Duration),
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(c.RateLimit.QPS), c.RateLimit.Burst)},
+	)
+}
+
+// structuralChanges lists the fields of "next" that differ from "c" but can
+// only be applied by restarting the controller.
+func (c *Configuration) structuralChanges(next *Configuration) []string {
+	var changed []string
+	if !reflect.DeepEqual(c.Concurrency, next.Concurrency) {
+		changed = append(changed, "concurrency")
+	}
+	if !reflect.DeepEqual(c.RateLimit, next.RateLimit) {
+		changed = append(changed, "rateLimit")
+	}
+	return changed
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
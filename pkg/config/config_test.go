@@ -0,0 +1,185 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stolostron/provider-credential-controller/pkg/transform"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+)
+
+const validConfig = `apiVersion: provider-credential-controller.open-cluster-management.io/v1alpha1
+kind: ControllerConfiguration
+providerTypes: ["aws", "ans"]
+concurrency:
+  maxConcurrentReconciles: 4
+rateLimit:
+  baseDelay: 10ms
+  maxDelay: 5m
+  qps: 20
+  burst: 50
+gating:
+  exemptNamespaces: ["hub-local"]
+gitOps:
+  fieldManagers: ["config-sync"]
+expiry:
+  maxAge: 2160h
+verification:
+  providerTypes: ["aws"]
+  endpoints:
+    aws: https://sts.eu-west-1.amazonaws.com
+sources:
+  vault:
+    address: https://vault.example.com:8200
+    role: provider-credential-controller
+    allowedPaths:
+      team-a: ["secret/team-a/"]
+transforms:
+  ans:
+  - key: tower_host
+    from: host
+  redhatvirtualization:
+  - key: fqdn
+    from: ovirt_fqdn
+logging:
+  level: debug
+`
+
+func TestDefault(t *testing.T) {
+
+	cfg := Default()
+
+	assert.Nil(t, cfg.Validate(), "Nil, the defaults are valid")
+	assert.Equal(t, SupportedProviderTypes, cfg.ProviderTypes)
+	assert.Equal(t, 1, cfg.Concurrency.MaxConcurrentReconciles)
+	assert.True(t, cfg.RequiresJoinedManagedCluster("cluster1"))
+	assert.True(t, cfg.SupportsProviderType("redhatvirtualization"))
+	assert.False(t, cfg.SupportsProviderType("bm"))
+	assert.True(t, cfg.IsGitOpsFieldManager("argocd-controller"))
+	assert.True(t, cfg.IsGitOpsOwnerAPIGroup("bitnami.com"))
+	assert.False(t, cfg.Verifies("aws"), "Credentials are not verified by default")
+	assert.Nil(t, cfg.Sources.Vault, "No external store is configured by default")
+}
+
+func TestParse(t *testing.T) {
+
+	cfg, err := Parse([]byte(validConfig))
+
+	assert.Nil(t, err, "Nil, when the configuration is valid")
+	assert.Equal(t, []string{"aws", "ans"}, cfg.ProviderTypes)
+	assert.False(t, cfg.SupportsProviderType("gcp"))
+	assert.Equal(t, 4, cfg.Concurrency.MaxConcurrentReconciles)
+	assert.Equal(t, 5*time.Minute, cfg.RateLimit.MaxDelay.Duration)
+	assert.False(t, cfg.RequiresJoinedManagedCluster("hub-local"))
+	assert.True(t, cfg.RequiresJoinedManagedCluster("cluster1"))
+	assert.NotNil(t, cfg.RateLimiter())
+	assert.True(t, cfg.IsGitOpsFieldManager("config-sync"))
+	assert.False(t, cfg.IsGitOpsFieldManager("argocd-controller"), "The configured managers replace the defaults")
+	assert.True(t, cfg.IsGitOpsOwnerAPIGroup("argoproj.io"))
+	assert.Equal(t, 90*24*time.Hour, cfg.Expiry.MaxAge.Duration)
+	assert.Equal(t, 30*24*time.Hour, cfg.Expiry.WarnBefore.Duration)
+	assert.True(t, cfg.Verifies("aws"))
+	assert.False(t, cfg.Verifies("ans"))
+	assert.Equal(t, 10*time.Second, cfg.Verification.Timeout.Duration)
+	assert.Equal(t, 5*time.Minute, cfg.Sources.PollInterval.Duration)
+	assert.Equal(t, 2, cfg.Sources.Vault.KVVersion)
+	assert.True(t, cfg.Sources.Vault.Allows("team-a", "secret/team-a/aws"))
+	assert.False(t, cfg.Sources.Vault.Allows("team-a", "secret/team-ab/aws"), "Prefixes match whole path segments")
+	assert.False(t, cfg.Sources.Vault.Allows("team-a", "secret/team-a/../team-b/aws"))
+	assert.False(t, cfg.Sources.Vault.Allows("team-b", "secret/team-a/aws"), "Other namespaces read nothing")
+	assert.Equal(t, "tower_host", cfg.Transforms["ans"][0].Key)
+	assert.Equal(t, append(append([]transform.Transform{}, DefaultTransforms["redhatvirtualization"]...),
+		transform.Transform{Key: "fqdn", From: "ovirt_fqdn"}), cfg.Transforms["redhatvirtualization"],
+		"The configured transforms are applied after the defaults")
+}
+
+func TestParseInvalid(t *testing.T) {
+
+	header := "apiVersion: " + APIVersion + "\nkind: " + Kind + "\n"
+
+	for name, doc := range map[string]string{
+		"wrong version":      "apiVersion: v0\nkind: " + Kind + "\n",
+		"wrong kind":         "apiVersion: " + APIVersion + "\nkind: Other\n",
+		"unknown field":      header + "concurency:\n  maxConcurrentReconciles: 2\n",
+		"unsupported type":   header + "providerTypes: [\"aws\", \"bogus\"]\n",
+		"negative workers":   header + "concurrency:\n  maxConcurrentReconciles: -1\n",
+		"max below base":     header + "rateLimit:\n  baseDelay: 1s\n  maxDelay: 1ms\n",
+		"unknown log level":  header + "logging:\n  level: chatty\n",
+		"malformed duration": header + "rateLimit:\n  baseDelay: soon\n",
+		"negative max age":   header + "expiry:\n  maxAge: -1h\n",
+		"verifier type":      header + "verification:\n  providerTypes: [\"ost\"]\n",
+		"verifier endpoint":  header + "verification:\n  endpoints:\n    aws: sts.amazonaws.com\n",
+		"vault address":      header + "sources:\n  vault:\n    address: vault:8200\n    role: a\n",
+		"vault auth":         header + "sources:\n  vault:\n    address: https://vault:8200\n",
+		"vault allowed path": header + "sources:\n  vault:\n    address: https://vault:8200\n    role: a\n    allowedPaths:\n      team-a: [\"/\"]\n",
+		"transform type":     header + "transforms:\n  bm:\n  - key: a\n    from: b\n",
+		"invalid transform":  header + "transforms:\n  aws:\n  - key: a\n    template: \"{{ .b \"\n",
+	} {
+		_, err := Parse([]byte(doc))
+		assert.NotNil(t, err, "Not nil, when the configuration has a %s", name)
+		t.Logf("%s: %v", name, err)
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+
+	cfg, err := Load(filepath.Join(t.TempDir(), "missing.yaml"))
+
+	assert.Nil(t, err, "Nil, when the optional configuration file does not exist")
+	assert.Equal(t, Default(), cfg)
+}
+
+func TestStoreReload(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(validConfig), 0600))
+
+	store, err := NewStore(path)
+	assert.Nil(t, err)
+	assert.Equal(t, zapcore.DebugLevel, store.LogLevel().Level())
+
+	// Hot reloadable settings change, structural settings are kept.
+	updated := `apiVersion: provider-credential-controller.open-cluster-management.io/v1alpha1
+kind: ControllerConfiguration
+providerTypes: ["gcp"]
+concurrency:
+  maxConcurrentReconciles: 8
+gating:
+  requireJoinedManagedCluster: false
+logging:
+  level: error
+`
+	assert.Nil(t, os.WriteFile(path, []byte(updated), 0600))
+	assert.Nil(t, store.Reload(logr.Discard()))
+
+	cfg := store.Get()
+	assert.Equal(t, []string{"gcp"}, cfg.ProviderTypes)
+	assert.False(t, cfg.RequiresJoinedManagedCluster("cluster1"))
+	assert.Equal(t, zapcore.ErrorLevel, store.LogLevel().Level())
+	assert.Equal(t, 4, cfg.Concurrency.MaxConcurrentReconciles, "structural settings require a restart")
+	assert.Equal(t, 50, cfg.RateLimit.Burst, "structural settings require a restart")
+
+	// An invalid file is rejected and the active configuration is kept.
+	assert.Nil(t, os.WriteFile(path, []byte("kind: Broken\n"), 0600))
+	assert.NotNil(t, store.Reload(logr.Discard()))
+	assert.Equal(t, cfg, store.Get())
+
+	// A removed file falls back to the defaults.
+	assert.Nil(t, os.Remove(path))
+	assert.Nil(t, store.Reload(logr.Discard()))
+	assert.Equal(t, Default().ProviderTypes, store.Get().ProviderTypes)
+	assert.True(t, store.Get().RequiresJoinedManagedCluster("cluster1"))
+}
+
+func TestStoreNil(t *testing.T) {
+
+	var store *Store
+
+	assert.Equal(t, Default(), store.Get())
+}
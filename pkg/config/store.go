@@ -0,0 +1,177 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// DefaultReloadInterval is how often Store.Start checks the configuration
+// file for changes. Kubelet refreshes mounted ConfigMaps on the order of a
+// minute, so polling more often than this buys nothing.
+const DefaultReloadInterval = 30 * time.Second
+
+// Store holds the active Configuration and applies hot reloads to it.
+//
+// Get is safe to call on a nil *Store and returns the defaults, so
+// reconcilers built without a configuration (as in unit tests) behave as
+// they always have.
+type Store struct {
+	path     string
+	interval time.Duration
+	level    zap.AtomicLevel
+
+	mu      sync.RWMutex
+	current *Configuration
+	raw     []byte
+}
+
+// NewStore loads and validates the configuration file at "path" and returns
+// a Store holding it.
+func NewStore(path string) (*Store, error) {
+	raw, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseFile(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	level, _ := zapcore.ParseLevel(cfg.Logging.Level)
+
+	return &Store{
+		path:     path,
+		interval: DefaultReloadInterval,
+		level:    zap.NewAtomicLevelAt(level),
+		current:  cfg,
+		raw:      raw,
+	}, nil
+}
+
+// NewStaticStore returns a Store holding "cfg" that is never reloaded.
+func NewStaticStore(cfg *Configuration) *Store {
+	level, _ := zapcore.ParseLevel(cfg.Logging.Level)
+
+	return &Store{
+		interval: DefaultReloadInterval,
+		level:    zap.NewAtomicLevelAt(level),
+		current:  cfg,
+	}
+}
+
+// Get returns the active configuration. Callers must not modify it.
+func (s *Store) Get() *Configuration {
+	if s == nil {
+		return Default()
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current
+}
+
+// LogLevel returns the level enabler to pass to the logger; it follows
+// logging.level across reloads.
+func (s *Store) LogLevel() zap.AtomicLevel {
+	return s.level
+}
+
+// Reload re-reads the configuration file. An invalid file is rejected and
+// the active configuration is kept. Structural settings that changed are
+// reported in the log and left at their current values until restart; all
+// other settings take effect immediately.
+func (s *Store) Reload(log logr.Logger) error {
+	raw, err := readFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if bytes.Equal(raw, s.raw) {
+		return nil
+	}
+
+	// The bytes compared above are the ones parsed, even if the file changes
+	// again in between
+	next, err := parseFile(raw)
+	if err != nil {
+		return err
+	}
+	s.raw = raw
+
+	if changed := s.current.structuralChanges(next); len(changed) > 0 {
+		log.Info("Configuration change requires a restart to take effect, keeping current values",
+			"fields", strings.Join(changed, ","))
+		next.Concurrency = s.current.Concurrency
+		next.RateLimit = s.current.RateLimit
+	}
+
+	level, _ := zapcore.ParseLevel(next.Logging.Level)
+	s.level.SetLevel(level)
+	s.current = next
+
+	log.Info("Reloaded configuration", "path", s.path)
+	return nil
+}
+
+// Start polls the configuration file until "ctx" is cancelled. It
+// implements manager.Runnable so the Store can be added to a manager.
+func (s *Store) Start(ctx context.Context) error {
+	log := ctrllog.Log.WithName("config")
+	if s.path == "" {
+		return nil
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := s.Reload(log); err != nil {
+				log.Error(err, "Failed to reload configuration, keeping current values", "path", s.path)
+			}
+		}
+	}
+}
+
+// NeedLeaderElection returns false so standby replicas also track the
+// configuration and are current when they take over.
+func (s *Store) NeedLeaderElection() bool {
+	return false
+}
+
+// parseFile parses the configuration file content returned by readFile,
+// which is nil when there is no file.
+func parseFile(raw []byte) (*Configuration, error) {
+	if raw == nil {
+		return Default(), nil
+	}
+	return Parse(raw)
+}
+
+func readFile(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(path) // #nosec G304 -- path is an operator supplied flag
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return raw, err
+}
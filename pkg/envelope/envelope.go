@@ -0,0 +1,202 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+// Package envelope encrypts the data of a credential copy to the RSA public
+// key of its consumer, so the copy can only be read by the holder of the
+// private key rather than by anyone who can read secrets in its namespace.
+//
+// # Format
+//
+// An encrypted copy holds a single data key, DataKey ("envelope.json"),
+// whose value is the JSON document:
+//
+//	{
+//	  "version":      "v1",
+//	  "algorithm":    "RSA-OAEP-256+A256GCM",
+//	  "keyId":        "sha256:<hex SHA-256 of the DER SubjectPublicKeyInfo of the public key>",
+//	  "encryptedKey": "<base64 RSA-OAEP (SHA-256, no label) encryption of a random 32 byte key>",
+//	  "nonce":        "<base64 random 12 byte nonce>",
+//	  "ciphertext":   "<base64 AES-256-GCM encryption of the plaintext, tag appended>"
+//	}
+//
+// The plaintext is the JSON object of the copy's data, as the data field of
+// a Secret is written: data keys mapped to their base64 values. The
+// additional authenticated data is "<namespace>/<name>" of the copy, so an
+// envelope moved to another secret does not decrypt. Base64 is standard
+// encoding with padding.
+//
+// To decrypt, unwrap the AES key with the private key, then open the
+// ciphertext with the nonce and the copy's namespace and name, as Open does.
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// DataKey is the only data key of an encrypted copy.
+const DataKey = "envelope.json"
+
+// Version and Algorithm identify the envelope format.
+const (
+	Version   = "v1"
+	Algorithm = "RSA-OAEP-256+A256GCM"
+)
+
+// minKeyBits is the smallest RSA key data is encrypted to.
+const minKeyBits = 2048
+
+// Envelope is the document stored under DataKey.
+type Envelope struct {
+	Version      string `json:"version"`
+	Algorithm    string `json:"algorithm"`
+	KeyID        string `json:"keyId"`
+	EncryptedKey []byte `json:"encryptedKey"`
+	Nonce        []byte `json:"nonce"`
+	Ciphertext   []byte `json:"ciphertext"`
+}
+
+// ParsePublicKey decodes a PEM encoded RSA public key, either a PKIX
+// "PUBLIC KEY" or a PKCS #1 "RSA PUBLIC KEY" of at least 2048 bits.
+func ParsePublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var key *rsa.PublicKey
+	switch block.Type {
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if key, ok = parsed.(*rsa.PublicKey); !ok {
+			return nil, errors.New("not an RSA public key")
+		}
+	case "RSA PUBLIC KEY":
+		parsed, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = parsed
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+
+	if key.N.BitLen() < minKeyBits {
+		return nil, fmt.Errorf("RSA keys must be at least %d bits, got %d", minKeyBits, key.N.BitLen())
+	}
+	return key, nil
+}
+
+// KeyID identifies "key" in the envelopes encrypted to it.
+func KeyID(key *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// Seal encrypts "data" for the copy "namespace"/"name" to "key" and returns
+// the data of the encrypted copy.
+func Seal(key *rsa.PublicKey, namespace, name string, data map[string][]byte) (map[string][]byte, error) {
+	plaintext, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := KeyID(key)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, dataKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := json.Marshal(Envelope{
+		Version:      Version,
+		Algorithm:    Algorithm,
+		KeyID:        keyID,
+		EncryptedKey: encryptedKey,
+		Nonce:        nonce,
+		Ciphertext:   gcm.Seal(nil, nonce, plaintext, additionalData(namespace, name)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{DataKey: sealed}, nil
+}
+
+// Open decrypts the data of the encrypted copy "namespace"/"name" with
+// "key". It is what a consumer of the copy does.
+func Open(key *rsa.PrivateKey, namespace, name string, data map[string][]byte) (map[string][]byte, error) {
+	var sealed Envelope
+	if err := json.Unmarshal(data[DataKey], &sealed); err != nil {
+		return nil, fmt.Errorf("%s: %w", DataKey, err)
+	}
+	if sealed.Version != Version || sealed.Algorithm != Algorithm {
+		return nil, fmt.Errorf("unsupported envelope %s %s", sealed.Version, sealed.Algorithm)
+	}
+
+	dataKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, sealed.EncryptedKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+	plaintext, err := gcm.Open(nil, sealed.Nonce, sealed.Ciphertext, additionalData(namespace, name))
+	if err != nil {
+		return nil, err
+	}
+
+	opened := map[string][]byte{}
+	return opened, json.Unmarshal(plaintext, &opened)
+}
+
+// IsSealed returns true if "data" is the data of an encrypted copy.
+func IsSealed(data map[string][]byte) bool {
+	_, ok := data[DataKey]
+	return ok && len(data) == 1
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func additionalData(namespace, name string) []byte {
+	return []byte(namespace + "/" + name)
+}
@@ -0,0 +1,80 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package envelope
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newKey(t *testing.T, bits int) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	assert.Nil(t, err)
+	return key
+}
+
+func TestSealOpen(t *testing.T) {
+
+	key := newKey(t, 2048)
+	data := map[string][]byte{"host": []byte("https://tower.example.com"), "token": []byte("secret")}
+
+	sealed, err := Seal(&key.PublicKey, "cluster1", "ansible", data)
+	assert.Nil(t, err)
+	assert.True(t, IsSealed(sealed))
+	assert.NotContains(t, string(sealed[DataKey]), "secret")
+
+	var document Envelope
+	assert.Nil(t, json.Unmarshal(sealed[DataKey], &document))
+	assert.Equal(t, Version, document.Version)
+	assert.Equal(t, Algorithm, document.Algorithm)
+	keyID, _ := KeyID(&key.PublicKey)
+	assert.Equal(t, keyID, document.KeyID)
+	assert.Len(t, document.Nonce, 12)
+
+	opened, err := Open(key, "cluster1", "ansible", sealed)
+	assert.Nil(t, err, "Nil, when opened by the intended consumer")
+	assert.Equal(t, data, opened)
+
+	_, err = Open(key, "cluster2", "ansible", sealed)
+	assert.NotNil(t, err, "Not nil, when the envelope was moved to another secret")
+
+	_, err = Open(newKey(t, 2048), "cluster1", "ansible", sealed)
+	assert.NotNil(t, err, "Not nil, when opened with another key")
+
+	document.Ciphertext[0] ^= 1
+	tampered, _ := json.Marshal(document)
+	_, err = Open(key, "cluster1", "ansible", map[string][]byte{DataKey: tampered})
+	assert.NotNil(t, err, "Not nil, when the ciphertext was modified")
+}
+
+func TestParsePublicKey(t *testing.T) {
+
+	key := newKey(t, 2048)
+	pkix, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.Nil(t, err)
+
+	for name, encoded := range map[string][]byte{
+		"pkix":  pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix}),
+		"pkcs1": pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)}),
+	} {
+		parsed, err := ParsePublicKey(encoded)
+		assert.Nil(t, err, name)
+		assert.True(t, key.PublicKey.Equal(parsed), name)
+	}
+
+	small := newKey(t, 1024)
+	for name, encoded := range map[string][]byte{
+		"not PEM":     []byte("ssh-rsa AAAA"),
+		"private key": pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		"small key":   pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&small.PublicKey)}),
+	} {
+		_, err := ParsePublicKey(encoded)
+		assert.NotNil(t, err, name)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+// cacheSyncTimeout bounds how long a readiness probe waits on the informer.
+// Probes are retried by the kubelet, so failing fast is preferable to
+// holding the HTTP request open until the probe itself times out.
+const cacheSyncTimeout = time.Second
+
+// CacheSyncCheck returns a readiness check that passes once the informer
+// backing "obj" in "c" has completed its initial list.
+func CacheSyncCheck(c cache.Cache, obj client.Object) healthz.Checker {
+	return func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), cacheSyncTimeout)
+		defer cancel()
+
+		informer, err := c.GetInformer(ctx, obj)
+		if err != nil {
+			return err
+		}
+		if !informer.HasSynced() {
+			return errors.New("informer cache has not synced")
+		}
+		return nil
+	}
+}
+
+// APIDiscoveryCheck returns a readiness check that passes once "gvk" is
+// served by the API server, as seen through the manager's RESTMapper.
+func APIDiscoveryCheck(mapper meta.RESTMapper, gvk schema.GroupVersionKind) healthz.Checker {
+	return func(_ *http.Request) error {
+		if _, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version); err != nil {
+			return fmt.Errorf("%s is not served: %w", gvk.String(), err)
+		}
+		return nil
+	}
+}
+
+// Watchdog tracks in-flight reconciles and reports a liveness failure when
+// one of them has not made progress within the configured timeout. A
+// reconcile that hangs on an API call (for example while propagating a
+// rotation to thousands of copies) otherwise leaves the pod looking healthy
+// while no further rotations are processed.
+//
+// All methods are safe to call on a nil *Watchdog, so reconcilers do not
+// need to check whether one was configured.
+type Watchdog struct {
+	timeout time.Duration
+	now     func() time.Time
+
+	mu     sync.Mutex
+	active map[string]time.Time
+}
+
+// NewWatchdog returns a Watchdog that fails its liveness check when an
+// in-flight reconcile has not reported progress for longer than "timeout".
+func NewWatchdog(timeout time.Duration) *Watchdog {
+	return &Watchdog{
+		timeout: timeout,
+		now:     time.Now,
+		active:  map[string]time.Time{},
+	}
+}
+
+// Begin records the start of a reconcile for "key".
+func (w *Watchdog) Begin(key string) {
+	w.Progress(key)
+}
+
+// Progress records that the reconcile for "key" is still advancing.
+func (w *Watchdog) Progress(key string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.active[key] = w.now()
+}
+
+// End records that the reconcile for "key" has returned.
+func (w *Watchdog) End(key string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.active, key)
+}
+
+// Check is a healthz.Checker that fails when any in-flight reconcile has
+// been without progress for longer than the timeout.
+func (w *Watchdog) Check(_ *http.Request) error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.now()
+	for key, last := range w.active {
+		if stalled := now.Sub(last); stalled > w.timeout {
+			return fmt.Errorf("reconcile of %s has made no progress for %s", key, stalled.Round(time.Second))
+		}
+	}
+	return nil
+}
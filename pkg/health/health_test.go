@@ -0,0 +1,87 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package health
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/cache/informertest"
+)
+
+var managedClusterGVK = schema.GroupVersionKind{
+	Group:   "cluster.open-cluster-management.io",
+	Version: "v1",
+	Kind:    "ManagedCluster",
+}
+
+func TestCacheSyncCheck(t *testing.T) {
+
+	informers := &informertest.FakeInformers{Scheme: scheme.Scheme}
+	check := CacheSyncCheck(informers, &corev1.Secret{})
+	req := httptest.NewRequest("GET", "/readyz", nil)
+
+	assert.NotNil(t, check(req), "Not nil, before the secret informer has synced")
+
+	fakeInformer, err := informers.FakeInformerFor(&corev1.Secret{})
+	assert.Nil(t, err)
+	fakeInformer.Synced = true
+
+	assert.Nil(t, check(req), "Nil, once the secret informer has synced")
+
+	informers.Error = errors.New("cache is not started")
+	assert.NotNil(t, check(req), "Not nil, when the informer can not be retrieved")
+}
+
+func TestAPIDiscoveryCheck(t *testing.T) {
+
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{managedClusterGVK.GroupVersion()})
+	check := APIDiscoveryCheck(mapper, managedClusterGVK)
+
+	assert.NotNil(t, check(nil), "Not nil, when the ManagedCluster API is not served")
+
+	mapper.Add(managedClusterGVK, meta.RESTScopeRoot)
+
+	assert.Nil(t, check(nil), "Nil, when the ManagedCluster API is served")
+}
+
+func TestWatchdog(t *testing.T) {
+
+	now := time.Now()
+	w := NewWatchdog(time.Minute)
+	w.now = func() time.Time { return now }
+
+	assert.Nil(t, w.Check(nil), "Nil, when no reconcile is in flight")
+
+	w.Begin("providers/aws")
+	now = now.Add(50 * time.Second)
+	assert.Nil(t, w.Check(nil), "Nil, when the reconcile is within the timeout")
+
+	w.Progress("providers/aws")
+	now = now.Add(50 * time.Second)
+	assert.Nil(t, w.Check(nil), "Nil, when progress resets the timeout")
+
+	now = now.Add(20 * time.Second)
+	assert.NotNil(t, w.Check(nil), "Not nil, when the reconcile has stalled")
+
+	w.End("providers/aws")
+	assert.Nil(t, w.Check(nil), "Nil, once the stalled reconcile returns")
+}
+
+func TestWatchdogNil(t *testing.T) {
+
+	var w *Watchdog
+
+	w.Begin("providers/aws")
+	w.Progress("providers/aws")
+	w.End("providers/aws")
+
+	assert.Nil(t, w.Check(nil), "Nil, when no watchdog is configured")
+}
@@ -0,0 +1,193 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package manager
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/stolostron/provider-credential-controller/controllers/oldproviderconnection"
+	"github.com/stolostron/provider-credential-controller/controllers/providercredential"
+	"github.com/stolostron/provider-credential-controller/pkg/config"
+	"github.com/stolostron/provider-credential-controller/pkg/health"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+var (
+	scheme   = runtime.NewScheme()
+	setupLog = ctrl.Log.WithName("setup")
+)
+
+func init() {
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	_ = corev1.AddToScheme(scheme)
+}
+
+// Run starts a single manager hosting the controllers selected in "o". The
+// controllers share the manager's client, RESTMapper, leader election lease,
+// metrics and probe endpoints, and the configuration held in "store", and
+// run until "ctx" is cancelled.
+func Run(ctx context.Context, o *Options, store *config.Store) error {
+	enabled, err := o.EnabledControllers()
+	if err != nil {
+		return err
+	}
+
+	namespaces := o.Namespaces()
+	if len(namespaces) > 0 {
+		setupLog.Info("Running namespace-scoped", "namespaces", namespaces)
+	}
+
+	setupLog.Info("Leader election settings", "enableLeaderElection", o.EnableLeaderElection,
+		"leaderElectionID", o.LeaderElectionID,
+		"leaseDuration", o.LeaderElectionLeaseDuration,
+		"renewDeadline", o.LeaderElectionRenewDeadline,
+		"retryPeriod", o.LeaderElectionRetryPeriod)
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+		Scheme:                 scheme,
+		MetricsBindAddress:     o.MetricsAddr,
+		HealthProbeBindAddress: o.ProbeAddr,
+		Port:                   9443,
+		NewCache: func(restConfig *rest.Config, opts cache.Options) (cache.Cache, error) {
+			opts.Namespaces = namespaces
+			opts.ByObject = map[client.Object]cache.ByObject{
+				&corev1.Secret{}: {
+					Label:     labels.SelectorFromSet(labels.Set{providercredential.CredentialLabel: ""}),
+					Transform: trimSecret,
+				}}
+			return cache.New(restConfig, opts)
+		},
+		LeaderElection:   o.EnableLeaderElection,
+		LeaderElectionID: o.LeaderElectionID,
+		LeaseDuration:    &o.LeaderElectionLeaseDuration,
+		RenewDeadline:    &o.LeaderElectionRenewDeadline,
+		RetryPeriod:      &o.LeaderElectionRetryPeriod,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to start manager: %w", err)
+	}
+
+	if err := mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
+		return fmt.Errorf("unable to set up health check: %w", err)
+	}
+	if err := mgr.AddReadyzCheck("secret-cache-sync", health.CacheSyncCheck(mgr.GetCache(), &corev1.Secret{})); err != nil {
+		return fmt.Errorf("unable to set up ready check: %w", err)
+	}
+
+	if err := mgr.Add(store); err != nil {
+		return fmt.Errorf("unable to watch configuration: %w", err)
+	}
+
+	if enabled[ProviderCredentialController] {
+		if err := setupProviderCredential(mgr, o, store, len(namespaces) > 0); err != nil {
+			return err
+		}
+	}
+
+	if enabled[OldProviderConnectionController] {
+		if err := setupOldProviderConnection(mgr, store, namespaces); err != nil {
+			return err
+		}
+	}
+	// +kubebuilder:scaffold:builder
+
+	setupLog.Info("starting manager", "controllers", o.Controllers)
+
+	return mgr.Start(ctx)
+}
+
+func setupProviderCredential(mgr ctrl.Manager, o *Options, store *config.Store, namespaceScoped bool) error {
+	watchdog := health.NewWatchdog(o.StuckReconcileTimeout)
+
+	if err := (&providercredential.ProviderCredentialSecretReconciler{
+		Client:    mgr.GetClient(),
+		APIReader: mgr.GetAPIReader(),
+		Log:       ctrl.Log.WithName("controllers").WithName("ProviderCredentialSecretReconciler"),
+		Scheme:    mgr.GetScheme(),
+		Recorder:  mgr.GetEventRecorderFor("provider-credential-controller"),
+		Watchdog:  watchdog,
+		Config:    store,
+
+		NamespaceScoped: namespaceScoped,
+	}).SetupWithManager(mgr); err != nil {
+		return fmt.Errorf("unable to create controller ProviderCredentialSecretReconciler: %w", err)
+	}
+
+	if err := mgr.AddHealthzCheck("reconcile-progress", watchdog.Check); err != nil {
+		return fmt.Errorf("unable to set up health check: %w", err)
+	}
+	if err := mgr.AddReadyzCheck("managedcluster-api",
+		health.APIDiscoveryCheck(mgr.GetRESTMapper(), providercredential.ManagedClusterGVK)); err != nil {
+		return fmt.Errorf("unable to set up ready check: %w", err)
+	}
+	return nil
+}
+
+// setupOldProviderConnection registers the legacy migration controller and
+// the controller reverting migrations. Label selectors can not be OR'ed, so
+// legacy secrets are watched through a second informer scoped to the
+// cloudconnection label; it is added to the manager and shares its lifecycle
+// and leader election.
+func setupOldProviderConnection(mgr ctrl.Manager, store *config.Store, namespaces []string) error {
+	legacyCache, err := oldproviderconnection.NewSecretCache(mgr, namespaces, trimSecret)
+	if err != nil {
+		return fmt.Errorf("unable to create legacy secret cache: %w", err)
+	}
+
+	legacyClient, err := client.New(mgr.GetConfig(), client.Options{
+		Scheme: mgr.GetScheme(),
+		Mapper: mgr.GetRESTMapper(),
+		Cache:  &client.CacheOptions{Reader: legacyCache},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create legacy secret client: %w", err)
+	}
+
+	if err := (&oldproviderconnection.OldProviderConnectionReconciler{
+		Client:    legacyClient,
+		Cache:     legacyCache,
+		APIReader: mgr.GetAPIReader(),
+		Log:       ctrl.Log.WithName("controllers").WithName("OldProviderConnectionReconciler"),
+		Scheme:    mgr.GetScheme(),
+		Config:    store,
+		Recorder:  mgr.GetEventRecorderFor("old-provider-connection-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		return fmt.Errorf("unable to create controller OldProviderConnectionReconciler: %w", err)
+	}
+
+	// Migrated secrets carry the credential label, so reverts are watched
+	// through the manager's own cache.
+	if err := (&oldproviderconnection.RevertMigrationReconciler{
+		Client:    mgr.GetClient(),
+		APIReader: mgr.GetAPIReader(),
+		Log:       ctrl.Log.WithName("controllers").WithName("RevertMigrationReconciler"),
+		Recorder:  mgr.GetEventRecorderFor("old-provider-connection-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		return fmt.Errorf("unable to create controller RevertMigrationReconciler: %w", err)
+	}
+
+	if err := mgr.AddReadyzCheck("legacy-secret-cache-sync", health.CacheSyncCheck(legacyCache, &corev1.Secret{})); err != nil {
+		return fmt.Errorf("unable to set up ready check: %w", err)
+	}
+	return nil
+}
+
+// trimSecret is the cache transform of secrets. The controllers never read
+// the managedFields of the secrets they watch (copies are read from the API
+// server), so they are dropped to keep the informers small.
+func trimSecret(obj interface{}) (interface{}, error) {
+	if secret, ok := obj.(*corev1.Secret); ok {
+		secret.ManagedFields = nil
+	}
+	return obj, nil
+}
@@ -0,0 +1,35 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package manager
+
+import (
+	"testing"
+
+	"github.com/stolostron/provider-credential-controller/controllers/oldproviderconnection"
+	"github.com/stolostron/provider-credential-controller/controllers/providercredential"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestTrimSecret(t *testing.T) {
+
+	for _, label := range []string{providercredential.CredentialLabel, oldproviderconnection.CloudConnectionLabel} {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:          "secret",
+				Namespace:     "namespace",
+				Labels:        map[string]string{label: ""},
+				Annotations:   map[string]string{"note": "kept"},
+				ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}},
+			},
+			Data: map[string][]byte{"token": []byte("secret")},
+		}
+		trimmed, err := trimSecret(secret)
+		assert.Nil(t, err)
+		assert.Nil(t, trimmed.(*corev1.Secret).ManagedFields, "The managedFields are dropped, %s", label)
+		assert.Equal(t, map[string][]byte{"token": []byte("secret")}, trimmed.(*corev1.Secret).Data, "The data is kept, %s", label)
+		assert.Equal(t, map[string]string{"note": "kept"}, trimmed.(*corev1.Secret).Annotations)
+		assert.Equal(t, map[string]string{label: ""}, trimmed.(*corev1.Secret).Labels)
+	}
+}
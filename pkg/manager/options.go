@@ -0,0 +1,142 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package manager
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Controller names accepted by --controllers.
+const (
+	ProviderCredentialController    = "providercredential"
+	OldProviderConnectionController = "oldproviderconnection"
+)
+
+var knownControllers = []string{ProviderCredentialController, OldProviderConnectionController}
+
+// Options holds the settings shared by every controller hosted in the manager.
+type Options struct {
+	MetricsAddr           string
+	ProbeAddr             string
+	StuckReconcileTimeout time.Duration
+
+	EnableLeaderElection        bool
+	LeaderElectionID            string
+	LeaderElectionLeaseDuration time.Duration
+	LeaderElectionRenewDeadline time.Duration
+	LeaderElectionRetryPeriod   time.Duration
+
+	// Controllers is the comma separated list of controllers to run.
+	Controllers string
+
+	// ConfigFile is the path of the controller configuration file.
+	ConfigFile string
+
+	// WatchNamespaces is the comma separated list of namespaces holding
+	// Provider secrets. When set, the controllers run namespace-scoped.
+	WatchNamespaces string
+}
+
+// NewOptions returns the default Options, running every controller.
+func NewOptions() *Options {
+	return &Options{
+		MetricsAddr:                 ":8080",
+		ProbeAddr:                   ":8081",
+		StuckReconcileTimeout:       10 * time.Minute,
+		LeaderElectionID:            "provider-credential-controller.open-cluster-management.io",
+		LeaderElectionLeaseDuration: 137 * time.Second,
+		LeaderElectionRenewDeadline: 107 * time.Second,
+		LeaderElectionRetryPeriod:   26 * time.Second,
+		Controllers:                 strings.Join(knownControllers, ","),
+	}
+}
+
+// AddFlags binds the Options to "fs", using the current values as defaults.
+func (o *Options) AddFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.MetricsAddr, "metrics-addr", o.MetricsAddr, "The address the metric endpoint binds to.")
+	fs.StringVar(&o.ProbeAddr, "health-probe-bind-address", o.ProbeAddr, "The address the probe endpoint binds to.")
+	fs.DurationVar(&o.StuckReconcileTimeout, "stuck-reconcile-timeout", o.StuckReconcileTimeout,
+		"The duration a reconcile may go without making progress before the liveness probe fails.")
+	fs.StringVar(&o.Controllers, "controllers", o.Controllers,
+		"Comma separated list of controllers to run. Supported: "+strings.Join(knownControllers, ", ")+".")
+	fs.StringVar(&o.ConfigFile, "config", o.ConfigFile,
+		"Path of the controller configuration file. Defaults are used when unset or the file does not exist.")
+	fs.StringVar(&o.WatchNamespaces, "watch-namespaces", o.WatchNamespaces,
+		"Comma separated list of namespaces to watch for Provider secrets. When set, copies are only "+
+			"looked up in Joined ManagedCluster namespaces, so no cluster-wide secret access is needed. "+
+			"Defaults to all namespaces.")
+	fs.BoolVar(&o.EnableLeaderElection, "enable-leader-election", o.EnableLeaderElection,
+		"Enable leader election for controller manager. "+
+			"Enabling this will ensure there is only one active controller manager.")
+	fs.StringVar(&o.LeaderElectionID, "leader-election-id", o.LeaderElectionID,
+		"The name of the lease used for leader election.")
+	fs.DurationVar(
+		&o.LeaderElectionLeaseDuration,
+		"leader-election-lease-duration",
+		o.LeaderElectionLeaseDuration,
+		"The duration that non-leader candidates will wait after observing a leadership "+
+			"renewal until attempting to acquire leadership of a led but unrenewed leader "+
+			"slot. This is effectively the maximum duration that a leader can be stopped "+
+			"before it is replaced by another candidate. This is only applicable if leader "+
+			"election is enabled.",
+	)
+	fs.DurationVar(
+		&o.LeaderElectionRenewDeadline,
+		"leader-election-renew-deadline",
+		o.LeaderElectionRenewDeadline,
+		"The interval between attempts by the acting master to renew a leadership slot "+
+			"before it stops leading. This must be less than or equal to the lease duration. "+
+			"This is only applicable if leader election is enabled.",
+	)
+	fs.DurationVar(
+		&o.LeaderElectionRetryPeriod,
+		"leader-election-retry-period",
+		o.LeaderElectionRetryPeriod,
+		"The duration the clients should wait between attempting acquisition and renewal "+
+			"of a leadership. This is only applicable if leader election is enabled.",
+	)
+}
+
+// EnabledControllers parses Controllers, rejecting unknown or empty lists.
+func (o *Options) EnabledControllers() (map[string]bool, error) {
+	enabled := map[string]bool{}
+	for _, name := range strings.Split(o.Controllers, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !isKnownController(name) {
+			return nil, fmt.Errorf("unknown controller %q, supported controllers are: %s",
+				name, strings.Join(knownControllers, ", "))
+		}
+		enabled[name] = true
+	}
+	if len(enabled) == 0 {
+		return nil, fmt.Errorf("no controllers enabled, supported controllers are: %s",
+			strings.Join(knownControllers, ", "))
+	}
+	return enabled, nil
+}
+
+// Namespaces parses WatchNamespaces, returning nil when every namespace is watched.
+func (o *Options) Namespaces() []string {
+	var namespaces []string
+	for _, namespace := range strings.Split(o.WatchNamespaces, ",") {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces
+}
+
+func isKnownController(name string) bool {
+	for _, known := range knownControllers {
+		if name == known {
+			return true
+		}
+	}
+	return false
+}
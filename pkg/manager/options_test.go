@@ -0,0 +1,56 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package manager
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnabledControllersDefault(t *testing.T) {
+
+	enabled, err := NewOptions().EnabledControllers()
+
+	assert.Nil(t, err, "Nil, when the default controllers are used")
+	assert.True(t, enabled[ProviderCredentialController])
+	assert.True(t, enabled[OldProviderConnectionController])
+}
+
+func TestEnabledControllersFlag(t *testing.T) {
+
+	opts := NewOptions()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	opts.AddFlags(fs)
+
+	err := fs.Parse([]string{"--controllers= oldproviderconnection ,", "--metrics-addr=:8383"})
+	assert.Nil(t, err)
+
+	enabled, err := opts.EnabledControllers()
+
+	assert.Nil(t, err, "Nil, when a known controller is selected")
+	assert.Equal(t, map[string]bool{OldProviderConnectionController: true}, enabled)
+	assert.Equal(t, ":8383", opts.MetricsAddr)
+}
+
+func TestEnabledControllersInvalid(t *testing.T) {
+
+	for _, controllers := range []string{"", ",", "providercredential,unknown"} {
+		opts := NewOptions()
+		opts.Controllers = controllers
+
+		_, err := opts.EnabledControllers()
+
+		assert.NotNil(t, err, "Not nil, when controllers is %q", controllers)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+
+	opts := NewOptions()
+	assert.Nil(t, opts.Namespaces(), "Nil, when every namespace is watched")
+
+	opts.WatchNamespaces = "providers, team-a,,"
+	assert.Equal(t, []string{"providers", "team-a"}, opts.Namespaces())
+}
@@ -0,0 +1,117 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package migrate
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/stolostron/provider-credential-controller/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+// Usage describes the migrate subcommand.
+const Usage = `Usage: old-provider-connection migrate [flags]
+
+Converts every legacy provider connection once and prints a JSON report of
+the converted, skipped and failed secrets.
+
+Exit status is 0 when no secret failed, 1 when the run could not complete
+and 2 when at least one secret failed to convert.
+
+Flags:
+`
+
+// Main runs the migrate subcommand with "args", writing the report to
+// "stdout" and diagnostics to "stderr", and returns the exit status.
+func Main(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, Usage)
+		fs.PrintDefaults()
+	}
+
+	opts := Options{}
+	var reportFile, configFile string
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "Convert without writing anything.")
+	fs.StringVar(&opts.Namespace, "namespace", "", "Only migrate secrets in this namespace. Defaults to all namespaces.")
+	fs.StringVar(&opts.Dir, "dir", "",
+		"Read exported secrets from the YAML or JSON files in this directory instead of the cluster.")
+	fs.StringVar(&opts.OutputDir, "output-dir", "",
+		"Directory receiving the converted secrets when --dir is set. Required unless --dry-run.")
+	fs.StringVar(&reportFile, "report", "", "Write the report to this file instead of standard output.")
+	fs.StringVar(&configFile, "config", "",
+		"The controller configuration file, whose transforms the credential hash is computed with.")
+	ctrlconfig.RegisterFlags(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return ExitError
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(stderr, "unexpected arguments: %v\n", fs.Args())
+		fs.Usage()
+		return ExitError
+	}
+
+	var err error
+	if opts.Config, err = config.Load(configFile); err != nil {
+		fmt.Fprintf(stderr, "invalid configuration: %v\n", err)
+		return ExitError
+	}
+
+	var report *Report
+	if opts.Dir != "" {
+		report, err = Directory(opts)
+	} else {
+		report, err = fromCluster(opts)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "migration failed: %v\n", err)
+		return ExitError
+	}
+
+	out := stdout
+	if reportFile != "" {
+		f, err := os.Create(reportFile) // #nosec G304 -- the report path is chosen by the operator
+		if err != nil {
+			fmt.Fprintf(stderr, "unable to write the report: %v\n", err)
+			return ExitError
+		}
+		defer f.Close()
+		out = f
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		fmt.Fprintf(stderr, "unable to write the report: %v\n", err)
+		return ExitError
+	}
+	return report.ExitCode()
+}
+
+func fromCluster(opts Options) (*Report, error) {
+	restConfig, err := ctrlconfig.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = corev1.AddToScheme(scheme)
+
+	c, err := client.New(restConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+	return Cluster(ctrl.SetupSignalHandler(), c, opts)
+}
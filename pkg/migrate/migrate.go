@@ -0,0 +1,298 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+// Package migrate converts legacy provider connections in one pass, either
+// in a cluster or offline in a directory of exported secrets, and reports
+// the outcome of every secret.
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stolostron/provider-credential-controller/controllers/oldproviderconnection"
+	"github.com/stolostron/provider-credential-controller/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// Result is the outcome of migrating one secret.
+type Result string
+
+const (
+	Converted Result = "converted"
+	Skipped   Result = "skipped"
+	Failed    Result = "failed"
+)
+
+// Exit codes returned by Main.
+const (
+	ExitOK     = 0
+	ExitError  = 1
+	ExitFailed = 2
+)
+
+// Entry reports the outcome for one secret.
+type Entry struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Source is the file the secret was read from, in directory mode.
+	Source string `json:"source,omitempty"`
+	Result Result `json:"result"`
+	Reason string `json:"reason,omitempty"`
+	// KeyMapping maps each legacy metadata key to the data key it is written to.
+	KeyMapping map[string]string `json:"keyMapping,omitempty"`
+	// AdoptedCopies lists the legacy copies labelled as copies of the secret.
+	AdoptedCopies []string `json:"adoptedCopies,omitempty"`
+	// UnknownKeys lists the metadata keys not known for the provider type,
+	// which are migrated as written.
+	UnknownKeys []string `json:"unknownKeys,omitempty"`
+	// Output is the file the converted secret was written to, in directory mode.
+	Output string `json:"output,omitempty"`
+}
+
+// Report is the machine-readable outcome of a migration run.
+type Report struct {
+	DryRun    bool    `json:"dryRun"`
+	Converted int     `json:"converted"`
+	Skipped   int     `json:"skipped"`
+	Failed    int     `json:"failed"`
+	Secrets   []Entry `json:"secrets"`
+}
+
+func (r *Report) add(e Entry) {
+	switch e.Result {
+	case Converted:
+		r.Converted++
+	case Skipped:
+		r.Skipped++
+	case Failed:
+		r.Failed++
+	}
+	r.Secrets = append(r.Secrets, e)
+}
+
+// ExitCode returns ExitFailed when any secret failed, ExitOK otherwise.
+func (r *Report) ExitCode() int {
+	if r.Failed > 0 {
+		return ExitFailed
+	}
+	return ExitOK
+}
+
+// Options select what a migration run reads and whether it writes.
+type Options struct {
+	// DryRun converts without writing anything.
+	DryRun bool
+	// Namespace limits a cluster run to one namespace, all when empty.
+	Namespace string
+	// Dir, when set, is read for exported secrets instead of the cluster.
+	Dir string
+	// OutputDir receives the converted secrets of a directory run.
+	OutputDir string
+	// Config holds the transforms the credential hash is computed with.
+	// Defaults to config.Default().
+	Config *config.Configuration
+}
+
+// Cluster migrates the legacy provider connections found through "c". When
+// not a dry run, each secret is backed up, migrated and its legacy copies
+// adopted exactly as the oldproviderconnection controller does.
+func Cluster(ctx context.Context, c client.Client, opts Options) (*Report, error) {
+	if opts.Config == nil {
+		opts.Config = config.Default()
+	}
+
+	secrets := &corev1.SecretList{}
+	listOpts := []client.ListOption{client.HasLabels{oldproviderconnection.CloudConnectionLabel}}
+	if opts.Namespace != "" {
+		listOpts = append(listOpts, client.InNamespace(opts.Namespace))
+	}
+	if err := c.List(ctx, secrets, listOpts...); err != nil {
+		return nil, err
+	}
+
+	migrator := &oldproviderconnection.OldProviderConnectionReconciler{
+		Client:    c,
+		APIReader: c,
+		Log:       ctrl.Log.WithName("migrate"),
+		Config:    config.NewStaticStore(opts.Config),
+	}
+
+	report := &Report{DryRun: opts.DryRun, Secrets: []Entry{}}
+	for _, secret := range secrets.Items {
+		entry := Entry{Namespace: secret.Namespace, Name: secret.Name}
+		if reason := oldproviderconnection.SkipReason(secret); reason != "" {
+			entry.Result, entry.Reason = Skipped, reason
+			report.add(entry)
+			continue
+		}
+
+		_, migration, err := oldproviderconnection.Convert(secret, opts.Config)
+		if err == nil && !opts.DryRun {
+			_, err = migrator.Migrate(ctx, secret)
+			if err == nil {
+				migration, err = migratedRecord(ctx, c, secret)
+			}
+		}
+		if err != nil {
+			entry.Result, entry.Reason = Failed, err.Error()
+			report.add(entry)
+			continue
+		}
+
+		entry.Result = Converted
+		entry.KeyMapping = migration.KeyMapping
+		entry.AdoptedCopies = migration.AdoptedCopies
+		entry.UnknownKeys = migration.UnknownKeys
+		report.add(entry)
+	}
+	return report, nil
+}
+
+// migratedRecord reads back the migration record written on "secret".
+func migratedRecord(ctx context.Context, c client.Client, secret corev1.Secret) (*oldproviderconnection.MigrationRecord, error) {
+	var migrated corev1.Secret
+	if err := c.Get(ctx, client.ObjectKeyFromObject(&secret), &migrated); err != nil {
+		return nil, err
+	}
+	return oldproviderconnection.MigrationRecordOf(migrated)
+}
+
+// Directory converts the legacy provider connections found in the YAML and
+// JSON files under opts.Dir. Files may hold several documents, and v1 Lists
+// as written by "kubectl get secrets -o yaml". When not a dry run, each
+// converted secret is written to opts.OutputDir as <namespace>-<name>.yaml;
+// the input files are never modified.
+func Directory(opts Options) (*Report, error) {
+	if opts.Config == nil {
+		opts.Config = config.Default()
+	}
+	if !opts.DryRun {
+		if opts.OutputDir == "" {
+			return nil, errors.New("an output directory is required unless running a dry run")
+		}
+		if err := os.MkdirAll(opts.OutputDir, 0o750); err != nil {
+			return nil, err
+		}
+	}
+
+	report := &Report{DryRun: opts.DryRun, Secrets: []Entry{}}
+	err := filepath.WalkDir(opts.Dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+
+		secrets, err := readSecrets(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		for _, secret := range secrets {
+			if opts.Namespace != "" && secret.Namespace != opts.Namespace {
+				continue
+			}
+			report.add(convertFile(secret, path, opts))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func convertFile(secret corev1.Secret, path string, opts Options) Entry {
+	entry := Entry{Namespace: secret.Namespace, Name: secret.Name, Source: path}
+
+	if _, ok := secret.Labels[oldproviderconnection.CloudConnectionLabel]; !ok {
+		entry.Result, entry.Reason = Skipped, "not labelled "+oldproviderconnection.CloudConnectionLabel
+		return entry
+	}
+	if reason := oldproviderconnection.SkipReason(secret); reason != "" {
+		entry.Result, entry.Reason = Skipped, reason
+		return entry
+	}
+
+	migrated, migration, err := oldproviderconnection.Convert(secret, opts.Config)
+	if err != nil {
+		entry.Result, entry.Reason = Failed, err.Error()
+		return entry
+	}
+	entry.KeyMapping = migration.KeyMapping
+	entry.UnknownKeys = migration.UnknownKeys
+
+	if !opts.DryRun {
+		migrated.ResourceVersion = ""
+		migrated.UID = ""
+		out, err := yaml.Marshal(migrated)
+		if err != nil {
+			entry.Result, entry.Reason = Failed, err.Error()
+			return entry
+		}
+		entry.Output = filepath.Join(opts.OutputDir, secret.Namespace+"-"+secret.Name+".yaml")
+		if err := os.WriteFile(entry.Output, out, 0o600); err != nil {
+			entry.Result, entry.Reason, entry.Output = Failed, err.Error(), ""
+			return entry
+		}
+	}
+
+	entry.Result = Converted
+	return entry
+}
+
+// readSecrets returns the Secrets held in the file at "path", ignoring other kinds.
+func readSecrets(path string) ([]corev1.Secret, error) {
+	content, err := os.ReadFile(path) // #nosec G304 -- the directory is chosen by the operator
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := []corev1.Secret{}
+	decoder := utilyaml.NewYAMLOrJSONDecoder(bytes.NewReader(content), 4096)
+	for {
+		obj := &unstructured.Unstructured{}
+		if err := decoder.Decode(&obj.Object); err != nil {
+			if errors.Is(err, io.EOF) {
+				return secrets, nil
+			}
+			return nil, err
+		}
+
+		items := []unstructured.Unstructured{*obj}
+		if obj.IsList() {
+			list, err := obj.ToList()
+			if err != nil {
+				return nil, err
+			}
+			items = list.Items
+		}
+		for _, item := range items {
+			if item.GetKind() != "Secret" || item.GetAPIVersion() != "v1" {
+				continue
+			}
+			var secret corev1.Secret
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &secret); err != nil {
+				return nil, err
+			}
+			secrets = append(secrets, secret)
+		}
+	}
+}
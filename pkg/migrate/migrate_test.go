@@ -0,0 +1,173 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stolostron/provider-credential-controller/controllers/oldproviderconnection"
+	"github.com/stolostron/provider-credential-controller/controllers/providercredential"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+)
+
+const exportedSecrets = `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Secret
+  metadata:
+    name: good-aws
+    namespace: providers
+    labels:
+      cluster.open-cluster-management.io/cloudconnection: ""
+      cluster.open-cluster-management.io/provider: aws
+  stringData: {}
+  data:
+    metadata: YXdzQWNjZXNzS2V5SUQ6IGEKYXdzU2VjcmV0QWNjZXNzS2V5SUQ6IGI=
+- apiVersion: v1
+  kind: Secret
+  metadata:
+    name: broken-azr
+    namespace: providers
+    labels:
+      cluster.open-cluster-management.io/cloudconnection: ""
+      cluster.open-cluster-management.io/provider: azr
+  data:
+    metadata: Y2xpZW50SWQ6IGE=
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: not-legacy
+  namespace: providers
+data:
+  token: dG9rZW4=
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ignored
+  namespace: providers
+`
+
+func writeExport(t *testing.T) string {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "secrets.yaml"), []byte(exportedSecrets), 0o600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "README.txt"), []byte("not a manifest"), 0o600))
+	return dir
+}
+
+func results(report *Report) map[string]Result {
+	r := map[string]Result{}
+	for _, e := range report.Secrets {
+		r[e.Name] = e.Result
+	}
+	return r
+}
+
+func TestDirectoryDryRun(t *testing.T) {
+
+	report, err := Directory(Options{Dir: writeExport(t), DryRun: true})
+
+	assert.Nil(t, err, "Nil, when the directory can be read")
+	assert.Equal(t, map[string]Result{"good-aws": Converted, "broken-azr": Failed, "not-legacy": Skipped}, results(report))
+	assert.Equal(t, 1, report.Converted)
+	assert.Equal(t, 1, report.Failed)
+	assert.Equal(t, 1, report.Skipped)
+	assert.Equal(t, ExitFailed, report.ExitCode())
+	for _, e := range report.Secrets {
+		assert.Empty(t, e.Output, "Nothing is written on a dry run")
+		if e.Result == Failed {
+			assert.Contains(t, e.Reason, "metadata.clientSecret is required")
+		}
+	}
+}
+
+func TestDirectoryWritesConvertedSecrets(t *testing.T) {
+	out := t.TempDir()
+
+	report, err := Directory(Options{Dir: writeExport(t), OutputDir: out})
+	assert.Nil(t, err, "Nil, when the directory can be read")
+
+	content, err := os.ReadFile(filepath.Join(out, "providers-good-aws.yaml"))
+	assert.Nil(t, err, "Nil, the converted secret is written")
+
+	var secret corev1.Secret
+	assert.Nil(t, yaml.Unmarshal(content, &secret))
+	assert.Equal(t, "Secret", secret.Kind)
+	assert.Equal(t, []byte("a"), secret.Data["aws_access_key_id"])
+	assert.Equal(t, "aws", secret.Labels[providercredential.ProviderTypeLabel])
+	assert.NotEmpty(t, secret.Annotations[providercredential.CredentialHash])
+
+	entries, err := os.ReadDir(out)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1, "Only converted secrets are written")
+	assert.Equal(t, ExitFailed, report.ExitCode())
+}
+
+func TestDirectoryRequiresOutput(t *testing.T) {
+
+	_, err := Directory(Options{Dir: writeExport(t)})
+
+	assert.NotNil(t, err, "Not nil, when neither --dry-run nor --output-dir is set")
+}
+
+func TestCluster(t *testing.T) {
+	legacy := &corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "good-aws",
+			Namespace: "providers",
+			Labels: map[string]string{
+				oldproviderconnection.CloudConnectionLabel: "",
+				oldproviderconnection.ProviderLabel:        "aws",
+			},
+		},
+		Data: map[string][]byte{"metadata": []byte("awsAccessKeyID: a\nawsSecretAccessKeyID: b")},
+	}
+	reverted := legacy.DeepCopy()
+	reverted.Name = "reverted"
+	reverted.Annotations = map[string]string{oldproviderconnection.RevertMigrationAnnotation: "true"}
+
+	c := clientfake.NewFakeClient(legacy, reverted)
+
+	report, err := Cluster(context.Background(), c, Options{DryRun: true})
+	assert.Nil(t, err, "Nil, when the secrets can be listed")
+	assert.Equal(t, map[string]Result{"good-aws": Converted, "reverted": Skipped}, results(report))
+
+	var secret corev1.Secret
+	assert.Nil(t, c.Get(context.Background(), types.NamespacedName{Namespace: "providers", Name: "good-aws"}, &secret))
+	assert.NotNil(t, secret.Data["metadata"], "A dry run leaves the secret untouched")
+
+	report, err = Cluster(context.Background(), c, Options{})
+	assert.Nil(t, err, "Nil, when the secrets can be listed")
+	assert.Equal(t, ExitOK, report.ExitCode())
+	assert.Equal(t, "aws_access_key_id", report.Secrets[0].KeyMapping["awsAccessKeyID"])
+
+	assert.Nil(t, c.Get(context.Background(), types.NamespacedName{Namespace: "providers", Name: "good-aws"}, &secret))
+	assert.Nil(t, secret.Data["metadata"], "The secret is migrated")
+	assert.Equal(t, []byte("b"), secret.Data["aws_secret_access_key"])
+}
+
+func TestMainReport(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	code := Main([]string{"--dir", writeExport(t), "--dry-run"}, &stdout, &stderr)
+
+	assert.Equal(t, ExitFailed, code)
+	var report Report
+	assert.Nil(t, json.Unmarshal(stdout.Bytes(), &report), "The report is JSON")
+	assert.True(t, report.DryRun)
+	assert.Equal(t, 1, report.Converted)
+
+	assert.Equal(t, ExitError, Main([]string{"--unknown"}, &stdout, &stderr))
+}
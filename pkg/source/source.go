@@ -0,0 +1,59 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+// Package source reads provider credentials kept outside the cluster, so a
+// Provider secret can point at a path of an external secret store instead
+// of holding the credential itself.
+//
+// A reference names the store by its scheme, then the path of the
+// credential, for example vault://secret/aws/prod for the aws/prod secret of
+// the Vault KV engine mounted at secret/.
+package source
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Source reads the credentials of an external secret store.
+type Source interface {
+	// Read returns the values stored at "path".
+	Read(ctx context.Context, path string) (*Values, error)
+}
+
+// Values are the keys of a credential read from a store.
+type Values struct {
+	Data map[string][]byte
+
+	// Version identifies the stored revision, when the store has one.
+	Version string
+
+	// TTL is how long the store asks the values to be cached before they
+	// are read again. Zero when the store gives no hint.
+	TTL time.Duration
+}
+
+// Ref is a parsed reference to a credential in an external store.
+type Ref struct {
+	Scheme string
+	Path   string
+}
+
+func (r Ref) String() string {
+	return r.Scheme + "://" + r.Path
+}
+
+// ParseRef parses a reference such as vault://secret/aws/prod.
+func ParseRef(value string) (Ref, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return Ref{}, err
+	}
+	path := strings.Trim(u.Host+u.Path, "/")
+	if u.Scheme == "" || u.Host == "" || !strings.Contains(path, "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return Ref{}, fmt.Errorf("%q is not a reference of the form <store>://<mount>/<path>", value)
+	}
+	return Ref{Scheme: u.Scheme, Path: path}, nil
+}
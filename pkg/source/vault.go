@@ -0,0 +1,221 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package source
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VaultScheme is the scheme of references to HashiCorp Vault KV secrets.
+const VaultScheme = "vault"
+
+// ServiceAccountTokenFile is the token the controller logs in to Vault with
+// when it uses the Kubernetes auth method.
+const ServiceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token" //#nosec G101
+
+// VaultOptions configure a Vault client.
+type VaultOptions struct {
+	// Address is the URL of the Vault server, for example
+	// https://vault.example.com:8200.
+	Address string
+
+	// KVVersion is the version of the KV secrets engine, 1 or 2.
+	KVVersion int
+
+	// TokenFile holds a Vault token, re-read on every request so that a
+	// Vault Agent can renew it. Either TokenFile or Role is set.
+	TokenFile string
+
+	// Role is the Vault role the controller logs in as with the Kubernetes
+	// auth method mounted at AuthMount, using JWTFile.
+	Role      string
+	AuthMount string
+	JWTFile   string
+
+	// Client makes the requests.
+	Client *http.Client
+}
+
+// Vault reads secrets of a Vault KV secrets engine.
+type Vault struct {
+	opts VaultOptions
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// now is replaced by tests.
+var now = time.Now
+
+// NewVault returns a Vault client. The CA bundle "caFile", when set, is
+// trusted for the server's certificate.
+func NewVault(opts VaultOptions, caFile string, timeout time.Duration) (*Vault, error) {
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: timeout}
+		if caFile != "" {
+			ca, err := os.ReadFile(caFile) //#nosec G304
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("%s holds no PEM certificate", caFile)
+			}
+			opts.Client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}}
+		}
+	}
+	if opts.KVVersion == 0 {
+		opts.KVVersion = 2
+	}
+	if opts.AuthMount == "" {
+		opts.AuthMount = "kubernetes"
+	}
+	if opts.JWTFile == "" {
+		opts.JWTFile = ServiceAccountTokenFile
+	}
+	opts.Address = strings.TrimSuffix(opts.Address, "/")
+	return &Vault{opts: opts}, nil
+}
+
+// vaultResponse holds the fields of Vault responses the client reads.
+type vaultResponse struct {
+	Data          json.RawMessage `json:"data"`
+	LeaseDuration int             `json:"lease_duration"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// Read returns the secret at "path", whose first segment is the mount of the
+// KV secrets engine. Values must be strings.
+func (v *Vault) Read(ctx context.Context, path string) (*Values, error) {
+	mount, secretPath, ok := strings.Cut(path, "/")
+	if !ok {
+		return nil, fmt.Errorf("%s: no secret path after the mount", path)
+	}
+	endpoint := "/v1/" + mount + "/" + secretPath
+	if v.opts.KVVersion == 2 {
+		endpoint = "/v1/" + mount + "/data/" + secretPath
+	}
+
+	token, err := v.clientToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.do(ctx, http.MethodGet, endpoint, token, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	values := &Values{Data: map[string][]byte{}, TTL: time.Duration(resp.LeaseDuration) * time.Second}
+	var data map[string]interface{}
+	if v.opts.KVVersion == 2 {
+		var kv struct {
+			Data     map[string]interface{} `json:"data"`
+			Metadata struct {
+				Version int `json:"version"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(resp.Data, &kv); err != nil {
+			return nil, err
+		}
+		if kv.Data == nil {
+			return nil, fmt.Errorf("%s was deleted", path)
+		}
+		data = kv.Data
+		values.Version = strconv.Itoa(kv.Metadata.Version)
+	} else if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return nil, err
+	}
+
+	for key, value := range data {
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: the value of %s is not a string", path, key)
+		}
+		values.Data[key] = []byte(s)
+	}
+	return values, nil
+}
+
+// clientToken returns the token of the TokenFile, or logs in with the
+// Kubernetes auth method once the last login token expires.
+func (v *Vault) clientToken(ctx context.Context) (string, error) {
+	if v.opts.TokenFile != "" {
+		token, err := os.ReadFile(v.opts.TokenFile)
+		return strings.TrimSpace(string(token)), err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.token != "" && now().Before(v.expires) {
+		return v.token, nil
+	}
+
+	jwt, err := os.ReadFile(v.opts.JWTFile)
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(map[string]string{"role": v.opts.Role, "jwt": strings.TrimSpace(string(jwt))})
+	if err != nil {
+		return "", err
+	}
+	resp, err := v.do(ctx, http.MethodPost, "/v1/auth/"+v.opts.AuthMount+"/login", "", body)
+	if err != nil {
+		return "", err
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return "", errors.New("Vault login returned no token")
+	}
+
+	// Log in again before the token expires rather than renewing it
+	v.token = resp.Auth.ClientToken
+	v.expires = now().Add(time.Duration(resp.Auth.LeaseDuration) * time.Second * 9 / 10)
+	return v.token, nil
+}
+
+func (v *Vault) do(ctx context.Context, method, endpoint, token string, body []byte) (*vaultResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, method, v.opts.Address+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	httpResp, err := v.opts.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	encoded, err := io.ReadAll(io.LimitReader(httpResp.Body, 1024*1024))
+	if err != nil {
+		return nil, err
+	}
+	resp := &vaultResponse{}
+	if len(encoded) > 0 {
+		if err := json.Unmarshal(encoded, resp); err != nil && httpResp.StatusCode == http.StatusOK {
+			return nil, err
+		}
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s returned %s: %s", method, endpoint, httpResp.Status, strings.Join(resp.Errors, "; "))
+	}
+	return resp, nil
+}
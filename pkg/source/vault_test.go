@@ -0,0 +1,151 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// vaultStub is an in-process stand-in for a Vault server with a KV version 2
+// engine mounted at secret/ and the Kubernetes auth method.
+type vaultStub struct {
+	secrets map[string]map[string]interface{}
+	version int
+	logins  int
+}
+
+func (s *vaultStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v1/auth/kubernetes/login" {
+		var login map[string]string
+		json.NewDecoder(r.Body).Decode(&login)
+		if login["role"] != "provider-credential-controller" || login["jwt"] != "service-account-token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors": ["permission denied"]}`))
+			return
+		}
+		s.logins++
+		w.Write([]byte(`{"auth": {"client_token": "login-token", "lease_duration": 3600}}`))
+		return
+	}
+
+	if token := r.Header.Get("X-Vault-Token"); token != "login-token" && token != "file-token" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errors": ["permission denied"]}`))
+		return
+	}
+	data, ok := s.secrets[strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors": []}`))
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"lease_duration": 0,
+		"data": map[string]interface{}{
+			"data":     data,
+			"metadata": map[string]interface{}{"version": s.version},
+		},
+	})
+}
+
+func TestParseRef(t *testing.T) {
+
+	ref, err := ParseRef("vault://secret/aws/prod")
+	assert.Nil(t, err)
+	assert.Equal(t, Ref{Scheme: VaultScheme, Path: "secret/aws/prod"}, ref)
+	assert.Equal(t, "vault://secret/aws/prod", ref.String())
+
+	for _, value := range []string{"secret/aws/prod", "vault://secret", "vault://secret/aws?version=2", "vault://user@secret/aws"} {
+		_, err := ParseRef(value)
+		assert.NotNil(t, err, value)
+	}
+}
+
+func TestVaultKubernetesAuth(t *testing.T) {
+
+	stub := &vaultStub{
+		secrets: map[string]map[string]interface{}{
+			"aws/prod": {"aws_access_key_id": "AKID", "aws_secret_access_key": "secret"},
+		},
+		version: 3,
+	}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	jwtFile := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, os.WriteFile(jwtFile, []byte("service-account-token\n"), 0600))
+
+	vault, err := NewVault(VaultOptions{Address: server.URL + "/", Role: "provider-credential-controller", JWTFile: jwtFile}, "", time.Second)
+	assert.Nil(t, err)
+
+	values, err := vault.Read(context.Background(), "secret/aws/prod")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]byte{"aws_access_key_id": []byte("AKID"), "aws_secret_access_key": []byte("secret")}, values.Data)
+	assert.Equal(t, "3", values.Version)
+
+	// The login token is reused until it expires
+	_, err = vault.Read(context.Background(), "secret/aws/prod")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stub.logins)
+
+	now = func() time.Time { return time.Now().Add(time.Hour) }
+	defer func() { now = time.Now }()
+	_, err = vault.Read(context.Background(), "secret/aws/prod")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, stub.logins)
+
+	_, err = vault.Read(context.Background(), "secret/aws/missing")
+	assert.NotNil(t, err, "Not nil, when the secret does not exist")
+}
+
+func TestVaultTokenFile(t *testing.T) {
+
+	stub := &vaultStub{secrets: map[string]map[string]interface{}{"ans": {"host": "https://tower", "token": 42}}}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("file-token"), 0600))
+
+	vault, err := NewVault(VaultOptions{Address: server.URL, TokenFile: tokenFile}, "", time.Second)
+	assert.Nil(t, err)
+
+	_, err = vault.Read(context.Background(), "secret/ans")
+	assert.NotNil(t, err, "Not nil, when a value is not a string")
+	assert.Contains(t, err.Error(), "token")
+
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("revoked"), 0600))
+	_, err = vault.Read(context.Background(), "secret/ans")
+	assert.NotNil(t, err, "Not nil, when the token is rejected")
+	assert.Contains(t, err.Error(), "permission denied")
+}
+
+func TestVaultKVVersion1(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/kv/vmw", r.URL.Path)
+		w.Write([]byte(`{"lease_duration": 600, "data": {"username": "admin", "password": "secret"}}`))
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("file-token"), 0600))
+
+	vault, err := NewVault(VaultOptions{Address: server.URL, KVVersion: 1, TokenFile: tokenFile}, "", time.Second)
+	assert.Nil(t, err)
+
+	values, err := vault.Read(context.Background(), "kv/vmw")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]byte{"username": []byte("admin"), "password": []byte("secret")}, values.Data)
+	assert.Equal(t, 10*time.Minute, values.TTL)
+}
@@ -0,0 +1,69 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package transform
+
+import (
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// OvirtConfig is the ovirt-config.yaml file the OpenShift installer reads to
+// reach Red Hat Virtualization.
+type OvirtConfig struct {
+	URL      string `json:"ovirt_url"`
+	Username string `json:"ovirt_username"`
+	Password string `json:"ovirt_password"`
+	CABundle string `json:"ovirt_ca_bundle"`
+}
+
+// ovirtLegacyConfig is the ovirt-config.yaml layout of earlier releases,
+// which wrote the values unquoted.
+const ovirtLegacyConfig = `ovirt_url: %s
+ovirt_username: %s
+ovirt_password: %s
+ovirt_ca_bundle: |+
+  %s`
+
+// ovirtConfig renders the ovirt-config.yaml of the Provider secret "values".
+// Values that the layout of earlier releases holds intact are rendered in
+// it, byte for byte, so existing copies are not rewritten. Otherwise every
+// value is encoded by the YAML encoder, so passwords holding ": ", "#" or
+// quotes and multi-certificate CA bundles come back unchanged, which is
+// verified before the file is used.
+func ovirtConfig(values map[string]string) (string, error) {
+	config := OvirtConfig{
+		URL:      values["ovirt_url"],
+		Username: values["ovirt_username"],
+		Password: values["ovirt_password"],
+		CABundle: values["ovirt_ca_bundle"],
+	}
+
+	legacy := fmt.Sprintf(ovirtLegacyConfig, config.URL, config.Username, config.Password,
+		strings.ReplaceAll(config.CABundle, "\n", "\n  "))
+	if roundTrips([]byte(legacy), config) == nil {
+		return legacy, nil
+	}
+
+	rendered, err := yaml.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	if err := roundTrips(rendered, config); err != nil {
+		return "", err
+	}
+	return string(rendered), nil
+}
+
+// roundTrips reports whether "rendered" parses back to "config".
+func roundTrips(rendered []byte, config OvirtConfig) error {
+	var parsed OvirtConfig
+	if err := yaml.UnmarshalStrict(rendered, &parsed); err != nil {
+		return fmt.Errorf("ovirt-config.yaml does not parse: %w", err)
+	}
+	if parsed != config {
+		return fmt.Errorf("ovirt-config.yaml does not round-trip")
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+// Package transform reshapes the data propagated to copies so it matches
+// what their consumers expect: keys can be renamed, rendered from a Go
+// template over the Provider secret's keys, and encoded.
+//
+// Templates only see the Provider secret's values, as strings keyed by data
+// key, and the functions listed in funcs: they cannot read files, the
+// environment or the cluster. A missing key renders as an empty string.
+package transform
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Encodings applied to a transform's value.
+const (
+	Base64 = "base64"
+	JSON   = "json"
+	YAML   = "yaml"
+)
+
+// maxValueSize bounds a rendered value to the size limit of a secret.
+const maxValueSize = 1024 * 1024
+
+// Transform sets the data key Key of copies, from the Provider secret's key
+// From (a rename, From is no longer propagated) or by rendering Template,
+// then encodes the value when Encode is set.
+type Transform struct {
+	Key      string `json:"key"`
+	From     string `json:"from,omitempty"`
+	Template string `json:"template,omitempty"`
+	Encode   string `json:"encode,omitempty"`
+}
+
+var funcs = template.FuncMap{
+	// indent indents every line after the first by "n" spaces, for values
+	// nested in a YAML block scalar.
+	"indent": func(n int, value string) string {
+		return strings.ReplaceAll(value, "\n", "\n"+strings.Repeat(" ", n))
+	},
+	"b64enc": func(value string) string {
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	},
+	"json": func(value string) (string, error) {
+		encoded, err := encode(JSON, []byte(value))
+		return string(encoded), err
+	},
+	"yaml": func(value string) (string, error) {
+		encoded, err := encode(YAML, []byte(value))
+		return strings.TrimSuffix(string(encoded), "\n"), err
+	},
+	// ovirtConfig renders the Provider secret as an ovirt-config.yaml file.
+	"ovirtConfig": ovirtConfig,
+}
+
+// Validate reports the first invalid setting of "t".
+func (t Transform) Validate() error {
+	if t.Key == "" {
+		return errors.New("key is required")
+	}
+	if (t.From == "") == (t.Template == "") {
+		return fmt.Errorf("%s: exactly one of from and template must be set", t.Key)
+	}
+	if t.Template != "" {
+		if _, err := t.parse(); err != nil {
+			return fmt.Errorf("%s: %w", t.Key, err)
+		}
+	}
+	switch t.Encode {
+	case "", Base64, JSON, YAML:
+	default:
+		return fmt.Errorf("%s: encode must be one of %s, %s or %s, got %q", t.Key, Base64, JSON, YAML, t.Encode)
+	}
+	return nil
+}
+
+func (t Transform) parse() (*template.Template, error) {
+	return template.New(t.Key).Funcs(funcs).Option("missingkey=zero").Parse(t.Template)
+}
+
+// Validate reports the first invalid transform of "transforms".
+func Validate(transforms []Transform) error {
+	for _, t := range transforms {
+		if err := t.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parse decodes and validates a JSON list of transforms, as set in an
+// annotation. Unknown fields are rejected.
+func Parse(value string) ([]Transform, error) {
+	transforms := []Transform{}
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&transforms); err != nil {
+		return nil, err
+	}
+	return transforms, Validate(transforms)
+}
+
+// Apply returns "data" reshaped by "transforms", in order. Templates and
+// renames read "source", the keys of the Provider secret they may see.
+func Apply(transforms []Transform, source, data map[string][]byte) (map[string][]byte, error) {
+	values := map[string]string{}
+	for key, value := range source {
+		values[key] = string(value)
+	}
+
+	result := map[string][]byte{}
+	for key, value := range data {
+		result[key] = value
+	}
+
+	for _, t := range transforms {
+		var value []byte
+		if t.From != "" {
+			value = source[t.From]
+			delete(result, t.From)
+		} else {
+			tmpl, err := t.parse()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", t.Key, err)
+			}
+			var rendered bytes.Buffer
+			if err := tmpl.Execute(&limitedWriter{w: &rendered, remaining: maxValueSize}, values); err != nil {
+				return nil, fmt.Errorf("%s: %w", t.Key, err)
+			}
+			value = rendered.Bytes()
+		}
+
+		encoded, err := encode(t.Encode, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", t.Key, err)
+		}
+		result[t.Key] = encoded
+	}
+	return result, nil
+}
+
+func encode(encoding string, value []byte) ([]byte, error) {
+	switch encoding {
+	case "":
+		return value, nil
+	case Base64:
+		return []byte(base64.StdEncoding.EncodeToString(value)), nil
+	case JSON:
+		return json.Marshal(string(value))
+	case YAML:
+		return yaml.Marshal(string(value))
+	}
+	return nil, fmt.Errorf("unknown encoding %q", encoding)
+}
+
+// limitedWriter fails a template that renders more than "remaining" bytes.
+type limitedWriter struct {
+	w         *bytes.Buffer
+	remaining int
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > l.remaining {
+		return 0, fmt.Errorf("rendered value exceeds %d bytes", maxValueSize)
+	}
+	l.remaining -= len(p)
+	return l.w.Write(p)
+}
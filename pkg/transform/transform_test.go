@@ -0,0 +1,136 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package transform
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/yaml"
+)
+
+var source = map[string][]byte{
+	"host":  []byte("https://tower.example.com"),
+	"token": []byte("t0k\"en"),
+	"ca":    []byte("line1\nline2"),
+}
+
+func TestApply(t *testing.T) {
+
+	data, err := Apply([]Transform{
+		{Key: "url", From: "host"},
+		{Key: "token.json", Template: `{"token": {{ json .token }}}`},
+		{Key: "config.yaml", Template: "ca: |\n  {{ indent 2 .ca }}\nmissing: {{ .missing }}"},
+		{Key: "token.b64", From: "token", Encode: Base64},
+		{Key: "quoted", Template: "{{ .token }}", Encode: JSON},
+		{Key: "dashed", Template: `{{ index . "host" | yaml }}`},
+	}, source, map[string][]byte{"host": source["host"], "token": source["token"]})
+
+	assert.Nil(t, err, "Nil, when the transforms are valid")
+	assert.Equal(t, map[string][]byte{
+		"url":         []byte("https://tower.example.com"),
+		"token.json":  []byte(`{"token": "t0k\"en"}`),
+		"config.yaml": []byte("ca: |\n  line1\n  line2\nmissing: "),
+		"token.b64":   []byte("dDBrImVu"),
+		"quoted":      []byte(`"t0k\"en"`),
+		"dashed":      []byte("https://tower.example.com"),
+	}, data, "Renamed keys are no longer propagated")
+}
+
+func TestApplyLimit(t *testing.T) {
+
+	huge := map[string][]byte{"value": []byte(strings.Repeat("x", maxValueSize/2+1))}
+	_, err := Apply([]Transform{{Key: "big", Template: "{{ .value }}{{ .value }}"}}, huge, nil)
+	assert.NotNil(t, err, "Not nil, when the rendered value exceeds the size of a secret")
+}
+
+func TestParse(t *testing.T) {
+
+	transforms, err := Parse(`[{"key": "url", "from": "host"}]`)
+	assert.Nil(t, err, "Nil, when the annotation is valid")
+	assert.Equal(t, []Transform{{Key: "url", From: "host"}}, transforms)
+
+	for name, value := range map[string]string{
+		"not json":          `url: host`,
+		"unknown field":     `[{"key": "url", "form": "host"}]`,
+		"missing key":       `[{"from": "host"}]`,
+		"from and template": `[{"key": "url", "from": "host", "template": "x"}]`,
+		"neither":           `[{"key": "url"}]`,
+		"bad template":      `[{"key": "url", "template": "{{ .host "}]`,
+		"unknown function":  `[{"key": "url", "template": "{{ env \"HOME\" }}"}]`,
+		"unknown encoding":  `[{"key": "url", "from": "host", "encode": "rot13"}]`,
+	} {
+		_, err := Parse(value)
+		assert.NotNil(t, err, "Not nil, when the annotation has a %s", name)
+	}
+}
+
+func TestOvirtConfig(t *testing.T) {
+
+	bundle := "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n" +
+		"-----BEGIN CERTIFICATE-----\nMIIC\n-----END CERTIFICATE-----\n"
+
+	for _, password := range []string{
+		"plain",
+		"p@ss: word",
+		"pass #comment",
+		"'quoted",
+		"\"double",
+		"- dash",
+		"{flow: map}",
+		"[list]",
+		"&anchor *alias",
+		"|block",
+		"yes",
+		"0x1F",
+		"  spaces  ",
+		"line\nbreak",
+		"",
+	} {
+		rendered, err := ovirtConfig(map[string]string{
+			"ovirt_url":       "https://rhv.example.com/ovirt-engine/api",
+			"ovirt_username":  "admin@internal",
+			"ovirt_password":  password,
+			"ovirt_ca_bundle": bundle,
+		})
+		assert.Nil(t, err, "Nil, when the password is %q", password)
+
+		var parsed OvirtConfig
+		assert.Nil(t, yaml.UnmarshalStrict([]byte(rendered), &parsed))
+		assert.Equal(t, password, parsed.Password)
+		assert.Equal(t, bundle, parsed.CABundle, "Every certificate of the bundle is kept")
+	}
+}
+
+func TestOvirtConfigLegacyLayout(t *testing.T) {
+
+	rendered, err := ovirtConfig(map[string]string{
+		"ovirt_url":      "https://rhv.example.com/ovirt-engine/api",
+		"ovirt_username": "admin@internal",
+		"ovirt_password": "plain-password",
+		"ovirt_ca_bundle": "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n" +
+			"-----BEGIN CERTIFICATE-----\nMIIC\n-----END CERTIFICATE-----\n",
+	})
+	assert.Nil(t, err, "Nil, when the values are plain")
+	assert.Equal(t, `ovirt_url: https://rhv.example.com/ovirt-engine/api
+ovirt_username: admin@internal
+ovirt_password: plain-password
+ovirt_ca_bundle: |+
+  -----BEGIN CERTIFICATE-----
+  MIIB
+  -----END CERTIFICATE-----
+  -----BEGIN CERTIFICATE-----
+  MIIC
+  -----END CERTIFICATE-----
+  `, rendered, "Values the earlier layout holds intact are rendered in it, byte for byte")
+
+	rendered, err = ovirtConfig(map[string]string{
+		"ovirt_url":       "https://rhv.example.com/ovirt-engine/api",
+		"ovirt_username":  "admin@internal",
+		"ovirt_password":  "p@ss: word",
+		"ovirt_ca_bundle": "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+	})
+	assert.Nil(t, err, "Nil, when the password holds \": \"")
+	assert.NotContains(t, rendered, "ovirt_password: p@ss: word", "Other values are encoded")
+}
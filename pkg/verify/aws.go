@@ -0,0 +1,119 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package verify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	awsEndpoint = "https://sts.amazonaws.com"
+	awsRegion   = "us-east-1"
+	awsService  = "sts"
+
+	getCallerIdentity = "Action=GetCallerIdentity&Version=2011-06-15"
+)
+
+// now is replaced by tests.
+var now = time.Now
+
+// aws calls STS GetCallerIdentity, which any valid access key may call.
+type aws struct {
+	Options
+}
+
+func (a aws) Verify(ctx context.Context, data map[string][]byte) error {
+	values, err := required(data, "aws_access_key_id", "aws_secret_access_key")
+	if err != nil {
+		return err
+	}
+
+	endpoint := a.endpoint(awsEndpoint) + "/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(getCallerIdentity))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signV4(req, []byte(getCallerIdentity), values[0], values[1], awsRegionOf(req.URL), awsService, now())
+
+	_, err = do(a.client(), req, http.StatusOK)
+	return err
+}
+
+// awsRegionOf returns the region of a regional STS endpoint such as
+// sts.eu-west-1.amazonaws.com. Other endpoints sign for us-east-1.
+func awsRegionOf(u *url.URL) string {
+	parts := strings.Split(u.Hostname(), ".")
+	if len(parts) == 4 && parts[0] == "sts" && parts[2] == "amazonaws" {
+		return parts[1]
+	}
+	return awsRegion
+}
+
+// signV4 adds the AWS Signature Version 4 headers to "req", whose body is
+// "body", signing its host, X-Amz-Date and any Content-Type headers.
+func signV4(req *http.Request, body []byte, accessKey, secretKey, region, service string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host, "x-amz-date": amzDate}
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		headers["content-type"] = contentType
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + strings.TrimSpace(headers[name]) + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		canonicalHeaders,
+		signedHeaders,
+		hexSHA256(body),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hexSHA256([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,165 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package verify
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	azureEndpoint = "https://login.microsoftonline.com"
+	azureScope    = "https://management.azure.com/.default"
+
+	gcpEndpoint = "https://oauth2.googleapis.com/token"
+	gcpScope    = "https://www.googleapis.com/auth/cloud-platform"
+	jwtBearer   = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+)
+
+// token posts the OAuth 2.0 "form" to "endpoint" and checks that an access
+// token is returned.
+func token(ctx context.Context, client *http.Client, endpoint string, form url.Values) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body, err := do(client, req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+
+	var response struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || response.AccessToken == "" {
+		return fmt.Errorf("POST %s returned no access token", endpoint)
+	}
+	return nil
+}
+
+// azure acquires a token for the service principal with its client secret.
+type azure struct {
+	Options
+}
+
+func (a azure) Verify(ctx context.Context, data map[string][]byte) error {
+	values, err := required(data, "osServicePrincipal.json")
+	if err != nil {
+		return err
+	}
+	var principal struct {
+		ClientID     string `json:"clientId"`
+		ClientSecret string `json:"clientSecret"`
+		TenantID     string `json:"tenantId"`
+	}
+	if err := json.Unmarshal([]byte(values[0]), &principal); err != nil {
+		return fmt.Errorf("osServicePrincipal.json: %w", err)
+	}
+	if principal.ClientID == "" || principal.ClientSecret == "" || principal.TenantID == "" {
+		return errors.New("osServicePrincipal.json: clientId, clientSecret and tenantId are required")
+	}
+
+	return token(ctx, a.client(), a.endpoint(azureEndpoint)+"/"+url.PathEscape(principal.TenantID)+"/oauth2/v2.0/token", url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {principal.ClientID},
+		"client_secret": {principal.ClientSecret},
+		"scope":         {azureScope},
+	})
+}
+
+// gcp exchanges a JWT signed with the service account key for a token.
+type gcp struct {
+	Options
+}
+
+func (g gcp) Verify(ctx context.Context, data map[string][]byte) error {
+	values, err := required(data, "osServiceAccount.json")
+	if err != nil {
+		return err
+	}
+	var account struct {
+		ClientEmail  string `json:"client_email"`
+		PrivateKeyID string `json:"private_key_id"`
+		PrivateKey   string `json:"private_key"`
+	}
+	if err := json.Unmarshal([]byte(values[0]), &account); err != nil {
+		return fmt.Errorf("osServiceAccount.json: %w", err)
+	}
+	if account.ClientEmail == "" || account.PrivateKey == "" {
+		return errors.New("osServiceAccount.json: client_email and private_key are required")
+	}
+	key, err := rsaPrivateKey(account.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("osServiceAccount.json: private_key: %w", err)
+	}
+
+	// The token_uri of the key is ignored, so a secret cannot point the
+	// controller at another URL
+	endpoint := g.endpoint(gcpEndpoint)
+
+	issued := now().Unix()
+	assertion, err := signJWT(key, map[string]string{"alg": "RS256", "typ": "JWT", "kid": account.PrivateKeyID}, map[string]interface{}{
+		"iss":   account.ClientEmail,
+		"scope": gcpScope,
+		"aud":   endpoint,
+		"iat":   issued,
+		"exp":   issued + 3600,
+	})
+	if err != nil {
+		return err
+	}
+	return token(ctx, g.client(), endpoint, url.Values{"grant_type": {jwtBearer}, "assertion": {assertion}})
+}
+
+// rsaPrivateKey decodes the PEM encoded PKCS #8 or PKCS #1 RSA key "value".
+func rsaPrivateKey(value string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(value))
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// signJWT returns the RS256 JSON Web Token of "header" and "claims".
+func signJWT(key *rsa.PrivateKey, header map[string]string, claims map[string]interface{}) (string, error) {
+	encodedHeader, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	encodedClaims, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(encodedHeader) + "." + base64.RawURLEncoding.EncodeToString(encodedClaims)
+
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,199 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+// Package verify checks that a rotated credential is accepted by its
+// provider before it is propagated, so a mistyped secret is not copied to
+// every cluster.
+//
+// The built-in verifiers make the cheapest authenticated call each provider
+// offers and never change anything: AWS STS GetCallerIdentity, an Azure
+// client credentials token, a GCP service account token, a vSphere session
+// that is logged out again and the Ansible Tower /api/v2/me endpoint. Each
+// calls the provider's public endpoint unless an endpoint is given, which
+// also lets them be pointed at local stand-in servers.
+package verify
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout bounds a verification when no HTTP client is given.
+const DefaultTimeout = 10 * time.Second
+
+// Verifier checks the credential held in the data of a Provider secret.
+type Verifier interface {
+	Verify(ctx context.Context, data map[string][]byte) error
+}
+
+// Func adapts a function to the Verifier interface.
+type Func func(ctx context.Context, data map[string][]byte) error
+
+func (f Func) Verify(ctx context.Context, data map[string][]byte) error {
+	return f(ctx, data)
+}
+
+// Options configure a built-in verifier.
+type Options struct {
+	// Endpoint replaces the URL of the provider's API, or, for vSphere and
+	// Ansible, the vCenter and host of the secret.
+	Endpoint string
+
+	// Client makes the requests. Defaults to a client with DefaultTimeout.
+	Client *http.Client
+}
+
+func (o Options) client() *http.Client {
+	if o.Client != nil {
+		return o.Client
+	}
+	return &http.Client{Timeout: DefaultTimeout}
+}
+
+func (o Options) endpoint(defaultEndpoint string) string {
+	if o.Endpoint != "" {
+		return strings.TrimSuffix(o.Endpoint, "/")
+	}
+	return strings.TrimSuffix(defaultEndpoint, "/")
+}
+
+// builtIn lists the built-in verifiers by provider type.
+var builtIn = map[string]func(Options) Verifier{
+	"ans": func(o Options) Verifier { return ansible{o} },
+	"aws": func(o Options) Verifier { return aws{o} },
+	"azr": func(o Options) Verifier { return azure{o} },
+	"gcp": func(o Options) Verifier { return gcp{o} },
+	"vmw": func(o Options) Verifier { return vsphere{o} },
+}
+
+// HasBuiltIn returns true if "providerType" has a built-in verifier.
+func HasBuiltIn(providerType string) bool {
+	_, ok := builtIn[providerType]
+	return ok
+}
+
+// BuiltIn returns the built-in verifier of "providerType", or nil.
+func BuiltIn(providerType string, opts Options) Verifier {
+	if newVerifier, ok := builtIn[providerType]; ok {
+		return newVerifier(opts)
+	}
+	return nil
+}
+
+// required returns the values of "keys" in "data", or an error naming the
+// first missing one.
+func required(data map[string][]byte, keys ...string) ([]string, error) {
+	values := []string{}
+	for _, key := range keys {
+		if len(data[key]) == 0 {
+			return nil, fmt.Errorf("%s is missing", key)
+		}
+		values = append(values, strings.TrimSpace(string(data[key])))
+	}
+	return values, nil
+}
+
+// do sends "req" and returns the response body when its status is one of
+// "expected". Other statuses are reported without the body: the URL may come
+// from the secret, and the error is recorded in an Event anyone reading
+// Events can see.
+func do(client *http.Client, req *http.Request, expected ...int) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return body, nil
+		}
+	}
+	return nil, fmt.Errorf("%s %s was rejected with %s", req.Method, req.URL.Redacted(), resp.Status)
+}
+
+// withRootCAs returns a copy of "client", keeping its timeout, whose
+// transport trusts the certificates of "pool" only.
+func withRootCAs(client *http.Client, pool *x509.CertPool) *http.Client {
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport)
+	}
+	transport = transport.Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+
+	copied := *client
+	copied.Transport = transport
+	return &copied
+}
+
+// ansible gets the user owning the token from the Ansible Tower API.
+type ansible struct {
+	Options
+}
+
+func (a ansible) Verify(ctx context.Context, data map[string][]byte) error {
+	values, err := required(data, "host", "token")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.endpoint(values[0])+"/api/v2/me/", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+values[1])
+	_, err = do(a.client(), req, http.StatusOK)
+	return err
+}
+
+// vsphere logs in to the vCenter REST API and logs out again. The vCenter's
+// certificate is verified with the cacertificate key when it is set.
+type vsphere struct {
+	Options
+}
+
+func (v vsphere) Verify(ctx context.Context, data map[string][]byte) error {
+	values, err := required(data, "vCenter", "username", "password")
+	if err != nil {
+		return err
+	}
+
+	client := v.client()
+	if ca := data["cacertificate"]; len(ca) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("cacertificate holds no PEM certificate")
+		}
+		client = withRootCAs(client, pool)
+	}
+
+	endpoint := v.endpoint("https://" + values[0])
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/api/session", nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(values[1], values[2])
+	body, err := do(client, req, http.StatusOK, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+
+	// Sessions count against the vCenter's limit until they time out
+	session := strings.Trim(strings.TrimSpace(string(body)), `"`)
+	req, err = http.NewRequestWithContext(ctx, http.MethodDelete, endpoint+"/api/session", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("vmware-api-session-id", session)
+	_, _ = do(client, req, http.StatusNoContent, http.StatusOK)
+	return nil
+}
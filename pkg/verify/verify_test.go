@@ -0,0 +1,295 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package verify
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignV4(t *testing.T) {
+
+	// The get-vanilla case of the AWS Signature Version 4 test suite
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	assert.Nil(t, err)
+	signV4(req, nil, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "service",
+		time.Date(2015, time.August, 30, 12, 36, 0, 0, time.UTC))
+
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+}
+
+func TestAWS(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, getCallerIdentity, string(body))
+
+		// Sign the request again with the secret key STS knows
+		expected, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.Path, nil)
+		expected.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+		amzDate, _ := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+		signV4(expected, body, "AKIDEXAMPLE", "secret", "us-east-1", "sts", amzDate)
+
+		if r.Header.Get("Authorization") != expected.Header.Get("Authorization") {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("<ErrorResponse><Error><Code>SignatureDoesNotMatch</Code></Error></ErrorResponse>"))
+			return
+		}
+		w.Write([]byte("<GetCallerIdentityResponse/>"))
+	}))
+	defer server.Close()
+
+	verifier := BuiltIn("aws", Options{Endpoint: server.URL})
+	assert.Nil(t, verifier.Verify(context.Background(), map[string][]byte{
+		"aws_access_key_id":     []byte("AKIDEXAMPLE"),
+		"aws_secret_access_key": []byte("secret"),
+	}))
+
+	err := verifier.Verify(context.Background(), map[string][]byte{
+		"aws_access_key_id":     []byte("AKIDEXAMPLE"),
+		"aws_secret_access_key": []byte("typo"),
+	})
+	assert.NotNil(t, err, "Not nil, when STS rejects the signature")
+	assert.Contains(t, err.Error(), "403")
+	assert.NotContains(t, err.Error(), "SignatureDoesNotMatch", "The response body is never reported")
+	assert.NotContains(t, err.Error(), "typo", "The secret is never reported")
+
+	err = verifier.Verify(context.Background(), map[string][]byte{"aws_access_key_id": []byte("AKIDEXAMPLE")})
+	assert.EqualError(t, err, "aws_secret_access_key is missing")
+}
+
+func TestAWSRegion(t *testing.T) {
+
+	for endpoint, region := range map[string]string{
+		"https://sts.amazonaws.com":           "us-east-1",
+		"https://sts.eu-west-1.amazonaws.com": "eu-west-1",
+		"http://127.0.0.1:8080":               "us-east-1",
+	} {
+		req, err := http.NewRequest(http.MethodPost, endpoint, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, region, awsRegionOf(req.URL), endpoint)
+	}
+}
+
+func TestAzure(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/tenant/oauth2/v2.0/token", r.URL.Path)
+		assert.Nil(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "client", r.PostForm.Get("client_id"))
+
+		if r.PostForm.Get("client_secret") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "invalid_client", "error_description": "AADSTS7000215: Invalid client secret provided."}`))
+			return
+		}
+		w.Write([]byte(`{"token_type": "Bearer", "access_token": "token"}`))
+	}))
+	defer server.Close()
+
+	verifier := BuiltIn("azr", Options{Endpoint: server.URL})
+	assert.Nil(t, verifier.Verify(context.Background(), map[string][]byte{
+		"osServicePrincipal.json": []byte(`{"clientId": "client", "clientSecret": "secret", "tenantId": "tenant", "subscriptionId": "subscription"}`),
+	}))
+
+	err := verifier.Verify(context.Background(), map[string][]byte{
+		"osServicePrincipal.json": []byte(`{"clientId": "client", "clientSecret": "typo", "tenantId": "tenant"}`),
+	})
+	assert.NotNil(t, err, "Not nil, when the client secret is rejected")
+	assert.Contains(t, err.Error(), "401")
+
+	err = verifier.Verify(context.Background(), map[string][]byte{
+		"osServicePrincipal.json": []byte(`{"clientId": "client", "tenantId": "tenant"}`),
+	})
+	assert.NotNil(t, err, "Not nil, when the client secret is missing")
+}
+
+func TestGCP(t *testing.T) {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Nil(t, err)
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, r.ParseForm())
+		assert.Equal(t, jwtBearer, r.PostForm.Get("grant_type"))
+
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		assert.Len(t, parts, 3)
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+		var decoded map[string]interface{}
+		assert.Nil(t, json.Unmarshal(claims, &decoded))
+		assert.Equal(t, "verifier@project.iam.gserviceaccount.com", decoded["iss"])
+		assert.Equal(t, server.URL+"/token", decoded["aud"])
+
+		if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant", "error_description": "Invalid JWT Signature."}`))
+			return
+		}
+		w.Write([]byte(`{"access_token": "token", "expires_in": 3599}`))
+	}))
+	defer server.Close()
+
+	account := func(privateKey []byte) map[string][]byte {
+		value, _ := json.Marshal(map[string]string{
+			"type":           "service_account",
+			"client_email":   "verifier@project.iam.gserviceaccount.com",
+			"private_key_id": "1",
+			"private_key":    string(privateKey),
+			"token_uri":      "https://oauth2.googleapis.com/token",
+		})
+		return map[string][]byte{"osServiceAccount.json": value}
+	}
+
+	verifier := BuiltIn("gcp", Options{Endpoint: server.URL + "/token"})
+	assert.Nil(t, verifier.Verify(context.Background(), account(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))))
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	err = verifier.Verify(context.Background(), account(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(other)})))
+	assert.NotNil(t, err, "Not nil, when the key is not the service account's")
+	assert.Contains(t, err.Error(), "400")
+
+	err = verifier.Verify(context.Background(), account([]byte("not a key")))
+	assert.NotNil(t, err, "Not nil, when the key does not parse")
+}
+
+// roundTripFunc answers the requests of an http.Client.
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestGCPTokenURI(t *testing.T) {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("The token_uri of the secret is called")
+	}))
+	defer internal.Close()
+
+	value, _ := json.Marshal(map[string]string{
+		"client_email": "verifier@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		"token_uri":    internal.URL,
+	})
+
+	called := []string{}
+	verifier := BuiltIn("gcp", Options{Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		called = append(called, req.URL.String())
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"access_token": "token"}`)),
+		}, nil
+	})}})
+	assert.Nil(t, verifier.Verify(context.Background(), map[string][]byte{"osServiceAccount.json": value}))
+	assert.Equal(t, []string{gcpEndpoint}, called, "The Google endpoint is called instead")
+}
+
+func TestVSphere(t *testing.T) {
+
+	loggedOut := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/session", r.URL.Path)
+		switch r.Method {
+		case http.MethodPost:
+			if username, password, _ := r.BasicAuth(); username != "administrator@vsphere.local" || password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error_type": "UNAUTHENTICATED"}`))
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`"session"`))
+		case http.MethodDelete:
+			loggedOut = r.Header.Get("vmware-api-session-id") == "session"
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	verifier := BuiltIn("vmw", Options{Endpoint: server.URL})
+	assert.Nil(t, verifier.Verify(context.Background(), map[string][]byte{
+		"vCenter":  []byte("vcenter.example.com"),
+		"username": []byte("administrator@vsphere.local"),
+		"password": []byte("secret"),
+	}))
+	assert.True(t, loggedOut, "The session is logged out")
+
+	err := verifier.Verify(context.Background(), map[string][]byte{
+		"vCenter":  []byte("vcenter.example.com"),
+		"username": []byte("administrator@vsphere.local"),
+		"password": []byte("typo"),
+	})
+	assert.NotNil(t, err, "Not nil, when the login is rejected")
+	assert.Contains(t, err.Error(), "401")
+	assert.NotContains(t, err.Error(), "UNAUTHENTICATED", "The response body is never reported")
+}
+
+func TestAnsible(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v2/me/", r.URL.Path)
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"detail": "Authentication credentials were not provided."}`))
+			return
+		}
+		w.Write([]byte(`{"count": 1, "results": [{"username": "admin"}]}`))
+	}))
+	defer server.Close()
+
+	// The host of the secret is the endpoint
+	verifier := BuiltIn("ans", Options{})
+	assert.Nil(t, verifier.Verify(context.Background(), map[string][]byte{
+		"host":  []byte(server.URL + "/"),
+		"token": []byte("token"),
+	}))
+
+	verifier = BuiltIn("ans", Options{Endpoint: server.URL})
+	err := verifier.Verify(context.Background(), map[string][]byte{
+		"host":  []byte("https://tower.example.com"),
+		"token": []byte("typo"),
+	})
+	assert.NotNil(t, err, "Not nil, when the token is rejected")
+	assert.Contains(t, err.Error(), "401")
+}
+
+func TestBuiltIn(t *testing.T) {
+
+	for _, providerType := range []string{"ans", "aws", "azr", "gcp", "vmw"} {
+		assert.True(t, HasBuiltIn(providerType), providerType)
+		assert.NotNil(t, BuiltIn(providerType, Options{}), providerType)
+	}
+	for _, providerType := range []string{"ost", "redhatvirtualization"} {
+		assert.False(t, HasBuiltIn(providerType), providerType)
+		assert.Nil(t, BuiltIn(providerType, Options{}), providerType)
+	}
+}
@@ -0,0 +1,7 @@
+// Copyright Contributors to the Open Cluster Management project.
+
+package version
+
+// Version is the controller version, set at build time with
+// -ldflags "-X github.com/stolostron/provider-credential-controller/pkg/version.Version=<version>".
+var Version = "unknown"